@@ -0,0 +1,296 @@
+// Package apiclient is a typed client of the HTTP API of a wssocks server, following the
+// OpenAPI document the server serves at /api/openapi.json.
+package apiclient
+
+//go:generate go run generate.go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error is returned for requests refused by the server
+type Error struct {
+	StatusCode int // 200 for operations the server reported as failed
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == http.StatusOK {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Client calls the API of a wssocks server
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// New creates a client for the API at baseURL, such as http://localhost:8765, authenticating
+// with apiKey
+func New(baseURL string, apiKey string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for requests
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	c.httpClient = httpClient
+	return c
+}
+
+// Status returns the server version and the tokens visible to the key
+func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
+	var status StatusResponse
+	if err := c.do(ctx, http.MethodGet, "/api/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// OpenAPI returns the OpenAPI document of the API
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var spec json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/api/openapi.json", nil, &spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// AddToken adds a token and returns it, with the SOCKS port of reverse tokens
+func (c *Client) AddToken(ctx context.Context, req TokenRequest) (*TokenResponse, error) {
+	return c.result(ctx, http.MethodPost, "/api/token", req)
+}
+
+// UpdateToken changes the options of a reverse token and returns its SOCKS port
+func (c *Client) UpdateToken(ctx context.Context, token string, req TokenUpdateRequest) (int, error) {
+	resp, err := c.result(ctx, http.MethodPatch, "/api/token/"+url.PathEscape(token), req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Port, nil
+}
+
+// RemoveToken removes a token and disconnects its clients, returning the success reported by the
+// server
+func (c *Client) RemoveToken(ctx context.Context, token string) (bool, error) {
+	var resp TokenResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/token/"+url.PathEscape(token), nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Success, nil
+}
+
+// Connectors returns the connector tokens of a reverse token
+func (c *Client) Connectors(ctx context.Context, reverseToken string) ([]ConnectorStatus, error) {
+	var resp ConnectorsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/token/"+url.PathEscape(reverseToken)+"/connectors", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Connectors, nil
+}
+
+// RemoveConnectors removes the connector tokens of a reverse token, or only connectorToken if set
+func (c *Client) RemoveConnectors(ctx context.Context, reverseToken string, connectorToken string) error {
+	path := "/api/token/" + url.PathEscape(reverseToken) + "/connectors"
+	if connectorToken != "" {
+		path += "/" + url.PathEscape(connectorToken)
+	}
+	_, err := c.result(ctx, http.MethodDelete, path, nil)
+	return err
+}
+
+// Clients returns the connected clients visible to the key
+func (c *Client) Clients(ctx context.Context) ([]ClientStatus, error) {
+	var resp ClientsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/clients", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Clients, nil
+}
+
+// GetClient returns a connected client with its channels
+func (c *Client) GetClient(ctx context.Context, id string) (*ClientStatus, error) {
+	var client ClientStatus
+	if err := c.do(ctx, http.MethodGet, "/api/clients/"+url.PathEscape(id), nil, &client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// KickClient disconnects a client along with the other threads of its instance
+func (c *Client) KickClient(ctx context.Context, id string) error {
+	_, err := c.result(ctx, http.MethodDelete, "/api/clients/"+url.PathEscape(id), nil)
+	return err
+}
+
+// Channels returns the active channels visible to the key
+func (c *Client) Channels(ctx context.Context) ([]ChannelStatus, error) {
+	var resp ChannelsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/channels", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Channels, nil
+}
+
+// CloseChannel closes a channel on both sides
+func (c *Client) CloseChannel(ctx context.Context, id string) error {
+	_, err := c.result(ctx, http.MethodDelete, "/api/channels/"+url.PathEscape(id), nil)
+	return err
+}
+
+// Bans returns the bans of the server
+func (c *Client) Bans(ctx context.Context) ([]BanStatus, error) {
+	var resp BansResponse
+	if err := c.do(ctx, http.MethodGet, "/api/bans", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Bans, nil
+}
+
+// Ban bans a client instance or an IP
+func (c *Client) Ban(ctx context.Context, req BanRequest) error {
+	_, err := c.result(ctx, http.MethodPost, "/api/bans", req)
+	return err
+}
+
+// Unban lifts the ban of an instance or IP, reporting whether it existed
+func (c *Client) Unban(ctx context.Context, key string) (bool, error) {
+	var resp TokenResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/bans/"+url.PathEscape(key), nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Success, nil
+}
+
+// EventStream reads the events streamed by the server
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// Events streams the server events, only those of tokens and of types if given. The stream ends
+// when ctx is done or it is closed.
+func (c *Client) Events(ctx context.Context, tokens []string, types []EventType) (*EventStream, error) {
+	query := url.Values{"token": tokens}
+	for _, typ := range types {
+		query.Add("type", string(typ))
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/events?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream events: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return &EventStream{body: resp.Body, scanner: bufio.NewScanner(resp.Body)}, nil
+}
+
+// Next waits for the next event, io.EOF is returned once the stream ended
+func (s *EventStream) Next() (Event, error) {
+	for s.scanner.Scan() {
+		data, ok := strings.CutPrefix(s.scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return Event{}, fmt.Errorf("invalid event: %w", err)
+		}
+		return event, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// Close ends the stream
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// result sends a request answered with a TokenResponse, failures being returned as errors
+func (c *Client) result(ctx context.Context, method string, path string, body any) (*TokenResponse, error) {
+	var resp TokenResponse
+	if err := c.do(ctx, method, path, body, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		message := resp.Error
+		if message == "" {
+			message = "request failed"
+		}
+		return nil, &Error{StatusCode: http.StatusOK, Message: message}
+	}
+	return &resp, nil
+}
+
+// do sends a request with body encoded as JSON if set, and decodes the response into out
+func (c *Client) do(ctx context.Context, method string, path string, body any, out any) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid API response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body any) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-API-Key", c.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// responseError returns the error of a failed response, with the message given by the server
+// if any
+func responseError(resp *http.Response) error {
+	var result TokenResponse
+	if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Error != "" {
+		return &Error{StatusCode: resp.StatusCode, Message: result.Error}
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+}
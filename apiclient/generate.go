@@ -0,0 +1,250 @@
+//go:build ignore
+
+// This program generates types.go from the schemas of the OpenAPI document of the server, run
+// it with go generate. The document is the source of truth of the API, so the client types
+// are never edited by hand.
+//
+// Objects become structs, with optional properties omitted when empty. Optional date-times,
+// and all optional properties of schemas with x-go-nullable, are pointers so that unset values
+// differ from zero ones. String enums become named string types with constants. Property names
+// are converted to Go names unless given with x-go-name.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	specPath   = "../wssocks/openapi.json"
+	outputPath = "types.go"
+	refPrefix  = "#/components/schemas/"
+)
+
+// initialisms are the words of property names written in capitals in Go names
+var initialisms = map[string]bool{"id": true, "ids": true, "ip": true, "rtt": true, "url": true, "uuid": true}
+
+type schema struct {
+	Ref         string    `json:"$ref"`
+	Type        string    `json:"type"`
+	Format      string    `json:"format"`
+	Description string    `json:"description"`
+	Enum        []string  `json:"enum"`
+	Required    []string  `json:"required"`
+	Items       *schema   `json:"items"`
+	AllOf       []*schema `json:"allOf"`
+	Properties  schemas   `json:"properties"`
+	GoName      string    `json:"x-go-name"`
+	GoNullable  bool      `json:"x-go-nullable"`
+}
+
+// schemas are named schemas in the order of the document
+type schemas []namedSchema
+
+type namedSchema struct {
+	name   string
+	schema *schema
+}
+
+func (s *schemas) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value schema
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		*s = append(*s, namedSchema{name: key.(string), schema: &value})
+	}
+	return nil
+}
+
+func main() {
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var spec struct {
+		Components struct {
+			Schemas schemas `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by generate.go from the OpenAPI document of the server. DO NOT EDIT.\n\n")
+	buf.WriteString("package apiclient\n\nimport \"time\"\n")
+	for _, named := range spec.Components.Schemas {
+		if err := writeType(&buf, named.name, named.schema); err != nil {
+			log.Fatalf("schema %s: %v", named.name, err)
+		}
+	}
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(outputPath, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeType writes the Go type of a named schema
+func writeType(buf *bytes.Buffer, name string, s *schema) error {
+	buf.WriteString("\n")
+	writeDoc(buf, name, s.Description)
+
+	switch {
+	case s.Type == "string" && len(s.Enum) > 0:
+		fmt.Fprintf(buf, "type %s string\n\nconst (\n", name)
+		for _, value := range s.Enum {
+			fmt.Fprintf(buf, "%s%s %s = %q\n", name, goName(value), name, value)
+		}
+		buf.WriteString(")\n")
+		return nil
+	case s.Type == "object":
+		fmt.Fprintf(buf, "type %s struct {\n", name)
+		if err := writeFields(buf, s); err != nil {
+			return err
+		}
+		buf.WriteString("}\n")
+		return nil
+	case len(s.AllOf) > 0:
+		// Referenced parts are embedded, inline ones add their properties
+		fmt.Fprintf(buf, "type %s struct {\n", name)
+		for _, part := range s.AllOf {
+			if part.Ref != "" {
+				fmt.Fprintf(buf, "%s\n", strings.TrimPrefix(part.Ref, refPrefix))
+				continue
+			}
+			if err := writeFields(buf, part); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}\n")
+		return nil
+	}
+	return fmt.Errorf("unsupported schema type %q", s.Type)
+}
+
+// writeDoc writes the doc comment of a type
+func writeDoc(buf *bytes.Buffer, name, description string) {
+	fmt.Fprintf(buf, "// %s follows the %s schema", name, name)
+	if description != "" {
+		fmt.Fprintf(buf, ". %s", description)
+	}
+	buf.WriteString("\n")
+}
+
+// writeFields writes the struct fields of the properties of an object schema
+func writeFields(buf *bytes.Buffer, s *schema) error {
+	required := make(map[string]bool)
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	for _, property := range s.Properties {
+		typ, err := goType(property.schema)
+		if err != nil {
+			return fmt.Errorf("property %s: %w", property.name, err)
+		}
+		tag := property.name
+		if !required[property.name] {
+			tag += ",omitempty"
+			if s.GoNullable || typ == "time.Time" {
+				typ = "*" + typ
+			}
+		}
+
+		name := property.schema.GoName
+		if name == "" {
+			name = goName(property.name)
+		}
+		fmt.Fprintf(buf, "%s %s `json:%q`", name, typ, tag)
+		if comment := fieldComment(property.schema); comment != "" {
+			fmt.Fprintf(buf, " // %s", comment)
+		}
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+// fieldComment returns the description of a property, or the values of an enum
+func fieldComment(s *schema) string {
+	if s.Description != "" || len(s.Enum) == 0 {
+		return s.Description
+	}
+	values := make([]string, len(s.Enum))
+	for i, value := range s.Enum {
+		values[i] = fmt.Sprintf("%q", value)
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
+
+// goType returns the Go type of a property schema
+func goType(s *schema) (string, error) {
+	if s.Ref != "" {
+		return strings.TrimPrefix(s.Ref, refPrefix), nil
+	}
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			return "time.Time", nil
+		}
+		return "string", nil
+	case "integer":
+		if s.Format == "int64" {
+			return "int64", nil
+		}
+		return "int", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := goType(s.Items)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + item, nil
+	}
+	return "", fmt.Errorf("unsupported type %q", s.Type)
+}
+
+// goName converts a snake case name to an exported Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(name, "_") {
+		if word == "" {
+			continue
+		}
+		switch {
+		case word == "ids":
+			b.WriteString("IDs")
+		case initialisms[word]:
+			b.WriteString(strings.ToUpper(word))
+		default:
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,427 @@
+// Package socks5 implements the SOCKS5 wire protocol (RFC 1928 and RFC 1929) independent
+// of how requests are relayed, so that it can be shared by the wssocks relay, other
+// front-ends and library users.
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version is the SOCKS protocol version handled by this package
+const Version = 0x05
+
+// Authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xFF
+)
+
+// Request commands
+const (
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+)
+
+// Address types
+const (
+	AddrIPv4   = 0x01
+	AddrDomain = 0x03
+	AddrIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	RepSuccess             = 0x00
+	RepGeneralFailure      = 0x01
+	RepNotAllowed          = 0x02
+	RepNetworkUnreachable  = 0x03
+	RepHostUnreachable     = 0x04
+	RepConnectionRefused   = 0x05
+	RepTTLExpired          = 0x06
+	RepCommandNotSupported = 0x07
+	RepAddressNotSupported = 0x08
+)
+
+const (
+	userPassVersion       = 0x01
+	userPassStatusSuccess = 0x00
+	userPassStatusFailure = 0x01
+	maxFieldLength        = 255
+)
+
+var (
+	ErrInvalidVersion      = errors.New("invalid socks version")
+	ErrNoAcceptableMethod  = errors.New("no acceptable auth method")
+	ErrAuthFailed          = errors.New("authentication failed")
+	ErrAddressNotSupported = errors.New("unsupported address type")
+	ErrFragmented          = errors.New("fragmented UDP datagram")
+)
+
+// ReplyError is returned by the client functions when the server answers with a non-success reply
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	switch byte(e) {
+	case RepGeneralFailure:
+		return "general SOCKS server failure"
+	case RepNotAllowed:
+		return "connection not allowed by ruleset"
+	case RepNetworkUnreachable:
+		return "network unreachable"
+	case RepHostUnreachable:
+		return "host unreachable"
+	case RepConnectionRefused:
+		return "connection refused"
+	case RepTTLExpired:
+		return "TTL expired"
+	case RepCommandNotSupported:
+		return "command not supported"
+	case RepAddressNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("connection failed: %d", byte(e))
+	}
+}
+
+// Request is a parsed SOCKS5 request
+type Request struct {
+	Command  byte
+	Host     string
+	Port     int
+	Username string // Set when username/password authentication was used
+}
+
+// Addr returns the target address of the request in host:port form
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// Authenticator validates the credentials of a client using username/password authentication
+type Authenticator func(username, password string) bool
+
+// StaticAuth returns an Authenticator accepting a single username and password,
+// or nil (no authentication) if either is empty
+func StaticAuth(username, password string) Authenticator {
+	if username == "" || password == "" {
+		return nil
+	}
+	return func(u, p string) bool {
+		return u == username && p == password
+	}
+}
+
+// Handshake performs the server side of method negotiation and authentication, then reads
+// the client request. The caller is expected to answer the request with WriteReply.
+// When auth is nil no authentication is performed.
+func Handshake(rw io.ReadWriter, auth Authenticator) (*Request, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return nil, fmt.Errorf("read version error: %w", err)
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidVersion, header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return nil, fmt.Errorf("read auth methods error: %w", err)
+	}
+
+	var username string
+	if auth != nil {
+		if !hasMethod(methods, MethodUserPass) {
+			if _, err := rw.Write([]byte{Version, MethodNoAcceptable}); err != nil {
+				return nil, fmt.Errorf("write auth method error: %w", err)
+			}
+			return nil, ErrNoAcceptableMethod
+		}
+		if _, err := rw.Write([]byte{Version, MethodUserPass}); err != nil {
+			return nil, fmt.Errorf("write auth response error: %w", err)
+		}
+
+		user, password, err := readUserPass(rw)
+		if err != nil {
+			return nil, err
+		}
+		if !auth(user, password) {
+			if _, err := rw.Write([]byte{userPassVersion, userPassStatusFailure}); err != nil {
+				return nil, fmt.Errorf("write auth failure response error: %w", err)
+			}
+			return nil, ErrAuthFailed
+		}
+		if _, err := rw.Write([]byte{userPassVersion, userPassStatusSuccess}); err != nil {
+			return nil, fmt.Errorf("write auth success response error: %w", err)
+		}
+		username = user
+	} else {
+		// No authentication required, accepted regardless of the offered methods
+		if _, err := rw.Write([]byte{Version, MethodNoAuth}); err != nil {
+			return nil, fmt.Errorf("write auth response error: %w", err)
+		}
+	}
+
+	request, err := ReadRequest(rw)
+	if err != nil {
+		if errors.Is(err, ErrAddressNotSupported) {
+			WriteReply(rw, RepAddressNotSupported, nil)
+		}
+		return nil, err
+	}
+	request.Username = username
+	return request, nil
+}
+
+// ReadRequest reads a request (VER CMD RSV ATYP DST.ADDR DST.PORT) following negotiation
+func ReadRequest(r io.Reader) (*Request, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read request error: %w", err)
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidVersion, header[0])
+	}
+	host, port, err := ReadAddr(r)
+	if err != nil {
+		return nil, fmt.Errorf("read request address error: %w", err)
+	}
+	return &Request{
+		Command: header[1],
+		Host:    host,
+		Port:    port,
+	}, nil
+}
+
+// WriteReply writes a reply with the given code and bound address. A nil addr is sent as 0.0.0.0:0.
+func WriteReply(w io.Writer, rep byte, addr net.Addr) error {
+	host, port := "0.0.0.0", 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		host, port = a.IP.String(), a.Port
+	case *net.UDPAddr:
+		host, port = a.IP.String(), a.Port
+	case nil:
+	default:
+		h, p, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return err
+		}
+		if port, err = strconv.Atoi(p); err != nil {
+			return err
+		}
+		host = h
+	}
+
+	reply, err := AppendAddr([]byte{Version, rep, 0x00}, host, port)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
+
+// ReadAddr reads ATYP, DST.ADDR and DST.PORT
+func ReadAddr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, fmt.Errorf("%w: %d", ErrAddressNotSupported, atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// AppendAddr appends the ATYP, DST.ADDR and DST.PORT encoding of host and port to b
+func AppendAddr(b []byte, host string, port int) ([]byte, error) {
+	if port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("invalid port: %d", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > maxFieldLength {
+			return nil, fmt.Errorf("domain name too long: %d", len(host))
+		}
+		b = append(b, AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ParseUDPDatagram splits a UDP request datagram into its destination and payload.
+// Fragmented datagrams are not supported and are rejected with ErrFragmented.
+func ParseUDPDatagram(b []byte) (string, int, []byte, error) {
+	if len(b) < 4 {
+		return "", 0, nil, fmt.Errorf("UDP datagram too short")
+	}
+	if b[2] != 0x00 {
+		return "", 0, nil, ErrFragmented
+	}
+
+	r := bytes.NewReader(b[3:])
+	host, port, err := ReadAddr(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", 0, nil, fmt.Errorf("UDP datagram too short")
+		}
+		return "", 0, nil, err
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
+
+// AppendUDPHeader appends a UDP request header (RSV FRAG ATYP DST.ADDR DST.PORT) to b
+func AppendUDPHeader(b []byte, host string, port int) ([]byte, error) {
+	return AppendAddr(append(b, 0x00, 0x00, 0x00), host, port)
+}
+
+// ClientHandshake performs the client side of method negotiation, using username/password
+// authentication when both username and password are set
+func ClientHandshake(rw io.ReadWriter, username, password string) error {
+	method := byte(MethodNoAuth)
+	if username != "" && password != "" {
+		method = MethodUserPass
+	}
+	if _, err := rw.Write([]byte{Version, 0x01, method}); err != nil {
+		return err
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(rw, response); err != nil {
+		return err
+	}
+	if response[0] != Version {
+		return fmt.Errorf("%w: %d", ErrInvalidVersion, response[0])
+	}
+
+	switch response[1] {
+	case MethodNoAuth:
+		return nil
+	case MethodUserPass:
+		return clientUserPass(rw, username, password)
+	default:
+		return fmt.Errorf("unsupported auth method: %d", response[1])
+	}
+}
+
+// ClientRequest sends a request and reads the reply, returning the bound address
+func ClientRequest(rw io.ReadWriter, cmd byte, host string, port int) (string, int, error) {
+	request, err := AppendAddr([]byte{Version, cmd, 0x00}, host, port)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := rw.Write(request); err != nil {
+		return "", 0, err
+	}
+
+	response := make([]byte, 3)
+	if _, err := io.ReadFull(rw, response); err != nil {
+		return "", 0, err
+	}
+	if response[0] != Version {
+		return "", 0, fmt.Errorf("%w: %d", ErrInvalidVersion, response[0])
+	}
+	if response[1] != RepSuccess {
+		return "", 0, ReplyError(response[1])
+	}
+	return ReadAddr(rw)
+}
+
+// clientUserPass performs username/password authentication as a client
+func clientUserPass(rw io.ReadWriter, username, password string) error {
+	if len(username) > maxFieldLength || len(password) > maxFieldLength {
+		return fmt.Errorf("username or password too long")
+	}
+	auth := []byte{userPassVersion, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := rw.Write(auth); err != nil {
+		return err
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(rw, response); err != nil {
+		return err
+	}
+	if response[0] != userPassVersion || response[1] != userPassStatusSuccess {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// readUserPass reads a username/password authentication request
+func readUserPass(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", fmt.Errorf("read auth version error: %w", err)
+	}
+	if header[0] != userPassVersion {
+		return "", "", fmt.Errorf("invalid auth version: %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", "", fmt.Errorf("read username error: %w", err)
+	}
+
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", "", fmt.Errorf("read password length error: %w", err)
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", fmt.Errorf("read password error: %w", err)
+	}
+	return string(username), string(password), nil
+}
+
+func hasMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// maxUDPHeaderLength is the length of a UDP request header with the longest domain name
+const maxUDPHeaderLength = 3 + 1 + 1 + maxFieldLength + 2
+
+// UDPConn is a net.PacketConn sending datagrams through the UDP relay of a SOCKS5 proxy
+type UDPConn struct {
+	net.PacketConn
+	ctrl  net.Conn // Control connection holding the association
+	relay net.Addr // Address of the UDP relay of the proxy
+
+	readMu    sync.Mutex
+	readBuf   []byte
+	closeOnce sync.Once
+}
+
+// NewUDPConn returns a UDPConn encapsulating the datagrams exchanged on pc with the UDP relay
+// at relay, for the association established by a UDP ASSOCIATE request on ctrl. Closing the
+// returned conn closes ctrl and pc, and the conn is closed when the proxy closes ctrl.
+func NewUDPConn(ctrl net.Conn, pc net.PacketConn, relay net.Addr) *UDPConn {
+	c := &UDPConn{
+		PacketConn: pc,
+		ctrl:       ctrl,
+		relay:      relay,
+	}
+	go c.watch()
+	return c
+}
+
+// watch closes the conn when the association ends
+func (c *UDPConn) watch() {
+	// Nothing is sent on the control connection after the reply, reads return once it is closed
+	io.Copy(io.Discard, c.ctrl)
+	c.Close()
+}
+
+// ReadFrom reads the next datagram from the relay and returns its payload and source address
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.readBuf) < len(p)+maxUDPHeaderLength {
+		c.readBuf = make([]byte, len(p)+maxUDPHeaderLength)
+	}
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop datagrams not sent by the relay and the ones that cannot be parsed
+		if !sameAddr(addr, c.relay) {
+			continue
+		}
+		host, port, payload, err := ParseUDPDatagram(c.readBuf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(p, payload), newAddr(host, port), nil
+	}
+}
+
+// WriteTo sends p to addr through the relay
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var host string
+	var port int
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		host, port = udpAddr.IP.String(), udpAddr.Port
+	} else {
+		h, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0, err
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return 0, err
+		}
+		host = h
+	}
+
+	datagram, err := AppendUDPHeader(make([]byte, 0, maxUDPHeaderLength+len(p)), host, port)
+	if err != nil {
+		return 0, err
+	}
+	datagram = append(datagram, p...)
+	if _, err := c.PacketConn.WriteTo(datagram, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the association
+func (c *UDPConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+// domainAddr is a UDP address with a domain name host
+type domainAddr struct {
+	host string
+	port int
+}
+
+func (a domainAddr) Network() string { return "udp" }
+func (a domainAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(a.port)) }
+
+// newAddr returns a *net.UDPAddr for IP hosts and a domain address otherwise
+func newAddr(host string, port int) net.Addr {
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return domainAddr{host: host, port: port}
+}
+
+// sameAddr reports whether a and b are the same address
+func sameAddr(a, b net.Addr) bool {
+	ua, okA := a.(*net.UDPAddr)
+	ub, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return ua.IP.Equal(ub.IP) && ua.Port == ub.Port
+	}
+	return a.String() == b.String()
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"testing"
 	"time"
@@ -33,6 +34,11 @@ type ProxyTestServerOption struct {
 	LoggerPrefix      string
 	Reconnect         bool
 	StrictConnect     bool
+	Dialer            wssocks.Dialer
+	Compressions      []byte
+	TCPPort           int         // TLS/TCP transport port, disabled if 0
+	QUICPort          int         // QUIC transport UDP port, disabled if 0
+	TLSConfig         *tls.Config // Certificate of the TLS/TCP and QUIC transports
 }
 
 // ProxyTestClient encapsulates the client-side test environment
@@ -44,6 +50,7 @@ type ProxyTestClient struct {
 
 type ProxyTestClientOption struct {
 	WSPort        int    // WebSocket server port
+	URL           string // Server URL, defaults to ws://localhost:WSPort
 	Token         string // Client token
 	SocksPort     int    // Custom SOCKS port
 	Threads       int    // Number of client threads
@@ -51,6 +58,19 @@ type ProxyTestClientOption struct {
 	Reverse       bool   // Whether to use reverse mode
 	StrictConnect bool   // Whether to enable strict connection mode
 	Reconnect     bool   // Whether to enable auto-reconnection
+
+	Compressions        []byte      // Accepted compressions, nil for all
+	AdaptiveCompression bool        // Whether to enable adaptive compression
+	E2ESecret           string      // Secret for end-to-end encryption between connector and provider
+	TLSConfig           *tls.Config // TLS config for tcp+tls:// and quic:// servers
+}
+
+// serverURL returns the URL the client connects to
+func (o *ProxyTestClientOption) serverURL() string {
+	if o.URL != "" {
+		return o.URL
+	}
+	return fmt.Sprintf("ws://localhost:%d", o.WSPort)
 }
 
 // ProxyTestEnv encapsulates both server and client test environments
@@ -101,6 +121,15 @@ func forwardServer(t *testing.T, opt *ProxyTestServerOption) *ProxyTestServer {
 
 		// Set StrictConnect
 		serverOpt.WithStrictConnect(opt.StrictConnect)
+
+		// Set Dialer
+		serverOpt.WithDialer(opt.Dialer)
+
+		// Set Compressions
+		serverOpt.WithCompressions(opt.Compressions)
+
+		// Set TLS/TCP and QUIC transports
+		serverOpt.WithTCPPort(opt.TCPPort).WithQUICPort(opt.QUICPort).WithTLSConfig(opt.TLSConfig)
 	}
 	server := wssocks.NewWSSocksServer(serverOpt)
 	token, err = server.AddForwardToken(token)
@@ -136,10 +165,14 @@ func forwardClient(t *testing.T, opt *ProxyTestClientOption) *ProxyTestClient {
 
 	logger := createPrefixedLogger(opt.LoggerPrefix)
 	clientOpt := wssocks.DefaultClientOption().
-		WithWSURL(fmt.Sprintf("ws://localhost:%d", opt.WSPort)).
+		WithWSURL(opt.serverURL()).
 		WithSocksPort(socksPort).
 		WithReconnectDelay(1 * time.Second).
 		WithStrictConnect(opt.StrictConnect).
+		WithCompressions(opt.Compressions).
+		WithAdaptiveCompression(opt.AdaptiveCompression).
+		WithE2ESecret(opt.E2ESecret).
+		WithTLSConfig(opt.TLSConfig).
 		WithLogger(logger)
 
 	if opt.Reconnect {
@@ -256,10 +289,14 @@ func reverseClient(t *testing.T, opt *ProxyTestClientOption) *ProxyTestClient {
 
 	logger := createPrefixedLogger(opt.LoggerPrefix)
 	clientOpt := wssocks.DefaultClientOption().
-		WithWSURL(fmt.Sprintf("ws://localhost:%d", opt.WSPort)).
+		WithWSURL(opt.serverURL()).
 		WithReconnectDelay(1 * time.Second).
 		WithReverse(true).
 		WithStrictConnect(opt.StrictConnect).
+		WithCompressions(opt.Compressions).
+		WithAdaptiveCompression(opt.AdaptiveCompression).
+		WithE2ESecret(opt.E2ESecret).
+		WithTLSConfig(opt.TLSConfig).
 		WithLogger(logger)
 
 	if opt.Reconnect {
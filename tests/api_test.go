@@ -1,14 +1,22 @@
 package tests
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zetxtech/wssocks/socks5"
 	"github.com/zetxtech/wssocks/wssocks"
 
 	"github.com/stretchr/testify/require"
@@ -70,6 +78,286 @@ func TestApiCreateForwardToken(t *testing.T) {
 	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
 }
 
+func TestApiUpdateToken(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, socksPort, err := server.AddReverseToken(nil)
+	require.NoError(t, err)
+
+	client := reverseClient(t, &ProxyTestClientOption{
+		WSPort: wsPort,
+		Token:  token,
+	})
+	defer client.Close()
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: socksPort}))
+
+	// Move the SOCKS server and require authentication while the provider stays connected
+	newPort, err := getFreePort()
+	require.NoError(t, err)
+	username, password := "test_user", "test_pass"
+	resp, err := apiRequest(t, "PATCH", baseURL+"/api/token/"+token, "TOKEN", wssocks.TokenUpdateRequest{
+		Port:     &newPort,
+		Username: &username,
+		Password: &password,
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var tokenResp wssocks.TokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokenResp))
+	require.True(t, tokenResp.Success, tokenResp.Error)
+	require.Equal(t, newPort, tokenResp.Port)
+
+	require.Equal(t, 1, server.GetTokenClientCount(token))
+	require.Eventually(t, func() bool {
+		return testWebConnection(globalHTTPServer, &ProxyConfig{Port: newPort, Username: username, Password: password}) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Error(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: newPort}))
+
+	resp, err = apiRequest(t, "PATCH", baseURL+"/api/token/unknown", "TOKEN", wssocks.TokenUpdateRequest{})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestApiToggleConnectorAutonomy(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, socksPort, err := server.AddReverseToken(nil)
+	require.NoError(t, err)
+	toggle := func(autonomy bool) wssocks.TokenResponse {
+		resp, err := apiRequest(t, "PATCH", baseURL+"/api/token/"+token, "TOKEN", wssocks.TokenUpdateRequest{
+			AllowManageConnector: &autonomy,
+		})
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var tokenResp wssocks.TokenResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokenResp))
+		return tokenResp
+	}
+
+	// The mode does not change under connected providers, which keep being served
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        token,
+		LoggerPrefix: "CLT1",
+	})
+	tokenResp := toggle(true)
+	require.False(t, tokenResp.Success)
+	require.Contains(t, tokenResp.Error, "providers are connected")
+	require.Eventually(t, func() bool {
+		return testWebConnection(globalHTTPServer, &ProxyConfig{Port: socksPort}) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	provider.Close()
+
+	require.Eventually(t, func() bool {
+		return toggle(true).Success
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Nor under connected autonomy providers
+	provider = reverseClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        token,
+		LoggerPrefix: "CLT1",
+	})
+	_, err = provider.Client.AddConnector("PROVIDER_CONNECTOR")
+	require.NoError(t, err)
+	tokenResp = toggle(false)
+	require.False(t, tokenResp.Success)
+	require.Contains(t, tokenResp.Error, "providers are connected")
+	provider.Close()
+
+	var port int
+	require.Eventually(t, func() bool {
+		tokenResp := toggle(false)
+		port = tokenResp.Port
+		return tokenResp.Success
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Positive(t, port)
+
+	// Providers connecting again get the SOCKS server of the token
+	provider = reverseClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        token,
+		LoggerPrefix: "CLT1",
+	})
+	defer provider.Close()
+	require.Eventually(t, func() bool {
+		return testWebConnection(globalHTTPServer, &ProxyConfig{Port: port}) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestApiTokenLimits(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	resp, err := apiRequest(t, "POST", baseURL+"/api/token", "TOKEN", wssocks.TokenRequest{
+		Type:       "forward",
+		ExpiresAt:  time.Now().Add(2 * time.Second),
+		MaxClients: 1,
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var tokenResp wssocks.TokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokenResp))
+	require.True(t, tokenResp.Success)
+	token := tokenResp.Token
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/socket/", wsPort), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	data, err := wssocks.PackMessage(wssocks.AuthMessage{Token: token, Instance: uuid.New(), MinVersion: wssocks.ProtocolVersion, MaxVersion: wssocks.ProtocolVersion})
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, data))
+	_, data, err = ws.ReadMessage()
+	require.NoError(t, err)
+	msg, err := wssocks.ParseMessage(data)
+	require.NoError(t, err)
+	require.True(t, msg.(wssocks.AuthResponseMessage).Success)
+
+	// Clients beyond the limit are refused
+	response := authenticate(t, wsPort, wssocks.AuthMessage{Token: token, Instance: uuid.New(), MinVersion: wssocks.ProtocolVersion, MaxVersion: wssocks.ProtocolVersion})
+	require.False(t, response.Success)
+	require.Equal(t, "too many clients for token", response.Error)
+
+	// The connected client is warned before the token expires, then disconnected
+	var warned bool
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		msg, err := wssocks.ParseMessage(data)
+		require.NoError(t, err)
+		if log, ok := msg.(wssocks.LogMessage); ok && log.Level == wssocks.LogLevelWarn {
+			warned = true
+		}
+	}
+	require.True(t, warned)
+
+	response = authenticate(t, wsPort, wssocks.AuthMessage{Token: token, Instance: uuid.New(), MinVersion: wssocks.ProtocolVersion, MaxVersion: wssocks.ProtocolVersion})
+	require.False(t, response.Success)
+	require.Equal(t, "invalid token", response.Error)
+}
+
+func TestApiTokenClientLimitConcurrent(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	resp, err := apiRequest(t, "POST", baseURL+"/api/token", "TOKEN", wssocks.TokenRequest{
+		Type:       "forward",
+		MaxClients: 1,
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var tokenResp wssocks.TokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokenResp))
+	require.True(t, tokenResp.Success)
+
+	// Clients authenticating at the same time cannot exceed the limit together
+	const clients = 8
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/socket/", wsPort), nil)
+		require.NoError(t, err)
+		defer ws.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := wssocks.PackMessage(wssocks.AuthMessage{Token: tokenResp.Token, Instance: uuid.New(), MinVersion: wssocks.ProtocolVersion, MaxVersion: wssocks.ProtocolVersion})
+			if err != nil || ws.WriteMessage(websocket.BinaryMessage, data) != nil {
+				return
+			}
+			_, data, err = ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg, err := wssocks.ParseMessage(data); err == nil && msg.(wssocks.AuthResponseMessage).Success {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), accepted.Load())
+}
+
+func TestApiConnectors(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, _, err := server.AddReverseToken(&wssocks.ReverseTokenOptions{AllowManageConnector: true})
+	require.NoError(t, err)
+	_, err = server.AddConnectorToken("SERVER_CONNECTOR", token)
+	require.NoError(t, err)
+
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        token,
+		LoggerPrefix: "CLT1",
+	})
+	defer provider.Close()
+	_, err = provider.Client.AddConnector("PROVIDER_CONNECTOR")
+	require.NoError(t, err)
+
+	connector := forwardClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        "PROVIDER_CONNECTOR",
+		LoggerPrefix: "CLT2",
+	})
+	defer connector.Close()
+
+	listConnectors := func() []wssocks.ConnectorStatus {
+		resp, err := apiRequest(t, "GET", baseURL+"/api/token/"+token+"/connectors", "TOKEN", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var connectorsResp wssocks.ConnectorsResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&connectorsResp))
+		return connectorsResp.Connectors
+	}
+
+	// Connectors added by providers are listed with the provider and their live connectors
+	connectors := listConnectors()
+	require.Len(t, connectors, 2)
+	require.Equal(t, "SERVER_CONNECTOR", connectors[0].Token)
+	require.Empty(t, connectors[0].CreatedBy)
+	require.Empty(t, connectors[0].Clients)
+	require.Equal(t, "PROVIDER_CONNECTOR", connectors[1].Token)
+	require.NotEmpty(t, connectors[1].CreatedBy)
+	require.Len(t, connectors[1].Clients, 1)
+
+	// Removing a connector token disconnects its connectors and keeps the reverse token
+	resp, err := apiRequest(t, "DELETE", baseURL+"/api/token/"+token+"/connectors/PROVIDER_CONNECTOR", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		return server.GetTokenClientCount("PROVIDER_CONNECTOR") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, listConnectors(), 1)
+
+	// Single connector tokens cannot be read
+	resp, err = apiRequest(t, "GET", baseURL+"/api/token/"+token+"/connectors/SERVER_CONNECTOR", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/token/"+token+"/connectors", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, listConnectors())
+	require.True(t, server.HasClients())
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/token/unknown/connectors", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
 func TestApiStatus(t *testing.T) {
 	server, baseURL, _ := setupTestServer(t)
 	defer server.Close()
@@ -102,3 +390,376 @@ func TestApiUnauthorized(t *testing.T) {
 	defer resp.Body.Close()
 	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 }
+
+func TestApiScopedKeys(t *testing.T) {
+	wsPort, err := getFreePort()
+	require.NoError(t, err)
+	reader, err := wssocks.ParseAPIKey("READER:status")
+	require.NoError(t, err)
+	bound, err := wssocks.ParseAPIKey("BOUND:status,tokens:bound_token")
+	require.NoError(t, err)
+	server := wssocks.NewWSSocksServer(wssocks.DefaultServerOption().
+		WithWSPort(wsPort).
+		WithLogger(createPrefixedLogger("SRV0")).
+		WithAPIKeys(reader, bound))
+	require.NoError(t, server.WaitReady(context.Background(), 5*time.Second))
+	defer server.Close()
+	baseURL := fmt.Sprintf("http://localhost:%d", wsPort)
+
+	_, err = server.AddForwardToken("other_token")
+	require.NoError(t, err)
+
+	// Read-only keys cannot add tokens
+	resp, err := apiRequest(t, "GET", baseURL+"/api/status", "READER", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = apiRequest(t, "POST", baseURL+"/api/token", "READER", wssocks.TokenRequest{Type: "forward"})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Keys bound to tokens only manage and see those
+	resp, err = apiRequest(t, "POST", baseURL+"/api/token", "BOUND", wssocks.TokenRequest{Type: "forward", Token: "bound_token"})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/token/other_token", "BOUND", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/status", "BOUND", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var statusResp struct {
+		Tokens []wssocks.TokenStatus `json:"tokens"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&statusResp))
+	require.Len(t, statusResp.Tokens, 1)
+	require.Equal(t, "bound_token", statusResp.Tokens[0].Token)
+
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/clients/"+uuid.NewString(), "BOUND", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestApiClients(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort:  wsPort,
+		Token:   token,
+		Threads: 2,
+	})
+	defer client.Close()
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+
+	resp, err := apiRequest(t, "GET", baseURL+"/api/clients", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var clientsResp wssocks.ClientsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&clientsResp))
+
+	// Both threads belong to the same instance
+	require.Len(t, clientsResp.Clients, 2)
+	var bytesReceived uint64
+	for _, c := range clientsResp.Clients {
+		require.Equal(t, "forward", c.Type)
+		require.Equal(t, token, c.Token)
+		require.NotEmpty(t, c.IP)
+		require.Equal(t, clientsResp.Clients[0].Instance, c.Instance)
+		require.Equal(t, 2, c.Threads)
+		require.NotZero(t, c.BytesSent)
+		bytesReceived += c.BytesReceived
+	}
+	require.NotZero(t, bytesReceived)
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/clients/"+clientsResp.Clients[0].ID, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var clientResp wssocks.ClientStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&clientResp))
+	require.Equal(t, clientsResp.Clients[0].ID, clientResp.ID)
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/clients/unknown", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestApiKickAndBan(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort:  wsPort,
+		Token:   token,
+		Threads: 2,
+	})
+	defer client.Close()
+
+	resp, err := apiRequest(t, "GET", baseURL+"/api/clients", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var clientsResp wssocks.ClientsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&clientsResp))
+	require.Len(t, clientsResp.Clients, 2)
+	clientIP := clientsResp.Clients[0].IP
+
+	// Kicking a client disconnects all threads of its instance
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/clients/"+clientsResp.Clients[0].ID, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool { return !server.HasClients() }, 5*time.Second, 10*time.Millisecond)
+
+	// Banned clients are refused
+	resp, err = apiRequest(t, "POST", baseURL+"/api/bans", "TOKEN", wssocks.BanRequest{IP: clientIP, Duration: 60})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/bans", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var bansResp wssocks.BansResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&bansResp))
+	require.Len(t, bansResp.Bans, 1)
+	require.Equal(t, clientIP, bansResp.Bans[0].IP)
+	require.NotNil(t, bansResp.Bans[0].Expires)
+
+	banned := wssocks.NewWSSocksClient(token, wssocks.DefaultClientOption().
+		WithWSURL(fmt.Sprintf("ws://localhost:%d", wsPort)).
+		WithLogger(createPrefixedLogger("CLT1")))
+	defer banned.Close()
+	require.Error(t, banned.WaitReady(context.Background(), 5*time.Second))
+
+	// Lifting the ban lets the client in again
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/bans/"+clientIP, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var unbanResp wssocks.TokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&unbanResp))
+	require.True(t, unbanResp.Success)
+
+	client = forwardClient(t, &ProxyTestClientOption{
+		WSPort:       wsPort,
+		Token:        token,
+		LoggerPrefix: "CLT2",
+	})
+	defer client.Close()
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+}
+
+func TestApiChannels(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: wsPort,
+		Token:  token,
+	})
+	defer client.Close()
+
+	// Target holding connections open until the test ends
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.SocksPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	request, err := socks5.AppendAddr([]byte{0x05, socks5.CmdConnect, 0x00}, "127.0.0.1", targetPort)
+	require.NoError(t, err)
+	_, err = conn.Write(append([]byte{0x05, 0x01, 0x00}, request...))
+	require.NoError(t, err)
+	// Method selection then connect reply with an IPv4 bind address
+	reply := make([]byte, 2+10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x05, 0x00, 0x05, socks5.RepSuccess}, reply[:4])
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	var channelsResp wssocks.ChannelsResponse
+	require.Eventually(t, func() bool {
+		resp, err := apiRequest(t, "GET", baseURL+"/api/channels", "TOKEN", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&channelsResp))
+		return len(channelsResp.Channels) == 1 && channelsResp.Channels[0].BytesUp == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	channel := channelsResp.Channels[0]
+	require.Equal(t, "tcp", channel.Protocol)
+	require.Equal(t, "127.0.0.1", channel.Address)
+	require.Equal(t, targetPort, channel.Port)
+	require.Equal(t, token, channel.Token)
+	require.NotEmpty(t, channel.Client)
+	require.Empty(t, channel.Provider)
+
+	// Closing the channel disconnects the SOCKS user
+	resp, err := apiRequest(t, "DELETE", baseURL+"/api/channels/"+channel.ID, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	resp, err = apiRequest(t, "GET", baseURL+"/api/channels", "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&channelsResp))
+	require.Empty(t, channelsResp.Channels)
+
+	resp, err = apiRequest(t, "DELETE", baseURL+"/api/channels/"+channel.ID, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestApiEvents(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	// Only the events of the token are streamed
+	resp, err := apiRequest(t, "GET", baseURL+"/api/events?token="+token, "TOKEN", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan wssocks.Event, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var event wssocks.Event
+			if json.Unmarshal([]byte(data), &event) == nil {
+				events <- event
+			}
+		}
+	}()
+	nextEvent := func() wssocks.Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no event received")
+			return wssocks.Event{}
+		}
+	}
+
+	_, err = server.AddForwardToken("")
+	require.NoError(t, err)
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: wsPort,
+		Token:  token,
+	})
+	event := nextEvent()
+	require.Equal(t, wssocks.EventClientConnected, event.Type)
+	require.Equal(t, token, event.Token)
+	require.Equal(t, "forward", event.Detail)
+	clientID := event.ClientID
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+	event = nextEvent()
+	require.Equal(t, wssocks.EventChannelOpened, event.Type)
+	require.Equal(t, clientID, event.ClientID)
+
+	// Channels still open are closed along with their client
+	client.Close()
+	require.Equal(t, wssocks.EventChannelClosed, nextEvent().Type)
+	event = nextEvent()
+	require.Equal(t, wssocks.EventClientDisconnected, event.Type)
+	require.Equal(t, clientID, event.ClientID)
+}
+
+func TestApiClientIPFromHeaders(t *testing.T) {
+	// clientIP returns the IP the server lists for a client connecting with header
+	clientIP := func(trustedProxies []string, header http.Header) string {
+		wsPort, err := getFreePort()
+		require.NoError(t, err)
+		server := wssocks.NewWSSocksServer(wssocks.DefaultServerOption().
+			WithWSPort(wsPort).
+			WithLogger(createPrefixedLogger("SRV0")).
+			WithAPI("TOKEN").
+			WithTrustedProxies(trustedProxies...))
+		defer server.Close()
+		require.NoError(t, server.WaitReady(context.Background(), 5*time.Second))
+		token, err := server.AddForwardToken("")
+		require.NoError(t, err)
+
+		ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/socket", wsPort), header)
+		require.NoError(t, err)
+		defer ws.Close()
+		writeRaw(t, ws, wssocks.AuthMessage{
+			Token:      token,
+			Instance:   uuid.New(),
+			MinVersion: wssocks.MinProtocolVersion,
+			MaxVersion: wssocks.ProtocolVersion,
+		})
+		response, err := readRaw(ws)
+		require.NoError(t, err)
+		require.True(t, response.(wssocks.AuthResponseMessage).Success)
+
+		resp, err := apiRequest(t, "GET", fmt.Sprintf("http://127.0.0.1:%d/api/clients", wsPort), "TOKEN", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var clientsResp wssocks.ClientsResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&clientsResp))
+		require.Len(t, clientsResp.Clients, 1)
+		return clientsResp.Clients[0].IP
+	}
+	forwarded := http.Header{"Cf-Connecting-Ip": {"198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}
+
+	// Headers of clients reaching the server directly are ignored
+	require.Equal(t, "127.0.0.1", clientIP(nil, forwarded))
+	require.Equal(t, "127.0.0.1", clientIP([]string{"192.0.2.1"}, forwarded))
+
+	// Invalid proxy lists are ignored as a whole
+	require.Equal(t, "127.0.0.1", clientIP([]string{"proxy", "127.0.0.1"}, forwarded))
+
+	// Trusted proxies set the client IP
+	require.Equal(t, "198.51.100.1", clientIP([]string{"127.0.0.1"}, forwarded))
+
+	// Addresses forged by the client before the proxies are skipped
+	require.Equal(t, "198.51.100.2", clientIP([]string{"127.0.0.0/8", "10.0.0.0/8"},
+		http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.2", "10.0.0.2"}}))
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zetxtech/wssocks/apiclient"
+	"github.com/zetxtech/wssocks/wssocks"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApiClient(t *testing.T) {
+	server, baseURL, wsPort := setupTestServer(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	api := apiclient.New(baseURL, "TOKEN")
+
+	added, err := api.AddToken(ctx, apiclient.TokenRequest{Type: "forward"})
+	require.NoError(t, err)
+	token := added.Token
+	require.NotEmpty(t, token)
+
+	events, err := api.Events(ctx, []string{token}, []apiclient.EventType{apiclient.EventTypeClientConnected})
+	require.NoError(t, err)
+	defer events.Close()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: wsPort,
+		Token:  token,
+	})
+	defer client.Close()
+
+	event, err := events.Next()
+	require.NoError(t, err)
+	require.Equal(t, apiclient.EventTypeClientConnected, event.Type)
+	require.Equal(t, token, event.Token)
+
+	status, err := api.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, wssocks.Version, status.Version)
+	require.Len(t, status.Tokens, 1)
+	require.Equal(t, 1, status.Tokens[0].ClientsCount)
+
+	clients, err := api.Clients(ctx)
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, event.ClientID, clients[0].ID)
+
+	// Reverse tokens are updated in place
+	added, err = api.AddToken(ctx, apiclient.TokenRequest{Type: "reverse"})
+	require.NoError(t, err)
+	require.NotZero(t, added.Port)
+	maxClients := 2
+	port, err := api.UpdateToken(ctx, added.Token, apiclient.TokenUpdateRequest{MaxClients: &maxClients})
+	require.NoError(t, err)
+	require.Equal(t, added.Port, port)
+
+	// Failures are returned as errors
+	_, err = api.UpdateToken(ctx, token, apiclient.TokenUpdateRequest{MaxClients: &maxClients})
+	var apiErr *apiclient.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	require.Equal(t, "reverse token not found", apiErr.Message)
+
+	_, err = apiclient.New(baseURL, "WRONG").Status(ctx)
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	require.NoError(t, api.KickClient(ctx, event.ClientID))
+	removed, err := api.RemoveToken(ctx, token)
+	require.NoError(t, err)
+	require.True(t, removed)
+}
+
+func TestApiOpenAPI(t *testing.T) {
+	server, baseURL, _ := setupTestServer(t)
+	defer server.Close()
+
+	data, err := apiclient.New(baseURL, "TOKEN").OpenAPI(context.Background())
+	require.NoError(t, err)
+
+	var spec struct {
+		Paths      map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]openAPISchema `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(data, &spec))
+	require.Contains(t, spec.Paths, "/api/token")
+	require.Contains(t, spec.Paths, "/api/events")
+
+	// The schemas list the fields of the server and client types
+	types := map[string][]interface{}{
+		"TokenRequest":       {wssocks.TokenRequest{}, apiclient.TokenRequest{}},
+		"TokenUpdateRequest": {wssocks.TokenUpdateRequest{}, apiclient.TokenUpdateRequest{}},
+		"TokenResponse":      {wssocks.TokenResponse{}, apiclient.TokenResponse{}},
+		"StatusResponse":     {wssocks.StatusResponse{}, apiclient.StatusResponse{}},
+		"TokenStatus":        {wssocks.TokenStatus{}, apiclient.TokenStatus{}},
+		"ReverseTokenStatus": {wssocks.ReverseTokenStatus{}, apiclient.ReverseTokenStatus{}},
+		"ConnectorStatus":    {wssocks.ConnectorStatus{}, apiclient.ConnectorStatus{}},
+		"ConnectorsResponse": {wssocks.ConnectorsResponse{}, apiclient.ConnectorsResponse{}},
+		"ClientStatus":       {wssocks.ClientStatus{}, apiclient.ClientStatus{}},
+		"ClientsResponse":    {wssocks.ClientsResponse{}, apiclient.ClientsResponse{}},
+		"ChannelStatus":      {wssocks.ChannelStatus{}, apiclient.ChannelStatus{}},
+		"ChannelsResponse":   {wssocks.ChannelsResponse{}, apiclient.ChannelsResponse{}},
+		"BanRequest":         {wssocks.BanRequest{}, apiclient.BanRequest{}},
+		"BanStatus":          {wssocks.BanStatus{}, apiclient.BanStatus{}},
+		"BansResponse":       {wssocks.BansResponse{}, apiclient.BansResponse{}},
+		"Event":              {wssocks.Event{}, apiclient.Event{}},
+	}
+	for name, values := range types {
+		properties := schemaProperties(t, spec.Components.Schemas, name)
+		for _, value := range values {
+			require.Equal(t, properties, jsonFields(reflect.TypeOf(value)), "%s of %T", name, value)
+		}
+	}
+}
+
+type openAPISchema struct {
+	Ref        string                     `json:"$ref"`
+	Properties map[string]json.RawMessage `json:"properties"`
+	AllOf      []openAPISchema            `json:"allOf"`
+}
+
+// schemaProperties returns the sorted properties of a schema, including those of allOf
+func schemaProperties(t *testing.T, schemas map[string]openAPISchema, name string) []string {
+	schema, ok := schemas[name]
+	require.True(t, ok, "schema %s", name)
+
+	var properties []string
+	var collect func(schema openAPISchema)
+	collect = func(schema openAPISchema) {
+		if ref, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/"); ok {
+			collect(schemas[ref])
+		}
+		for property := range schema.Properties {
+			properties = append(properties, property)
+		}
+		for _, part := range schema.AllOf {
+			collect(part)
+		}
+	}
+	collect(schema)
+	sort.Strings(properties)
+	return properties
+}
+
+// jsonFields returns the sorted JSON names of the fields of a struct, including embedded ones
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
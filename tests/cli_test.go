@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/apiclient"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+// runAdmin runs an admin command of the CLI against the API at baseURL and returns its output
+func runAdmin(baseURL string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cli := wssocks.NewCLI()
+	cli.SetArgs(append([]string{"admin", "--api-url", baseURL, "--api-key", "TOKEN"}, args...))
+	cli.SetOutput(&out)
+	err := cli.Execute()
+	return out.String(), err
+}
+
+func TestCLIAdmin(t *testing.T) {
+	server, baseURL, _ := setupTestServer(t)
+	defer server.Close()
+
+	out, err := runAdmin(baseURL, "status")
+	require.NoError(t, err)
+	require.Contains(t, out, "Server version "+wssocks.Version)
+
+	out, err = runAdmin(baseURL, "token", "add", "forward", "--token", "CLI_FORWARD")
+	require.NoError(t, err)
+	require.Contains(t, out, "Added forward token CLI_FORWARD")
+
+	out, err = runAdmin(baseURL, "token", "add", "reverse", "--json")
+	require.NoError(t, err)
+	var added apiclient.TokenResponse
+	require.NoError(t, json.Unmarshal([]byte(out), &added))
+	require.True(t, added.Success)
+	require.NotZero(t, added.Port)
+	_, err = runAdmin(baseURL, "token", "add", "connector", "--token", "CLI_CONNECTOR", "--reverse-token", added.Token)
+	require.NoError(t, err)
+
+	out, err = runAdmin(baseURL, "status")
+	require.NoError(t, err)
+	require.Contains(t, out, "CLI_FORWARD")
+	require.Contains(t, out, "CLI_CONNECTOR")
+
+	// Removing a reverse token removes its connector tokens
+	out, err = runAdmin(baseURL, "token", "rm", "CLI_FORWARD", added.Token)
+	require.NoError(t, err)
+	require.Contains(t, out, "Removed token CLI_FORWARD")
+	require.Contains(t, out, "Removed token "+added.Token)
+	require.False(t, server.RemoveToken("CLI_CONNECTOR"))
+
+	// Unknown tokens are reported and fail the command
+	out, err = runAdmin(baseURL, "token", "rm", "CLI_FORWARD")
+	require.ErrorContains(t, err, "token not found")
+	require.Contains(t, out, "Token CLI_FORWARD not found")
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+// codecMessages returns a message of every type, used as fuzzing seeds
+func codecMessages() []wssocks.BaseMessage {
+	channelID := uuid.New()
+	compressible := bytes.Repeat([]byte("wssocks "), 256)
+	return []wssocks.BaseMessage{
+		wssocks.AuthMessage{
+			Token:        "token",
+			Reverse:      true,
+			Instance:     uuid.New(),
+			Compressions: []byte{wssocks.DataCompressionDeflate, wssocks.DataCompressionGzip},
+			MinVersion:   wssocks.MinProtocolVersion,
+			MaxVersion:   wssocks.ProtocolVersion,
+			Capabilities: wssocks.LocalCapabilities,
+		},
+		wssocks.AuthResponseMessage{Success: true, Compression: wssocks.DataCompressionGzip, Version: wssocks.ProtocolVersion},
+		wssocks.AuthResponseMessage{Success: false, Error: "invalid token"},
+		wssocks.ConnectMessage{Protocol: "tcp", Address: "example.com", Port: 443, ChannelID: channelID, StreamID: 3},
+		wssocks.ConnectMessage{
+			Protocol:  "udp",
+			ChannelID: channelID,
+			Encrypted: true,
+			E2ENonce:  bytes.Repeat([]byte{1}, 16),
+			E2ETag:    bytes.Repeat([]byte{2}, 16),
+			StreamID:  7,
+		},
+		wssocks.ConnectResponseMessage{Success: true, ChannelID: channelID},
+		wssocks.ConnectResponseMessage{Success: false, Error: "connection refused", ChannelID: channelID},
+		wssocks.DataMessage{Protocol: "tcp", ChannelID: channelID, Data: []byte("data")},
+		wssocks.DataMessage{Protocol: "tcp", ChannelID: channelID, Data: compressible, Compression: wssocks.DataCompressionGzip},
+		wssocks.DataMessage{Protocol: "tcp", Data: compressible, Compression: wssocks.DataCompressionDeflate, StreamID: 5},
+		wssocks.DataMessage{Protocol: "tcp", ChannelID: channelID, Data: compressible, Compression: wssocks.DataCompressionLZ4},
+		wssocks.DataMessage{
+			Protocol:   "udp",
+			ChannelID:  channelID,
+			Data:       []byte("datagram"),
+			Address:    "127.0.0.1",
+			Port:       53,
+			TargetAddr: "1.1.1.1",
+			TargetPort: 53,
+		},
+		wssocks.DisconnectMessage{ChannelID: channelID},
+		wssocks.ConnectorMessage{ChannelID: channelID, ConnectorToken: "connector", Operation: "add"},
+		wssocks.ConnectorResponseMessage{Success: true, ChannelID: channelID, ConnectorToken: "connector"},
+		wssocks.ConnectorResponseMessage{Success: false, ChannelID: channelID, Error: "exists"},
+		wssocks.LogMessage{Level: wssocks.LogLevelInfo, Msg: "message"},
+		wssocks.PartnersMessage{Count: 2},
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, msg := range codecMessages() {
+		packed, err := wssocks.PackMessage(msg)
+		require.NoError(f, err)
+		f.Add(packed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := wssocks.ParseMessage(data)
+		if err != nil {
+			return
+		}
+
+		// Anything parsed packs to a canonical frame that is stable across round trips
+		packed, err := wssocks.PackMessage(msg)
+		require.NoError(t, err)
+		reparsed, err := wssocks.ParseMessage(packed)
+		require.NoError(t, err)
+		repacked, err := wssocks.PackMessage(reparsed)
+		require.NoError(t, err)
+		require.Equal(t, packed, repacked)
+	})
+}
+
+func FuzzFrameReader(f *testing.F) {
+	var stream bytes.Buffer
+	writer := wssocks.NewFrameWriter(&stream)
+	for _, msg := range codecMessages() {
+		require.NoError(f, writer.WriteMessage(msg))
+	}
+	f.Add(stream.Bytes())
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := wssocks.NewFrameReader(bytes.NewReader(data))
+		for {
+			if _, err := reader.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	messages := codecMessages()
+
+	var stream bytes.Buffer
+	writer := wssocks.NewFrameWriter(&stream)
+	for _, msg := range messages {
+		require.NoError(t, writer.WriteMessage(msg))
+	}
+
+	reader := wssocks.NewFrameReader(&stream)
+	for _, msg := range messages {
+		parsed, err := reader.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, msg.GetType(), parsed.GetType())
+		if data, ok := msg.(wssocks.DataMessage); ok {
+			require.Equal(t, data.Data, parsed.(wssocks.DataMessage).Data)
+		}
+	}
+	_, err := reader.ReadMessage()
+	require.ErrorIs(t, err, io.EOF)
+
+	// A frame cut short is reported as such
+	packed, err := wssocks.PackMessage(messages[0])
+	require.NoError(t, err)
+	truncated := append([]byte{0, 0, 0, byte(len(packed))}, packed[:len(packed)-1]...)
+	_, err = wssocks.NewFrameReader(bytes.NewReader(truncated)).ReadFrame()
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+func TestAppendMessageAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not measured with the race detector")
+	}
+	data := wssocks.DataMessage{
+		Protocol:  "tcp",
+		ChannelID: uuid.New(),
+		Data:      bytes.Repeat([]byte("wssocks "), 1024),
+	}
+	buf := make([]byte, 0, 64*1024)
+	measure := func(msg wssocks.BaseMessage) float64 {
+		// Warm the pools up before measuring
+		_, err := wssocks.AppendMessage(buf, msg)
+		require.NoError(t, err)
+		return testing.AllocsPerRun(100, func() {
+			if _, err := wssocks.AppendMessage(buf[:0], msg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Uncompressed data is packed without allocating
+	require.Zero(t, measure(data))
+
+	// Pooled buffers and codec states may be dropped by a garbage collection during the run
+	data.Compression = wssocks.DataCompressionGzip
+	require.LessOrEqual(t, measure(data), 2.0)
+}
+
+func TestReadPooledFrameAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not measured with the race detector")
+	}
+	var stream bytes.Buffer
+	writer := wssocks.NewFrameWriter(&stream)
+	msg := wssocks.DataMessage{Protocol: "tcp", ChannelID: uuid.New(), Data: bytes.Repeat([]byte("wssocks "), 1024)}
+	for i := 0; i < 200; i++ {
+		require.NoError(t, writer.WriteMessage(msg))
+	}
+	reader := wssocks.NewFrameReader(bytes.NewReader(stream.Bytes()))
+
+	// Released frames are reused by the next reads
+	frame, err := reader.ReadPooledFrame()
+	require.NoError(t, err)
+	frame.Release()
+	allocs := testing.AllocsPerRun(100, func() {
+		frame, err := reader.ReadPooledFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame.Release()
+	})
+	require.Zero(t, allocs)
+
+	frame, err = reader.ReadPooledFrame()
+	require.NoError(t, err)
+	defer frame.Release()
+	parsed, err := wssocks.ParseMessage(frame.Data)
+	require.NoError(t, err)
+	require.Equal(t, msg.Data, parsed.(wssocks.DataMessage).Data)
+}
@@ -0,0 +1,313 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+// countingCompressor is a gzip codec counting its calls
+type countingCompressor struct {
+	compress   atomic.Int32
+	decompress atomic.Int32
+}
+
+func (c *countingCompressor) Compress(data []byte) ([]byte, error) {
+	c.compress.Add(1)
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *countingCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	c.decompress.Add(1)
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, int64(limit)))
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	const customCompression = 0x10
+	codec := &countingCompressor{}
+	wssocks.RegisterCompressor(customCompression, "counting", codec)
+
+	server := forwardServer(t, &ProxyTestServerOption{Compressions: []byte{wssocks.DataCompressionDeflate, customCompression}})
+	defer server.Close()
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort:              server.WSPort,
+		Token:               server.Token,
+		Compressions:        []byte{customCompression, wssocks.DataCompressionGzip},
+		AdaptiveCompression: true,
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Client.Dial(ctx, "udp", globalUDPServer)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo := func(data []byte) {
+		_, err := conn.Write(data)
+		require.NoError(t, err)
+		buffer := make([]byte, 4096)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		n, err := conn.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, data, buffer[:n])
+	}
+
+	// Compressible data is sent with the negotiated codec
+	echo(bytes.Repeat([]byte("compress"), 128))
+	require.Equal(t, int32(1), codec.compress.Load())
+	require.Equal(t, int32(1), codec.decompress.Load())
+
+	// Random data is skipped by adaptive compression
+	random := make([]byte, 1024)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	echo(random)
+	require.Equal(t, int32(1), codec.compress.Load())
+}
+
+func TestCompressionConnector(t *testing.T) {
+	const customCompression = 0x11
+	codec := &countingCompressor{}
+	wssocks.RegisterCompressor(customCompression, "counting-connector", codec)
+
+	server := reverseServer(t, &ProxyTestServerOption{ConnectorToken: "CONNECTOR"})
+	defer server.Close()
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort:       server.WSPort,
+		Token:        server.Token,
+		Compressions: []byte{wssocks.DataCompressionGzip},
+	})
+	defer provider.Close()
+	connector := forwardClient(t, &ProxyTestClientOption{
+		WSPort:              server.WSPort,
+		Token:               "CONNECTOR",
+		Compressions:        []byte{customCompression},
+		AdaptiveCompression: true,
+	})
+	defer connector.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := connector.Client.Dial(ctx, "udp", globalUDPServer)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte("compress"), 128)
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	buffer := make([]byte, 4096)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	require.Equal(t, data, buffer[:n])
+
+	// Data of the connector is forwarded to the provider without the codec it did not accept
+	require.Equal(t, int32(1), codec.compress.Load())
+	require.Equal(t, int32(1), codec.decompress.Load())
+}
+
+func TestCompressionLegacyAuth(t *testing.T) {
+	packed, err := wssocks.PackMessage(wssocks.AuthMessage{
+		Token:        "token",
+		Instance:     uuid.New(),
+		Compressions: []byte{wssocks.DataCompressionDeflate},
+	})
+	require.NoError(t, err)
+
+	msg, err := wssocks.ParseMessage(packed)
+	require.NoError(t, err)
+	require.Equal(t, []byte{wssocks.DataCompressionDeflate}, msg.(wssocks.AuthMessage).Compressions)
+
+	// Auth messages of older clients end after the instance and imply gzip support
+	msg, err = wssocks.ParseMessage(packed[:len(packed)-2-6])
+	require.NoError(t, err)
+	require.Equal(t, []byte{wssocks.DataCompressionGzip}, msg.(wssocks.AuthMessage).Compressions)
+
+	msg, err = wssocks.ParseMessage([]byte{wssocks.ProtocolVersion, wssocks.BinaryTypeAuthResponse, 0x01})
+	require.NoError(t, err)
+	require.Equal(t, wssocks.DataCompressionGzip, msg.(wssocks.AuthResponseMessage).Compression)
+}
+
+func TestLZ4Compression(t *testing.T) {
+	random := make([]byte, 100000)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	// Text with matches near and far, long runs and literals between them
+	var text bytes.Buffer
+	for i := 0; text.Len() < 300000; i++ {
+		fmt.Fprintf(&text, "line %d of the wssocks compression test, ", i%1000)
+		if i%97 == 0 {
+			text.Write(random[:i%300])
+			text.Write(bytes.Repeat([]byte{'a'}, i%700))
+		}
+	}
+
+	inputs := [][]byte{
+		{},
+		[]byte("short"),
+		bytes.Repeat([]byte("ab"), 10),
+		bytes.Repeat([]byte{0}, 70000),
+		text.Bytes(),
+		random,
+	}
+	for _, data := range inputs {
+		packed, err := wssocks.PackMessage(wssocks.DataMessage{
+			Protocol:    "tcp",
+			ChannelID:   uuid.New(),
+			Data:        data,
+			Compression: wssocks.DataCompressionLZ4,
+		})
+		require.NoError(t, err)
+		msg, err := wssocks.ParseMessage(packed)
+		require.NoError(t, err)
+		require.Equal(t, len(data), len(msg.(wssocks.DataMessage).Data))
+		require.True(t, bytes.Equal(data, msg.(wssocks.DataMessage).Data))
+		if len(data) > 1000 && &data[0] != &random[0] {
+			require.Less(t, len(packed), len(data)/2)
+		}
+	}
+
+	// Peers negotiating the codec exchange data with it
+	server := forwardServer(t, &ProxyTestServerOption{Compressions: []byte{wssocks.DataCompressionLZ4}})
+	defer server.Close()
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort:       server.WSPort,
+		Token:        server.Token,
+		Compressions: []byte{wssocks.DataCompressionLZ4, wssocks.DataCompressionGzip},
+	})
+	defer client.Close()
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+}
+
+// lz4DataHeaderSize is the size of the header of packed TCP data messages without a stream ID
+const lz4DataHeaderSize = 24
+
+// packLZ4 returns the payload of data compressed by the LZ4 codec of the protocol, the
+// original size as a little endian uint32 followed by an LZ4 block
+func packLZ4(t *testing.T, data []byte) []byte {
+	packed, err := wssocks.PackMessage(wssocks.DataMessage{
+		Protocol:    "tcp",
+		ChannelID:   uuid.New(),
+		Data:        data,
+		Compression: wssocks.DataCompressionLZ4,
+	})
+	require.NoError(t, err)
+	require.Equal(t, wssocks.DataCompressionLZ4, packed[lz4DataHeaderSize-5], "data not compressed")
+	return packed[lz4DataHeaderSize:]
+}
+
+// unpackLZ4 returns the data of an LZ4 block of the given original size as parsed by the protocol
+func unpackLZ4(t *testing.T, block []byte, size int) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(size))
+	payload = append(payload, block...)
+	packed, err := wssocks.PackMessage(wssocks.DataMessage{Protocol: "tcp", ChannelID: uuid.New()})
+	require.NoError(t, err)
+	packed = packed[:lz4DataHeaderSize-5]
+	packed = append(packed, wssocks.DataCompressionLZ4)
+	packed = binary.BigEndian.AppendUint32(packed, uint32(len(payload)))
+	packed = append(packed, payload...)
+
+	msg, err := wssocks.ParseMessage(packed)
+	require.NoError(t, err)
+	return msg.(wssocks.DataMessage).Data
+}
+
+func TestLZ4ReferenceBlocks(t *testing.T) {
+	// Blocks compressed by the reference implementation (lz4 1.9.4)
+	var text strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&text, "line %d of the wssocks lz4 test, ", i%7)
+	}
+	for _, tc := range []struct {
+		data  string
+		block string
+	}{
+		{data: "short", block: "5073686f7274"},
+		{data: strings.Repeat("ab", 10), block: "2961620200506261626162"},
+		{
+			data: text.String(),
+			block: "f1116c696e652030206f6620746865207773736f636b73206c7a3420746573742c2020001f3120000c1f32" +
+				"20000c1f3320000c1f3420000c1f3520000c1f3620000c0fe000ffffffff07506573742c20",
+		},
+	} {
+		block, err := hex.DecodeString(tc.block)
+		require.NoError(t, err)
+		require.Equal(t, tc.data, string(unpackLZ4(t, block, len(tc.data))))
+	}
+}
+
+// lz4LegacyMagic starts the legacy frames of the reference lz4 tool, made of blocks of up to
+// 8 MiB each preceded by its compressed size
+const lz4LegacyMagic = 0x184C2102
+
+func TestLZ4ReferenceTool(t *testing.T) {
+	tool, err := exec.LookPath("lz4")
+	if err != nil {
+		t.Skip("lz4 tool not installed")
+	}
+
+	random := make([]byte, 50000)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	var text bytes.Buffer
+	for i := 0; text.Len() < 1<<20; i++ {
+		fmt.Fprintf(&text, "line %d of the wssocks lz4 test, ", i%5000)
+		if i%89 == 0 {
+			text.Write(random[:i%500])
+			text.Write(bytes.Repeat([]byte{'z'}, i%900))
+		}
+	}
+
+	for _, data := range [][]byte{
+		bytes.Repeat([]byte("ab"), 10),
+		bytes.Repeat([]byte{0}, 70000),
+		text.Bytes(),
+	} {
+		// Blocks of the codec are decompressed by the tool
+		payload := packLZ4(t, data)
+		frame := binary.LittleEndian.AppendUint32(nil, lz4LegacyMagic)
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(payload)-4))
+		frame = append(frame, payload[4:]...)
+		cmd := exec.Command(tool, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(frame)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, out), "data decompressed by lz4 differs")
+
+		// Blocks of the tool are decompressed by the codec
+		cmd = exec.Command(tool, "-l", "-c")
+		cmd.Stdin = bytes.NewReader(data)
+		frame, err = cmd.Output()
+		require.NoError(t, err)
+		require.Equal(t, uint32(lz4LegacyMagic), binary.LittleEndian.Uint32(frame))
+		size := binary.LittleEndian.Uint32(frame[4:])
+		require.Equal(t, int(size), len(frame)-8, "data compressed by lz4 in several blocks")
+		require.True(t, bytes.Equal(data, unpackLZ4(t, frame[8:], len(data))), "data decompressed by the codec differs")
+	}
+}
@@ -0,0 +1,284 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+func TestClientDial(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: env.Client.Client.Dial,
+		},
+		Timeout: 5 * time.Second,
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get(globalHTTPServer)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	// Networks with an address family only dial addresses of that family
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = env.Client.Client.Dial(ctx, "tcp6", u.Host)
+	var addrErr *net.AddrError
+	require.ErrorAs(t, err, &addrErr)
+	conn, err := env.Client.Client.Dial(ctx, "tcp4", net.JoinHostPort("localhost", u.Port()))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestClientDialRefused(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// Dial waits for the remote connection even without strict connect
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = env.Client.Client.Dial(ctx, "tcp", addr)
+	require.ErrorIs(t, err, wssocks.ErrConnectFailed)
+}
+
+func TestClientDialUDP(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Close()
+
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer remote.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer other.Close()
+
+	// The remote answers through another socket first, then by itself
+	go func() {
+		buf := make([]byte, 1024)
+		n, addr, err := remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		other.WriteTo([]byte("other"), addr)
+		time.Sleep(100 * time.Millisecond)
+		remote.WriteTo(buf[:n], addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := env.Client.Client.Dial(ctx, "udp", remote.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, remote.LocalAddr().String(), conn.RemoteAddr().String())
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestClientListenPacketDisconnect(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := env.Client.Client.ListenPacket(ctx)
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// Readers are unblocked when the connection carrying the channel drops
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 1024))
+		result <- err
+	}()
+	env.Server.Close()
+
+	select {
+	case err := <-result:
+		require.True(t, errors.Is(err, net.ErrClosed), "unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "reader not unblocked")
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := env.Client.Client.ListenPacket(ctx)
+	require.NoError(t, err)
+	defer pc.Close()
+
+	serverAddr, err := net.ResolveUDPAddr("udp", globalUDPServer)
+	require.NoError(t, err)
+
+	testData := []byte("Hello UDP")
+	buffer := make([]byte, 1024)
+	successCount := 0
+	for i := 0; i < udpTestAttempts; i++ {
+		_, err := pc.WriteTo(testData, serverAddr)
+		require.NoError(t, err)
+
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+		n, addr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			continue
+		}
+		require.Equal(t, testData, buffer[:n])
+		require.Equal(t, serverAddr.Port, addr.(*net.UDPAddr).Port)
+		successCount++
+	}
+	require.Greater(t, successCount, udpTestAttempts/2)
+
+	// Dialing a UDP "connection" shares the same channel implementation
+	conn, err := env.Client.Client.Dial(ctx, "udp", globalUDPServer)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(testData)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	require.Equal(t, testData, buffer[:n])
+}
+
+func TestServerListen(t *testing.T) {
+	env := forwardProxy(t)
+	defer env.Close()
+
+	listener, err := env.Server.Server.Listen(env.Server.Token)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	_, err = env.Server.Server.Listen(env.Server.Token)
+	require.Error(t, err)
+
+	targets := make(chan string, 10)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			targets <- c.LocalAddr().String()
+			return ctx
+		},
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// The target does not exist, the request is served by the listener
+	require.NoError(t, testWebConnection("http://app.internal:8080/generate_204", &ProxyConfig{Port: env.SocksPort}))
+	require.Equal(t, "app.internal:8080", <-targets)
+
+	// Closing the listener restores dialing the requested target
+	require.NoError(t, listener.Close())
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: env.SocksPort}))
+}
+
+func TestServerListenReverse(t *testing.T) {
+	server := reverseServer(t, &ProxyTestServerOption{
+		ConnectorToken: "CONNECTOR",
+	})
+	defer server.Close()
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  server.Token,
+	})
+	defer provider.Close()
+	connector := forwardClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  "CONNECTOR",
+	})
+	defer connector.Close()
+
+	_, err := server.Server.Listen("CONNECTOR")
+	require.Error(t, err)
+	listener, err := server.Server.Listen(server.Token)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	targets := make(chan string, 10)
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			targets <- c.LocalAddr().String()
+			return ctx
+		},
+	}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	// Connections requested by connectors are served by the listener instead of a provider
+	require.NoError(t, testWebConnection("http://app.internal:8080/generate_204", &ProxyConfig{Port: connector.SocksPort}))
+	require.Equal(t, "app.internal:8080", <-targets)
+
+	require.NoError(t, listener.Close())
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: connector.SocksPort}))
+}
+
+// redirectDialer sends every TCP connection to a fixed address and counts dials
+type redirectDialer struct {
+	wssocks.DirectDialer
+	target string
+	tcp    atomic.Int32
+	udp    atomic.Int32
+}
+
+func (d *redirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.tcp.Add(1)
+	return d.DirectDialer.DialContext(ctx, network, d.target)
+}
+
+func (d *redirectDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	d.udp.Add(1)
+	return d.DirectDialer.ListenPacket(ctx, network, address)
+}
+
+func TestCustomDialer(t *testing.T) {
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	dialer := &redirectDialer{target: u.Host}
+
+	server := forwardServer(t, &ProxyTestServerOption{Dialer: dialer})
+	defer server.Close()
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  server.Token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection("http://mocked.internal/generate_204", &ProxyConfig{Port: client.SocksPort}))
+	require.Equal(t, int32(1), dialer.tcp.Load())
+
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+	require.Equal(t, int32(1), dialer.udp.Load())
+}
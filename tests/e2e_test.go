@@ -0,0 +1,243 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+func TestE2EEncryption(t *testing.T) {
+	server := reverseServer(t, &ProxyTestServerOption{
+		ConnectorToken: "CONNECTOR",
+	})
+	defer server.Close()
+
+	// Record what the server sends to the provider, compression disabled to expose payloads
+	relayPort, recorded, cleanup, err := startRecordingRelay(fmt.Sprintf("127.0.0.1:%d", server.WSPort))
+	require.NoError(t, err)
+	defer cleanup()
+
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort:       relayPort,
+		Token:        server.Token,
+		LoggerPrefix: "CLT1",
+		Compressions: []byte{},
+		E2ESecret:    "SECRET",
+	})
+	defer provider.Close()
+
+	echo := func(secret string, payload []byte) error {
+		connector := forwardClient(t, &ProxyTestClientOption{
+			WSPort:       server.WSPort,
+			Token:        "CONNECTOR",
+			LoggerPrefix: "CLT2",
+			Compressions: []byte{},
+			E2ESecret:    secret,
+			// The server only routes data of connector channels once the provider is chosen
+			StrictConnect: true,
+		})
+		defer connector.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := connector.Client.Dial(ctx, "udp", globalUDPServer)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(payload)
+		require.NoError(t, err)
+		buffer := make([]byte, 1024)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+		require.Equal(t, payload, buffer[:n])
+		return nil
+	}
+
+	// Plain channels are readable by the server
+	plain := []byte("plain payload seen by the server")
+	require.NoError(t, echo("", plain))
+	require.True(t, bytes.Contains(recorded(), plain))
+
+	// Encrypted channels are not
+	secret := []byte("secret payload hidden from the server")
+	require.NoError(t, echo("SECRET", secret))
+	require.False(t, bytes.Contains(recorded(), secret))
+
+	// Channels requested with another secret are refused by the provider
+	require.ErrorIs(t, echo("WRONG", []byte("payload with a wrong secret")), wssocks.ErrConnectFailed)
+}
+
+func TestE2ETampering(t *testing.T) {
+	server := reverseServer(t, &ProxyTestServerOption{
+		ConnectorToken: "CONNECTOR",
+	})
+	defer server.Close()
+
+	// The server is played by a relay altering what it sends to the provider
+	var tamper atomic.Pointer[func(wssocks.BaseMessage) wssocks.BaseMessage]
+	relayPort, inject, cleanup, err := startTamperingRelay(fmt.Sprintf("127.0.0.1:%d", server.WSPort), func(data []byte) []byte {
+		f := tamper.Load()
+		if f == nil {
+			return data
+		}
+		msg, err := wssocks.ParseMessage(data)
+		if err != nil {
+			return data
+		}
+		packed, err := wssocks.PackMessage((*f)(msg))
+		if err != nil {
+			return data
+		}
+		return packed
+	})
+	require.NoError(t, err)
+	defer cleanup()
+
+	provider := reverseClient(t, &ProxyTestClientOption{
+		WSPort:       relayPort,
+		Token:        server.Token,
+		LoggerPrefix: "CLT1",
+		E2ESecret:    "SECRET",
+	})
+	defer provider.Close()
+	connector := forwardClient(t, &ProxyTestClientOption{
+		WSPort:        server.WSPort,
+		Token:         "CONNECTOR",
+		LoggerPrefix:  "CLT2",
+		E2ESecret:     "SECRET",
+		StrictConnect: true,
+	})
+	defer connector.Close()
+
+	// Targets the relay redirects channels to
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer decoy.Close()
+	decoyPort := decoy.Addr().(*net.TCPAddr).Port
+	decoyUDP, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer decoyUDP.Close()
+	decoyUDPPort := decoyUDP.LocalAddr().(*net.UDPAddr).Port
+	requireNoDecoyDatagram := func() {
+		require.NoError(t, decoyUDP.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		_, _, err := decoyUDP.ReadFrom(make([]byte, 1024))
+		require.Error(t, err, "datagram delivered to the decoy")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setTamper := func(f func(wssocks.BaseMessage) wssocks.BaseMessage) {
+		tamper.Store(&f)
+	}
+
+	// Connect requests to another target are refused
+	setTamper(func(msg wssocks.BaseMessage) wssocks.BaseMessage {
+		if m, ok := msg.(wssocks.ConnectMessage); ok && m.Protocol == "tcp" {
+			m.Address, m.Port = "127.0.0.1", decoyPort
+			return m
+		}
+		return msg
+	})
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	_, err = connector.Client.Dial(ctx, "tcp", u.Host)
+	require.ErrorIs(t, err, wssocks.ErrConnectFailed)
+	accepted := make(chan struct{})
+	go func() {
+		if conn, err := decoy.Accept(); err == nil {
+			conn.Close()
+			close(accepted)
+		}
+	}()
+	select {
+	case <-accepted:
+		require.FailNow(t, "connection opened to the decoy")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Datagrams sent to another target are dropped
+	setTamper(func(msg wssocks.BaseMessage) wssocks.BaseMessage {
+		if m, ok := msg.(wssocks.DataMessage); ok && m.Protocol == "udp" {
+			m.TargetAddr, m.TargetPort = "127.0.0.1", decoyUDPPort
+			return m
+		}
+		return msg
+	})
+	conn, err := connector.Client.Dial(ctx, "udp", globalUDPServer)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("redirected"))
+	require.NoError(t, err)
+	requireNoDecoyDatagram()
+	conn.Close()
+
+	// Replayed channels are refused
+	var mu sync.Mutex
+	var replay []wssocks.BaseMessage
+	var channelID uuid.UUID
+	var streamID, lastStreamID uint64
+	setTamper(func(msg wssocks.BaseMessage) wssocks.BaseMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		switch m := msg.(type) {
+		case wssocks.ConnectMessage:
+			lastStreamID = m.StreamID
+			if m.Protocol == "udp" {
+				channelID, streamID = m.ChannelID, m.StreamID
+				replay = append(replay, m)
+			}
+		case wssocks.DataMessage:
+			if m.ChannelID == channelID || (m.StreamID != 0 && m.StreamID == streamID) {
+				replay = append(replay, m)
+			}
+		}
+		return msg
+	})
+	conn, err = connector.Client.Dial(ctx, "udp", decoyUDP.LocalAddr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("replayed"))
+	require.NoError(t, err)
+	require.NoError(t, decoyUDP.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := decoyUDP.ReadFrom(make([]byte, 1024))
+	require.NoError(t, err)
+	require.Equal(t, len("replayed"), n)
+	defer conn.Close()
+
+	// The relay sends the channel again under a new stream ID
+	mu.Lock()
+	require.Len(t, replay, 2)
+	replayStreamID := lastStreamID + 2
+	for _, msg := range replay {
+		switch m := msg.(type) {
+		case wssocks.ConnectMessage:
+			if m.StreamID != 0 {
+				m.StreamID = replayStreamID
+			}
+			msg = m
+		case wssocks.DataMessage:
+			if m.StreamID != 0 {
+				m.StreamID = replayStreamID
+			}
+			msg = m
+		}
+		data, err := wssocks.PackMessage(msg)
+		require.NoError(t, err)
+		require.NoError(t, inject(data))
+	}
+	mu.Unlock()
+	requireNoDecoyDatagram()
+}
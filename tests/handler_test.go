@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+func TestServerHandler(t *testing.T) {
+	decoy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "decoy")
+	})
+	server := wssocks.NewWSSocksServer(wssocks.DefaultServerOption().
+		WithLogger(createPrefixedLogger("SRV0")).
+		WithBasePath("/wssocks/").
+		WithDecoy(decoy))
+	defer server.Close()
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Mount the server into an existing mux next to other routes
+	mux := http.NewServeMux()
+	mux.Handle("/wssocks/", server.Handler(ctx))
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "other")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// Visitors see the decoy below the base path, including the socket path
+	for _, path := range []string{"/wssocks/", "/wssocks/index.html", "/wssocks/socket"} {
+		status, body := get(path)
+		require.Equal(t, http.StatusOK, status, path)
+		require.Equal(t, "decoy", body, path)
+	}
+	_, body := get("/other")
+	require.Equal(t, "other", body)
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		URL:   fmt.Sprintf("ws://127.0.0.1:%d/wssocks/socket", port),
+		Token: token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+}
+
+func TestServerSocketPaths(t *testing.T) {
+	server := wssocks.NewWSSocksServer(wssocks.DefaultServerOption().
+		WithLogger(createPrefixedLogger("SRV0")).
+		WithSocketPaths("/socket", "/tunnel/"))
+	defer server.Close()
+	token, err := server.AddForwardToken("")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: server.Handler(ctx)}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Clients connect on every socket path, with any transport
+	for _, url := range []string{
+		fmt.Sprintf("ws://127.0.0.1:%d/socket", port),
+		fmt.Sprintf("ws://127.0.0.1:%d/tunnel", port),
+		fmt.Sprintf("http+poll://127.0.0.1:%d/tunnel/", port),
+	} {
+		client := forwardClient(t, &ProxyTestClientOption{
+			URL:   url,
+			Token: token,
+		})
+		require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}), url)
+		client.Close()
+	}
+
+	// Other paths below the socket paths are unknown
+	for _, path := range []string{"/tunnel/other", "/tunnel/other/poll", "/socket/other/stream"} {
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", port, path), "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+
+		_, resp, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d%s", port, path), nil)
+		require.ErrorIs(t, err, websocket.ErrBadHandshake, path)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
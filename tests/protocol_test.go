@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+// authenticate sends an auth message on a raw WebSocket and returns the auth response
+func authenticate(t *testing.T, wsPort int, msg wssocks.AuthMessage) wssocks.AuthResponseMessage {
+	ws, response := dialRaw(t, wsPort, msg)
+	ws.Close()
+	return response
+}
+
+// dialRaw opens a raw WebSocket authenticated with msg and returns it with the auth response
+func dialRaw(t *testing.T, wsPort int, msg wssocks.AuthMessage) (*websocket.Conn, wssocks.AuthResponseMessage) {
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/socket/", wsPort), nil)
+	require.NoError(t, err)
+
+	writeRaw(t, ws, msg)
+	response, err := readRaw(ws)
+	require.NoError(t, err)
+	return ws, response.(wssocks.AuthResponseMessage)
+}
+
+func writeRaw(t *testing.T, ws *websocket.Conn, msg wssocks.BaseMessage) {
+	data, err := wssocks.PackMessage(msg)
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, data))
+}
+
+func readRaw(ws *websocket.Conn) (wssocks.BaseMessage, error) {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return wssocks.ParseMessage(data)
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	server := forwardServer(t, nil)
+	defer server.Close()
+
+	// Unknown capabilities are dropped and the highest common version is selected
+	response := authenticate(t, server.WSPort, wssocks.AuthMessage{
+		Token:        server.Token,
+		Instance:     uuid.New(),
+		MinVersion:   wssocks.MinProtocolVersion,
+		MaxVersion:   0xFF,
+		Capabilities: 0xFFFFFFFF,
+	})
+	require.True(t, response.Success)
+	require.Equal(t, wssocks.ProtocolVersion, response.Version)
+	require.Equal(t, wssocks.LocalCapabilities, response.Capabilities)
+
+	// Compressions other than gzip are only negotiated with CapabilityCompression
+	response = authenticate(t, server.WSPort, wssocks.AuthMessage{
+		Token:        server.Token,
+		Instance:     uuid.New(),
+		Compressions: []byte{wssocks.DataCompressionDeflate, wssocks.DataCompressionGzip},
+		MinVersion:   wssocks.MinProtocolVersion,
+		MaxVersion:   wssocks.ProtocolVersion,
+		Capabilities: wssocks.LocalCapabilities,
+	})
+	require.Equal(t, wssocks.DataCompressionDeflate, response.Compression)
+	response = authenticate(t, server.WSPort, wssocks.AuthMessage{
+		Token:        server.Token,
+		Instance:     uuid.New(),
+		Compressions: []byte{wssocks.DataCompressionDeflate, wssocks.DataCompressionGzip},
+		MinVersion:   wssocks.MinProtocolVersion,
+		MaxVersion:   wssocks.ProtocolVersion,
+	})
+	require.Equal(t, wssocks.DataCompressionGzip, response.Compression)
+	response = authenticate(t, server.WSPort, wssocks.AuthMessage{
+		Token:        server.Token,
+		Instance:     uuid.New(),
+		Compressions: []byte{wssocks.DataCompressionDeflate},
+		MinVersion:   wssocks.MinProtocolVersion,
+		MaxVersion:   wssocks.ProtocolVersion,
+	})
+	require.Equal(t, wssocks.DataCompressionNone, response.Compression)
+
+	// Clients only speaking newer versions are refused
+	response = authenticate(t, server.WSPort, wssocks.AuthMessage{
+		Token:      server.Token,
+		Instance:   uuid.New(),
+		MinVersion: wssocks.ProtocolVersion + 1,
+		MaxVersion: wssocks.ProtocolVersion + 1,
+	})
+	require.False(t, response.Success)
+	require.Contains(t, response.Error, "version")
+
+	// Auth messages of older clients imply the first version and no capabilities
+	packed, err := wssocks.PackMessage(wssocks.AuthMessage{Token: server.Token, Instance: uuid.New()})
+	require.NoError(t, err)
+	msg, err := wssocks.ParseMessage(packed[:len(packed)-1-6])
+	require.NoError(t, err)
+	require.Equal(t, wssocks.MinProtocolVersion, msg.(wssocks.AuthMessage).MaxVersion)
+	require.Equal(t, wssocks.Capability(0), msg.(wssocks.AuthMessage).Capabilities)
+}
+
+func TestCompactDataFrame(t *testing.T) {
+	msg := wssocks.DataMessage{
+		Protocol:   "udp",
+		ChannelID:  uuid.New(),
+		Data:       []byte("ping"),
+		Address:    "127.0.0.1",
+		Port:       53,
+		TargetAddr: "example.com",
+		TargetPort: 53,
+	}
+	full, err := wssocks.PackMessage(msg)
+	require.NoError(t, err)
+
+	msg.StreamID = 300
+	compact, err := wssocks.PackMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, wssocks.BinaryTypeCompactData, compact[1])
+	require.LessOrEqual(t, len(compact), len(full)-16)
+
+	parsed, err := wssocks.ParseMessage(compact)
+	require.NoError(t, err)
+	data := parsed.(wssocks.DataMessage)
+	require.Equal(t, uint64(300), data.StreamID)
+	require.Equal(t, uuid.Nil, data.ChannelID) // Resolved by the connection
+	require.Equal(t, msg.Data, data.Data)
+	require.Equal(t, msg.TargetAddr, data.TargetAddr)
+	require.Equal(t, msg.Port, data.Port)
+
+	// Truncated frames must be rejected instead of panicking
+	for i := 2; i < len(compact); i++ {
+		_, err := wssocks.ParseMessage(compact[:i])
+		require.Error(t, err)
+	}
+}
+
+func TestStreamIDValidation(t *testing.T) {
+	server := forwardServer(t, nil)
+	defer server.Close()
+
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	dial := func() *websocket.Conn {
+		ws, response := dialRaw(t, server.WSPort, wssocks.AuthMessage{
+			Token:        server.Token,
+			Instance:     uuid.New(),
+			MinVersion:   wssocks.MinProtocolVersion,
+			MaxVersion:   wssocks.ProtocolVersion,
+			Capabilities: wssocks.LocalCapabilities,
+		})
+		require.True(t, response.Success)
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		return ws
+	}
+	connect := func(streamID uint64) wssocks.ConnectMessage {
+		return wssocks.ConnectMessage{Protocol: "tcp", Address: host, Port: port, ChannelID: uuid.New(), StreamID: streamID}
+	}
+	// requireClosed reads until the server closes the connection, failing on connect responses
+	requireClosed := func(ws *websocket.Conn) {
+		for {
+			msg, err := readRaw(ws)
+			if err != nil {
+				var netErr net.Error
+				require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection not closed")
+				return
+			}
+			_, ok := msg.(wssocks.ConnectResponseMessage)
+			require.False(t, ok, "connect request with an invalid stream ID accepted")
+		}
+	}
+
+	// Clients assign odd stream IDs
+	ws := dial()
+	defer ws.Close()
+	writeRaw(t, ws, connect(1))
+	for {
+		msg, err := readRaw(ws)
+		require.NoError(t, err)
+		if response, ok := msg.(wssocks.ConnectResponseMessage); ok {
+			require.True(t, response.Success)
+			break
+		}
+	}
+
+	// and never reuse them
+	writeRaw(t, ws, connect(1))
+	requireClosed(ws)
+
+	// IDs of the server are refused
+	ws = dial()
+	defer ws.Close()
+	writeRaw(t, ws, connect(2))
+	requireClosed(ws)
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package tests
+
+// The race detector allocates on its own, so allocation counts are not measured
+const raceEnabled = true
@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/socks5"
+)
+
+func TestSocks5HandshakeFragmented(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	type result struct {
+		request *socks5.Request
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		request, err := socks5.Handshake(server, socks5.StaticAuth("user", "pass"))
+		if err == nil {
+			err = socks5.WriteReply(server, socks5.RepSuccess, nil)
+		}
+		done <- result{request, err}
+	}()
+
+	// Write every message one byte at a time
+	writeBytes := func(b []byte) {
+		for i := range b {
+			_, err := client.Write(b[i : i+1])
+			require.NoError(t, err)
+		}
+	}
+	readBytes := func(n int) []byte {
+		buf := make([]byte, n)
+		_, err := client.Read(buf)
+		require.NoError(t, err)
+		return buf
+	}
+
+	writeBytes([]byte{0x05, 0x02, 0x00, 0x02})
+	require.Equal(t, []byte{0x05, 0x02}, readBytes(2))
+	writeBytes([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'})
+	require.Equal(t, []byte{0x01, 0x00}, readBytes(2))
+
+	request, err := socks5.AppendAddr([]byte{0x05, socks5.CmdConnect, 0x00}, "example.com", 443)
+	require.NoError(t, err)
+	writeBytes(request)
+	require.Equal(t, []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, readBytes(10))
+
+	res := <-done
+	require.NoError(t, res.err)
+	require.Equal(t, byte(socks5.CmdConnect), res.request.Command)
+	require.Equal(t, "example.com:443", res.request.Addr())
+	require.Equal(t, "user", res.request.Username)
+}
+
+func TestSocks5HandshakeAuthFailed(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := socks5.Handshake(server, socks5.StaticAuth("user", "pass"))
+		done <- err
+	}()
+
+	err := socks5.ClientHandshake(client, "user", "wrong")
+	require.ErrorIs(t, err, socks5.ErrAuthFailed)
+	require.ErrorIs(t, <-done, socks5.ErrAuthFailed)
+}
+
+func TestSocks5UDPDatagram(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1", "example.com"} {
+		datagram, err := socks5.AppendUDPHeader(nil, host, 53)
+		require.NoError(t, err)
+		datagram = append(datagram, "payload"...)
+
+		parsedHost, port, payload, err := socks5.ParseUDPDatagram(datagram)
+		require.NoError(t, err)
+		require.Equal(t, host, parsedHost)
+		require.Equal(t, 53, port)
+		require.Equal(t, []byte("payload"), payload)
+
+		// Truncated datagrams must be rejected instead of panicking
+		_, _, _, err = socks5.ParseUDPDatagram(datagram[:5])
+		require.Error(t, err)
+	}
+
+	_, _, _, err := socks5.ParseUDPDatagram([]byte{0x00, 0x00, 0x01, 0x01, 127, 0, 0, 1, 0, 53})
+	require.ErrorIs(t, err, socks5.ErrFragmented)
+}
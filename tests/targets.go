@@ -1,12 +1,22 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // startUDPEchoServer starts a UDP echo server (IPv4 or IPv6) and returns both IP and domain-based addresses
@@ -137,3 +147,287 @@ func startTestHTTPServer(useIPv6 bool) (string, func(), error) {
 
 	return urlAddr, cleanup, nil
 }
+
+// startHTTPConnectProxy starts an HTTP CONNECT proxy requiring the given basic auth credentials,
+// and returns its address along with a counter of established tunnels
+func startHTTPConnectProxy(username, password string) (string, *atomic.Int32, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	tunnels := &atomic.Int32{}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect {
+					conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != expectedAuth {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+
+				tunnels.Add(1)
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+				done := make(chan struct{}, 2)
+				go func() {
+					io.Copy(target, reader)
+					done <- struct{}{}
+				}()
+				go func() {
+					io.Copy(conn, target)
+					done <- struct{}{}
+				}()
+				<-done
+			}()
+		}
+	}()
+
+	cleanup := func() {
+		listener.Close()
+		wg.Wait()
+	}
+
+	return listener.Addr().String(), tunnels, cleanup, nil
+}
+
+// startRecordingRelay starts a TCP relay to target recording everything the target sends, and
+// returns its port along with a function returning a copy of the recorded bytes
+func startRecordingRelay(target string) (int, func() []byte, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var mu sync.Mutex
+	var recorded bytes.Buffer
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				done := make(chan struct{}, 2)
+				go func() {
+					io.Copy(upstream, conn)
+					done <- struct{}{}
+				}()
+				go func() {
+					buffer := make([]byte, 32*1024)
+					for {
+						n, err := upstream.Read(buffer)
+						if n > 0 {
+							mu.Lock()
+							recorded.Write(buffer[:n])
+							mu.Unlock()
+							if _, err := conn.Write(buffer[:n]); err != nil {
+								break
+							}
+						}
+						if err != nil {
+							break
+						}
+					}
+					done <- struct{}{}
+				}()
+				<-done
+			}()
+		}
+	}()
+
+	record := func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]byte(nil), recorded.Bytes()...)
+	}
+	cleanup := func() {
+		listener.Close()
+		wg.Wait()
+	}
+
+	return listener.Addr().(*net.TCPAddr).Port, record, cleanup, nil
+}
+
+// startUpgradeBlockingProxy starts an HTTP reverse proxy to target refusing WebSocket upgrades,
+// and requests to the stream transport if blockStream is set, like restrictive corporate proxies
+func startUpgradeBlockingProxy(target string, blockStream bool) (int, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+	proxy.FlushInterval = -1
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || (blockStream && strings.HasSuffix(r.URL.Path, "/stream")) {
+			http.Error(w, "blocked by proxy", http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})}
+	go server.Serve(listener)
+
+	cleanup := func() {
+		server.Close()
+	}
+	return listener.Addr().(*net.TCPAddr).Port, cleanup, nil
+}
+
+// startTamperingRelay starts a WebSocket proxy to the server at target, passing each frame the
+// server sends to clients through tamper, which may alter it or return nil to drop it. It also
+// returns a function injecting frames to the last connected client.
+func startTamperingRelay(target string, tamper func([]byte) []byte) (int, func([]byte) error, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var mu sync.Mutex // Guards last and writes to clients
+	var last *websocket.Conn
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s%s", target, r.URL.RequestURI()), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		client, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		mu.Lock()
+		last = client
+		mu.Unlock()
+
+		go func() {
+			defer upstream.Close()
+			defer client.Close()
+			for {
+				messageType, data, err := client.ReadMessage()
+				if err != nil || upstream.WriteMessage(messageType, data) != nil {
+					return
+				}
+			}
+		}()
+		for {
+			messageType, data, err := upstream.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				if data = tamper(data); data == nil {
+					continue
+				}
+			}
+			mu.Lock()
+			err = client.WriteMessage(messageType, data)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	})}
+	go server.Serve(listener)
+
+	inject := func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if last == nil {
+			return fmt.Errorf("no client connected")
+		}
+		return last.WriteMessage(websocket.BinaryMessage, data)
+	}
+	cleanup := func() {
+		server.Close()
+	}
+
+	return listener.Addr().(*net.TCPAddr).Port, inject, cleanup, nil
+}
+
+// startLossyUDPRelay starts a UDP relay between a single client and target dropping one packet
+// out of every dropEvery in each direction, like a lossy network
+func startLossyUDPRelay(target string, dropEvery int) (int, func(), error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, nil, err
+	}
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
+
+	var client atomic.Pointer[net.Addr]
+	go func() {
+		buffer := make([]byte, 64*1024)
+		for count := 1; ; count++ {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			client.Store(&addr)
+			if count%dropEvery != 0 {
+				upstream.Write(buffer[:n])
+			}
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 64*1024)
+		for count := 1; ; count++ {
+			n, err := upstream.Read(buffer)
+			if err != nil {
+				return
+			}
+			if addr := client.Load(); addr != nil && count%dropEvery != 0 {
+				conn.WriteTo(buffer[:n], *addr)
+			}
+		}
+	}()
+
+	cleanup := func() {
+		conn.Close()
+		upstream.Close()
+	}
+	return conn.LocalAddr().(*net.UDPAddr).Port, cleanup, nil
+}
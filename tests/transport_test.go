@@ -0,0 +1,269 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+func TestStreamTransport(t *testing.T) {
+	server := forwardServer(t, nil)
+	defer server.Close()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		URL:   fmt.Sprintf("http+stream://localhost:%d", server.WSPort),
+		Token: server.Token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+}
+
+func TestPollTransport(t *testing.T) {
+	server := reverseServer(t, nil)
+	defer server.Close()
+
+	client := reverseClient(t, &ProxyTestClientOption{
+		URL:   fmt.Sprintf("http+poll://localhost:%d", server.WSPort),
+		Token: server.Token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: server.SocksPort}))
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: server.SocksPort})
+}
+
+func TestPollRedelivery(t *testing.T) {
+	server := forwardServer(t, nil)
+	defer server.Close()
+
+	endpoint := fmt.Sprintf("http://localhost:%d/socket/poll", server.WSPort)
+	resp, err := http.Post(endpoint, "", nil)
+	require.NoError(t, err)
+	sessionID, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	sessionURL := endpoint + "?session=" + url.QueryEscape(string(sessionID))
+
+	send := func(seq int, msg wssocks.BaseMessage) {
+		var body bytes.Buffer
+		require.NoError(t, wssocks.NewFrameWriter(&body).WriteMessage(msg))
+		resp, err := http.Post(fmt.Sprintf("%s&seq=%d", sessionURL, seq), "application/octet-stream", &body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	// poll returns the batch acknowledging ack and its sequence number, nil if none came in time
+	poll := func(ack uint64, timeout time.Duration) ([]byte, uint64) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s&ack=%d", sessionURL, ack), nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ack
+		}
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return nil, ack
+		}
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		batch, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		seq, err := strconv.ParseUint(resp.Header.Get("X-Poll-Seq"), 10, 64)
+		require.NoError(t, err)
+		return batch, seq
+	}
+	messages := func(batch []byte) []wssocks.BaseMessage {
+		var msgs []wssocks.BaseMessage
+		reader := wssocks.NewFrameReader(bytes.NewReader(batch))
+		for {
+			msg, err := reader.ReadMessage()
+			if errors.Is(err, io.EOF) {
+				return msgs
+			}
+			require.NoError(t, err)
+			msgs = append(msgs, msg)
+		}
+	}
+
+	send(1, wssocks.AuthMessage{
+		Token:      server.Token,
+		Instance:   uuid.New(),
+		MinVersion: wssocks.MinProtocolVersion,
+		MaxVersion: wssocks.ProtocolVersion,
+	})
+	batch, seq := poll(0, 5*time.Second)
+	require.Equal(t, uint64(1), seq)
+	require.True(t, messages(batch)[0].(wssocks.AuthResponseMessage).Success)
+
+	// Batches are returned again until acknowledged
+	again, seq := poll(0, 5*time.Second)
+	require.Equal(t, uint64(1), seq)
+	require.Equal(t, batch, again)
+
+	// Batches sent again by the client are queued once
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	connect := wssocks.ConnectMessage{Protocol: "tcp", Address: host, Port: port, ChannelID: uuid.New()}
+	send(2, connect)
+	send(2, connect)
+
+	responses := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		batch, next := poll(seq, time.Until(deadline))
+		for _, msg := range messages(batch) {
+			if _, ok := msg.(wssocks.ConnectResponseMessage); ok {
+				responses++
+			}
+		}
+		seq = next
+	}
+	require.Equal(t, 1, responses)
+}
+
+func TestTransportFallback(t *testing.T) {
+	server := forwardServer(t, nil)
+	defer server.Close()
+
+	// Only plain HTTP requests pass the proxy, so the client falls back to polling
+	proxyPort, cleanup, err := startUpgradeBlockingProxy(fmt.Sprintf("127.0.0.1:%d", server.WSPort), true)
+	require.NoError(t, err)
+	defer cleanup()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: proxyPort,
+		Token:  server.Token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+}
+
+func TestTCPTransport(t *testing.T) {
+	cert, roots, err := generateTestCertificate()
+	require.NoError(t, err)
+	tcpPort, err := getFreePort()
+	require.NoError(t, err)
+
+	server := forwardServer(t, &ProxyTestServerOption{
+		TCPPort:   tcpPort,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer server.Close()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		URL:       fmt.Sprintf("tcp+tls://localhost:%d", tcpPort),
+		Token:     server.Token,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+}
+
+func TestTCPTransportMissingPort(t *testing.T) {
+	client := wssocks.NewWSSocksClient("TOKEN", wssocks.DefaultClientOption().
+		WithWSURL("tcp+tls://localhost").
+		WithLogger(createPrefixedLogger("CLT")))
+	defer client.Close()
+
+	err := client.WaitReady(context.Background(), 5*time.Second)
+	require.ErrorContains(t, err, "missing port in tcp+tls URL")
+}
+
+func TestQUICTransport(t *testing.T) {
+	cert, roots, err := generateTestCertificate()
+	require.NoError(t, err)
+	quicPort, err := getFreePort()
+	require.NoError(t, err)
+
+	server := forwardServer(t, &ProxyTestServerOption{
+		QUICPort:  quicPort,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer server.Close()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		URL:       fmt.Sprintf("quic://localhost:%d", quicPort),
+		Token:     server.Token,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+}
+
+func TestQUICTransportLoss(t *testing.T) {
+	cert, roots, err := generateTestCertificate()
+	require.NoError(t, err)
+	quicPort, err := getFreePort()
+	require.NoError(t, err)
+
+	server := forwardServer(t, &ProxyTestServerOption{
+		QUICPort:  quicPort,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer server.Close()
+
+	// Lost packets are sent again, so the data arrives whole and in order
+	relayPort, cleanup, err := startLossyUDPRelay(fmt.Sprintf("127.0.0.1:%d", quicPort), 4)
+	require.NoError(t, err)
+	defer cleanup()
+
+	client := forwardClient(t, &ProxyTestClientOption{
+		URL:       fmt.Sprintf("quic://127.0.0.1:%d", relayPort),
+		Token:     server.Token,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := client.Client.Dial(ctx, "tcp", echo.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	payload := make([]byte, 256*1024)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	go conn.Write(payload)
+	received := make([]byte, len(payload))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Second)))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	require.Equal(t, payload, received)
+}
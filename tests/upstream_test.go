@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zetxtech/wssocks/socks5"
+	"github.com/zetxtech/wssocks/wssocks"
+)
+
+func TestHTTPUpstreamProxy(t *testing.T) {
+	proxyAddr, tunnels, cleanup, err := startHTTPConnectProxy("user", "pass")
+	require.NoError(t, err)
+	defer cleanup()
+
+	proxyURL := fmt.Sprintf("http://user:pass@%s", proxyAddr)
+
+	// Wrong credentials are rejected by the proxy
+	dialer, err := wssocks.NewProxyChainDialer([]string{fmt.Sprintf("http://user:wrong@%s", proxyAddr)}, nil, false)
+	require.NoError(t, err)
+	_, err = dialer.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	require.ErrorContains(t, err, "407")
+
+	// HTTP CONNECT cannot carry UDP unless direct UDP is allowed
+	dialer, err = wssocks.NewProxyChainDialer([]string{proxyURL}, nil, false)
+	require.NoError(t, err)
+	_, err = dialer.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	require.ErrorIs(t, err, wssocks.ErrUDPNotSupported)
+
+	// Chain through the same proxy twice, with direct UDP allowed
+	dialer, err = wssocks.NewProxyChainDialer([]string{proxyURL, proxyURL}, nil, true)
+	require.NoError(t, err)
+
+	server := forwardServer(t, &ProxyTestServerOption{Dialer: dialer})
+	defer server.Close()
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  server.Token,
+	})
+	defer client.Close()
+
+	require.NoError(t, testWebConnection(globalHTTPServer, &ProxyConfig{Port: client.SocksPort}))
+	require.Equal(t, int32(2), tunnels.Load())
+
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+}
+
+// countingDialer counts the connections opened directly
+type countingDialer struct {
+	wssocks.DirectDialer
+	tcp atomic.Int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.tcp.Add(1)
+	return d.DirectDialer.DialContext(ctx, network, address)
+}
+
+func TestSocks5UpstreamUDP(t *testing.T) {
+	// A forward proxy serves as the upstream SOCKS5 proxy
+	upstream := forwardProxy(t)
+	defer upstream.Close()
+
+	direct := &countingDialer{}
+	dialer, err := wssocks.NewProxyChainDialer([]string{fmt.Sprintf("socks5://127.0.0.1:%d", upstream.SocksPort)}, direct, false)
+	require.NoError(t, err)
+
+	server := forwardServer(t, &ProxyTestServerOption{Dialer: dialer})
+	defer server.Close()
+	client := forwardClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  server.Token,
+	})
+	defer client.Close()
+
+	// Datagrams go through a UDP association of the upstream
+	assertUDPConnection(t, globalUDPServer, &ProxyConfig{Port: client.SocksPort})
+	require.Equal(t, int32(1), direct.tcp.Load())
+}
+
+func TestSocks5UpstreamResolve(t *testing.T) {
+	// The upstream SOCKS5 proxy sends every connection to the HTTP target
+	u, err := url.Parse(globalHTTPServer)
+	require.NoError(t, err)
+	server := forwardServer(t, &ProxyTestServerOption{Dialer: &redirectDialer{target: u.Host}})
+	defer server.Close()
+	upstream := forwardClient(t, &ProxyTestClientOption{
+		WSPort: server.WSPort,
+		Token:  server.Token,
+	})
+	defer upstream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// socks5h lets the proxy resolve domain names
+	dialer, err := wssocks.NewProxyDialer(fmt.Sprintf("socks5h://127.0.0.1:%d", upstream.SocksPort), nil)
+	require.NoError(t, err)
+	conn, err := dialer.DialContext(ctx, "tcp", "mocked.invalid:80")
+	require.NoError(t, err)
+	conn.Close()
+
+	// socks5 resolves them locally
+	dialer, err = wssocks.NewProxyDialer(fmt.Sprintf("socks5://127.0.0.1:%d", upstream.SocksPort), nil)
+	require.NoError(t, err)
+	_, err = dialer.DialContext(ctx, "tcp", "mocked.invalid:80")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+}
+
+// recordingSocks5Proxy is a SOCKS5 proxy answering UDP ASSOCIATE requests and reporting the
+// destination of each datagram sent to its UDP relay
+func recordingSocks5Proxy(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	destinations := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := socks5.Handshake(conn, nil); err != nil {
+					return
+				}
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				defer pc.Close()
+				if err := socks5.WriteReply(conn, socks5.RepSuccess, pc.LocalAddr()); err != nil {
+					return
+				}
+				go func() {
+					buf := make([]byte, 65535)
+					for {
+						n, _, err := pc.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						if host, port, _, err := socks5.ParseUDPDatagram(buf[:n]); err == nil {
+							destinations <- net.JoinHostPort(host, fmt.Sprint(port))
+						}
+					}
+				}()
+				// The association lasts as long as its control connection
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return listener.Addr().String(), destinations
+}
+
+// domainAddr is a UDP address with a domain name
+type domainAddr string
+
+func (a domainAddr) Network() string { return "udp" }
+func (a domainAddr) String() string  { return string(a) }
+
+func TestSocks5UpstreamUDPResolve(t *testing.T) {
+	for _, tc := range []struct {
+		scheme string
+		err    bool // Whether the datagram fails to resolve locally
+	}{
+		{scheme: "socks5h"},
+		{scheme: "socks5", err: true},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			proxy, destinations := recordingSocks5Proxy(t)
+			dialer, err := wssocks.NewProxyDialer(fmt.Sprintf("%s://%s", tc.scheme, proxy), nil)
+			require.NoError(t, err)
+
+			server := forwardServer(t, &ProxyTestServerOption{Dialer: dialer})
+			defer server.Close()
+			client := forwardClient(t, &ProxyTestClientOption{
+				WSPort: server.WSPort,
+				Token:  server.Token,
+			})
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			pc, err := client.Client.ListenPacket(ctx)
+			require.NoError(t, err)
+			defer pc.Close()
+
+			// Addresses are sent as they are
+			_, err = pc.WriteTo([]byte("ip"), &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53})
+			require.NoError(t, err)
+			select {
+			case destination := <-destinations:
+				require.Equal(t, "192.0.2.1:53", destination)
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "datagram not relayed")
+			}
+
+			// Domain names are left to proxies resolving them, and looked up locally otherwise
+			_, err = pc.WriteTo([]byte("domain"), domainAddr("mocked.invalid:53"))
+			require.NoError(t, err)
+			select {
+			case destination := <-destinations:
+				require.False(t, tc.err, "unexpected datagram to %s", destination)
+				require.Equal(t, "mocked.invalid:53", destination)
+			case <-time.After(time.Second):
+				require.True(t, tc.err, "datagram not relayed")
+			}
+		})
+	}
+}
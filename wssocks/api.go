@@ -1,22 +1,42 @@
 package wssocks
 
 import (
+	_ "embed"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// eventKeepAlive is the interval of comments sent on idle event streams to keep proxies from
+// closing them
+const eventKeepAlive = 15 * time.Second
+
+// openAPISpec describes the API endpoints, served at /api/openapi.json
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
 // APIHandler handles HTTP API requests for WSSocksServer
 type APIHandler struct {
 	server *WSSocksServer
-	apiKey string
+	keys   []APIKey
 }
 
-// NewAPIHandler creates a new API handler for the given server
+// NewAPIHandler creates a new API handler for the given server with a single admin key
 func NewAPIHandler(server *WSSocksServer, apiKey string) *APIHandler {
+	return NewAPIHandlerWithKeys(server, []APIKey{{Key: apiKey, Scopes: []APIScope{APIScopeAdmin}}})
+}
+
+// NewAPIHandlerWithKeys creates a new API handler for the given server with scoped keys
+func NewAPIHandlerWithKeys(server *WSSocksServer, keys []APIKey) *APIHandler {
 	return &APIHandler{
 		server: server,
-		apiKey: apiKey,
+		keys:   keys,
 	}
 }
 
@@ -25,6 +45,14 @@ func (h *APIHandler) RegisterHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/api/token", h.handleToken)
 	mux.HandleFunc("/api/token/", h.handleToken)
 	mux.HandleFunc("/api/status", h.handleStatus)
+	mux.HandleFunc("/api/clients", h.handleClients)
+	mux.HandleFunc("/api/clients/", h.handleClients)
+	mux.HandleFunc("/api/channels", h.handleChannels)
+	mux.HandleFunc("/api/channels/", h.handleChannels)
+	mux.HandleFunc("/api/bans", h.handleBans)
+	mux.HandleFunc("/api/bans/", h.handleBans)
+	mux.HandleFunc("/api/events", h.handleEvents)
+	mux.HandleFunc("/api/openapi.json", h.handleOpenAPI)
 }
 
 // TokenRequest represents a request to create a new token
@@ -36,6 +64,23 @@ type TokenRequest struct {
 	Password             string `json:"password"`      // Optional: SOCKS auth password
 	ReverseToken         string `json:"reverse_token"` // Optional: reverse token for connector token
 	AllowManageConnector bool   `json:"allow_manage_connector"`
+
+	ExpiresAt  time.Time `json:"expires_at"`  // Optional: time the token is removed at
+	MaxClients int       `json:"max_clients"` // Optional: connections using the token at the same time
+	MaxBytes   int64     `json:"max_bytes"`   // Optional: bytes transferred before the token is removed
+}
+
+// TokenUpdateRequest represents a request to change the options of a reverse token, fields
+// not provided are left unchanged
+type TokenUpdateRequest struct {
+	Port                 *int    `json:"port,omitempty"`
+	Username             *string `json:"username,omitempty"`
+	Password             *string `json:"password,omitempty"`
+	AllowManageConnector *bool   `json:"allow_manage_connector,omitempty"`
+
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	MaxClients *int       `json:"max_clients,omitempty"`
+	MaxBytes   *int64     `json:"max_bytes,omitempty"`
 }
 
 // TokenResponse represents the response for token operations
@@ -57,6 +102,11 @@ type TokenStatus struct {
 	Token        string `json:"token"`
 	Type         string `json:"type"` // "forward" or "reverse"
 	ClientsCount int    `json:"clients_count"`
+
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	MaxClients int        `json:"max_clients,omitempty"`
+	MaxBytes   int64      `json:"max_bytes,omitempty"`
+	BytesUsed  int64      `json:"bytes_used,omitempty"` // Only counted for tokens with limits
 }
 
 // ReverseTokenStatus represents the status of a reverse token
@@ -66,27 +116,133 @@ type ReverseTokenStatus struct {
 	ConnectorTokens []string `json:"connector_tokens,omitempty"` // List of associated connector tokens
 }
 
-// checkAPIKey verifies the API key in the request header
-func (h *APIHandler) checkAPIKey(w http.ResponseWriter, r *http.Request) bool {
-	providedKey := r.Header.Get("X-API-Key")
-	if providedKey != h.apiKey {
+// ConnectorStatus represents a connector token of a reverse token
+type ConnectorStatus struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"` // Provider that added the token, not set if added on the server
+	Clients   []string  `json:"clients"`              // Connectors connected with the token
+}
+
+// ConnectorsResponse represents the connector tokens of a reverse token
+type ConnectorsResponse struct {
+	Connectors []ConnectorStatus `json:"connectors"`
+}
+
+// ClientStatus represents a connected client
+type ClientStatus struct {
+	ID            string    `json:"id"`
+	Instance      string    `json:"instance,omitempty"` // Client instance, shared by its threads
+	IP            string    `json:"ip"`
+	Type          string    `json:"type"` // "forward", "reverse" or "connector"
+	Token         string    `json:"token"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Threads       int       `json:"threads"` // Connections of the same instance
+	RTTMillis     float64   `json:"rtt_ms"`  // Zero until measured, HTTP transports are not measured
+	Channels      int       `json:"channels"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	Version       byte      `json:"version"`
+	Compression   string    `json:"compression"`
+	ChannelIDs    []string  `json:"channel_ids,omitempty"` // Only returned for a single client
+}
+
+// ClientsResponse represents the list of connected clients
+type ClientsResponse struct {
+	Clients []ClientStatus `json:"clients"`
+}
+
+// ChannelStatus represents a channel relayed by the server
+type ChannelStatus struct {
+	ID           string    `json:"id"`
+	Protocol     string    `json:"protocol"` // "tcp" or "udp"
+	Address      string    `json:"address,omitempty"`
+	Port         int       `json:"port,omitempty"`
+	Token        string    `json:"token"`
+	Client       string    `json:"client,omitempty"`   // Client opening the channel, not set for SOCKS users of the server
+	Provider     string    `json:"provider,omitempty"` // Reverse client connecting to the target
+	StartedAt    time.Time `json:"started_at"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesUp      uint64    `json:"bytes_up"`   // Data sent toward the target
+	BytesDown    uint64    `json:"bytes_down"` // Data received from the target
+}
+
+// ChannelsResponse represents the list of active channels
+type ChannelsResponse struct {
+	Channels []ChannelStatus `json:"channels"`
+}
+
+// BanRequest represents a request to ban a client instance or IP
+type BanRequest struct {
+	Instance string `json:"instance"` // Instance ID to ban, or
+	IP       string `json:"ip"`       // IP to ban
+	Duration int    `json:"duration"` // Optional: seconds until the ban expires, forever if 0
+}
+
+// BanStatus represents a ban in effect
+type BanStatus struct {
+	Instance string     `json:"instance,omitempty"`
+	IP       string     `json:"ip,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // Not set for bans that never expire
+}
+
+// BansResponse represents the list of bans in effect
+type BansResponse struct {
+	Bans []BanStatus `json:"bans"`
+}
+
+// checkAPIKey verifies the API key in the request header grants scope for modifications, or the
+// status scope for reads, and returns it
+func (h *APIHandler) checkAPIKey(w http.ResponseWriter, r *http.Request, scope APIScope) *APIKey {
+	key := findAPIKey(h.keys, r.Header.Get("X-API-Key"))
+	if key == nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(TokenResponse{
 			Success: false,
 			Error:   "invalid API key",
 		})
-		return false
+		return nil
+	}
+	if r.Method == http.MethodGet {
+		scope = APIScopeStatus
 	}
-	return true
+	if !key.allows(scope) {
+		forbidden(w)
+		return nil
+	}
+	return key
+}
+
+// forbidden answers requests beyond the scopes or tokens of their API key
+func forbidden(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(TokenResponse{
+		Success: false,
+		Error:   "insufficient permissions",
+	})
 }
 
 func (h *APIHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if !h.checkAPIKey(w, r) {
+	key := h.checkAPIKey(w, r, APIScopeTokens)
+	if key == nil {
 		return
 	}
 
+	// Sub-resources of a token, only connectors exist
+	if path, ok := strings.CutPrefix(r.URL.Path, "/api/token/"); ok {
+		if reverseToken, rest, found := strings.Cut(path, "/"); found {
+			connectorToken, ok := strings.CutPrefix(rest, "connectors")
+			if ok && (connectorToken == "" || strings.HasPrefix(connectorToken, "/")) {
+				h.handleConnectors(w, r, key, reverseToken, strings.TrimPrefix(connectorToken, "/"))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
 	switch r.Method {
 	case http.MethodDelete:
 		token := strings.TrimPrefix(r.URL.Path, "/api/token/")
@@ -101,13 +257,85 @@ func (h *APIHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 			}
 			token = req.Token
 		}
+		if !key.allowsToken(token) {
+			forbidden(w)
+			return
+		}
 
-		success := h.server.RemoveToken(token)
+		if !h.server.RemoveToken(token) {
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Token:   token,
+				Error:   "token not found",
+			})
+			return
+		}
 		json.NewEncoder(w).Encode(TokenResponse{
-			Success: success,
+			Success: true,
 			Token:   token,
 		})
 
+	case http.MethodPatch:
+		token := strings.TrimPrefix(r.URL.Path, "/api/token/")
+		var req TokenUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || token == "" || r.URL.Path == "/api/token" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "invalid request body",
+			})
+			return
+		}
+		if !key.allowsToken(token) {
+			forbidden(w)
+			return
+		}
+
+		opts, exists := h.server.ReverseTokenOptions(token)
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "reverse token not found",
+			})
+			return
+		}
+		if req.Port != nil {
+			opts.Port = *req.Port
+		}
+		if req.Username != nil {
+			opts.Username = *req.Username
+		}
+		if req.Password != nil {
+			opts.Password = *req.Password
+		}
+		if req.AllowManageConnector != nil {
+			opts.AllowManageConnector = *req.AllowManageConnector
+		}
+		if req.ExpiresAt != nil {
+			opts.ExpiresAt = *req.ExpiresAt
+		}
+		if req.MaxClients != nil {
+			opts.MaxClients = *req.MaxClients
+		}
+		if req.MaxBytes != nil {
+			opts.MaxBytes = *req.MaxBytes
+		}
+
+		port, err := h.server.UpdateReverseToken(token, opts)
+		if err != nil {
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{
+			Success: true,
+			Token:   token,
+			Port:    port,
+		})
+
 	case http.MethodPost:
 		var req TokenRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -119,9 +347,24 @@ func (h *APIHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Keys bound to tokens only add the tokens they are bound to
+		if !key.allowsToken(req.Token) || (req.Type == "connector" && !key.allowsToken(req.ReverseToken)) {
+			forbidden(w)
+			return
+		}
+
+		limits := TokenLimits{
+			ExpiresAt:  req.ExpiresAt,
+			MaxClients: req.MaxClients,
+			MaxBytes:   req.MaxBytes,
+		}
+
 		switch req.Type {
 		case "forward":
-			token, err := h.server.AddForwardToken(req.Token)
+			token, err := h.server.AddForwardTokenWithOptions(&ForwardTokenOptions{
+				Token:       req.Token,
+				TokenLimits: limits,
+			})
 			if err != nil {
 				json.NewEncoder(w).Encode(TokenResponse{
 					Success: false,
@@ -141,6 +384,7 @@ func (h *APIHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 				Username:             req.Username,
 				Password:             req.Password,
 				AllowManageConnector: req.AllowManageConnector,
+				TokenLimits:          limits,
 			}
 			token, port, err := h.server.AddReverseToken(opts)
 			if err != nil {
@@ -191,8 +435,67 @@ func (h *APIHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleConnectors lists or removes the connector tokens of a reverse token, or removes a single
+// one if connectorToken is set
+func (h *APIHandler) handleConnectors(w http.ResponseWriter, r *http.Request, key *APIKey, reverseToken, connectorToken string) {
+	if !key.allowsToken(reverseToken) {
+		forbidden(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Single connector tokens can only be removed
+		if connectorToken != "" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		connectors, exists := h.server.Connectors(reverseToken)
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "reverse token not found",
+			})
+			return
+		}
+		statuses := make([]ConnectorStatus, 0, len(connectors))
+		for _, connector := range connectors {
+			status := ConnectorStatus{
+				Token:     connector.Token,
+				CreatedAt: connector.CreatedAt,
+				Clients:   make([]string, 0, len(connector.Clients)),
+			}
+			if connector.CreatedBy != uuid.Nil {
+				status.CreatedBy = connector.CreatedBy.String()
+			}
+			for _, clientID := range connector.Clients {
+				status.Clients = append(status.Clients, clientID.String())
+			}
+			statuses = append(statuses, status)
+		}
+		json.NewEncoder(w).Encode(ConnectorsResponse{Connectors: statuses})
+
+	case http.MethodDelete:
+		removed := h.server.RemoveConnectors(reverseToken, connectorToken)
+		if connectorToken != "" && len(removed) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "connector token not found",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{Success: true})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *APIHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
-	if !h.checkAPIKey(w, r) {
+	key := h.checkAPIKey(w, r, APIScopeStatus)
+	if key == nil {
 		return
 	}
 
@@ -209,17 +512,23 @@ func (h *APIHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
 	// Create map of reverse tokens to their connector tokens
 	reverseToConnectors := make(map[string][]string)
 	for connectorToken, reverseToken := range h.server.connectorTokens {
+		if !key.allowsToken(connectorToken) {
+			continue
+		}
 		reverseToConnectors[reverseToken] = append(reverseToConnectors[reverseToken], connectorToken)
 	}
 
 	// Add reverse tokens with their connector tokens
 	for token, port := range h.server.tokens {
+		if !key.allowsToken(token) {
+			continue
+		}
 		tokens = append(tokens, ReverseTokenStatus{
-			TokenStatus: TokenStatus{
+			TokenStatus: h.withLimits(TokenStatus{
 				Token:        token,
 				Type:         "reverse",
 				ClientsCount: h.server.GetTokenClientCount(token),
-			},
+			}),
 			Port:            port,
 			ConnectorTokens: reverseToConnectors[token],
 		})
@@ -227,11 +536,14 @@ func (h *APIHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	// Add forward tokens
 	for token := range h.server.forwardTokens {
-		tokens = append(tokens, TokenStatus{
+		if !key.allowsToken(token) {
+			continue
+		}
+		tokens = append(tokens, h.withLimits(TokenStatus{
 			Token:        token,
 			Type:         "forward",
 			ClientsCount: h.server.GetTokenClientCount(token),
-		})
+		}))
 	}
 	h.server.mu.RUnlock()
 
@@ -240,3 +552,349 @@ func (h *APIHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
 		Tokens:  tokens,
 	})
 }
+
+// withLimits adds the limits and usage of a token to its status, must be called with the server
+// lock held
+func (h *APIHandler) withLimits(status TokenStatus) TokenStatus {
+	limits, exists := h.server.tokenLimits[status.Token]
+	if !exists {
+		return status
+	}
+	if !limits.ExpiresAt.IsZero() {
+		expiresAt := limits.ExpiresAt
+		status.ExpiresAt = &expiresAt
+	}
+	status.MaxClients = limits.MaxClients
+	status.MaxBytes = limits.MaxBytes
+	_, status.BytesUsed = h.server.tokenUsage(status.Token)
+	return status
+}
+
+func (h *APIHandler) handleClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key := h.checkAPIKey(w, r, APIScopeClients)
+	if key == nil {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/clients/")
+	if id == "" || r.URL.Path == "/api/clients" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewEncoder(w).Encode(ClientsResponse{Clients: h.clientStatuses(key, uuid.Nil)})
+		return
+	}
+
+	clientID, err := uuid.Parse(id)
+	var clients []ClientStatus
+	if err == nil {
+		clients = h.clientStatuses(key, clientID)
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		// Kick the client along with the other threads of its instance
+		if len(clients) > 0 && h.server.KickClient(clientID) > 0 {
+			json.NewEncoder(w).Encode(TokenResponse{Success: true})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(clients) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(TokenResponse{
+			Success: false,
+			Error:   "client not found",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(clients[0])
+}
+
+// clientStatuses returns the status of the connected clients visible to key, or with the channels
+// of a single one if clientID is set
+func (h *APIHandler) clientStatuses(key *APIKey, clientID uuid.UUID) []ClientStatus {
+	h.server.mu.RLock()
+	defer h.server.mu.RUnlock()
+
+	threads := make(map[uuid.UUID]int)
+	for _, clients := range h.server.tokenClients {
+		for _, client := range clients {
+			if client.Instance != uuid.Nil {
+				threads[client.Instance]++
+			}
+		}
+	}
+
+	statuses := make([]ClientStatus, 0)
+	for _, clients := range h.server.tokenClients {
+		for _, client := range clients {
+			if (clientID != uuid.Nil && client.ID != clientID) || !key.allowsToken(client.Token) {
+				continue
+			}
+
+			ws := client.Conn
+			status := ClientStatus{
+				ID:            client.ID.String(),
+				IP:            ws.GetClientIP(),
+				Type:          client.Type,
+				Token:         client.Token,
+				ConnectedAt:   ws.ConnectedAt(),
+				Threads:       1,
+				RTTMillis:     float64(ws.RTT().Microseconds()) / 1000,
+				Channels:      ws.ActiveChannels(),
+				BytesSent:     ws.BytesSent(),
+				BytesReceived: ws.BytesReceived(),
+				Version:       ws.Version(),
+				Compression:   CompressionName(ws.Compression()),
+			}
+			if client.Instance != uuid.Nil {
+				status.Instance = client.Instance.String()
+				status.Threads = threads[client.Instance]
+			}
+			if clientID != uuid.Nil {
+				for _, channelID := range ws.ChannelIDs() {
+					status.ChannelIDs = append(status.ChannelIDs, channelID.String())
+				}
+			}
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ConnectedAt.Before(statuses[j].ConnectedAt)
+	})
+	return statuses
+}
+
+func (h *APIHandler) handleChannels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key := h.checkAPIKey(w, r, APIScopeClients)
+	if key == nil {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/channels/")
+	if id == "" || r.URL.Path == "/api/channels" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		channels := make([]ChannelStatus, 0)
+		for _, channel := range h.server.Channels() {
+			if !key.allowsToken(channel.Token) {
+				continue
+			}
+			status := ChannelStatus{
+				ID:           channel.ID.String(),
+				Protocol:     channel.Protocol,
+				Address:      channel.Address,
+				Port:         channel.Port,
+				Token:        channel.Token,
+				StartedAt:    channel.StartedAt,
+				LastActivity: channel.LastActivity,
+				BytesUp:      channel.BytesUp,
+				BytesDown:    channel.BytesDown,
+			}
+			if channel.Client != uuid.Nil {
+				status.Client = channel.Client.String()
+			}
+			if channel.Provider != uuid.Nil {
+				status.Provider = channel.Provider.String()
+			}
+			channels = append(channels, status)
+		}
+		json.NewEncoder(w).Encode(ChannelsResponse{Channels: channels})
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	channelID, err := uuid.Parse(id)
+	if err != nil || !h.channelVisible(key, channelID) || !h.server.CloseChannel(channelID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(TokenResponse{
+			Success: false,
+			Error:   "channel not found",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(TokenResponse{Success: true})
+}
+
+// channelVisible reports whether a channel is open and relays a token visible to key
+func (h *APIHandler) channelVisible(key *APIKey, channelID uuid.UUID) bool {
+	for _, channel := range h.server.Channels() {
+		if channel.ID == channelID {
+			return key.allowsToken(channel.Token)
+		}
+	}
+	return false
+}
+
+func (h *APIHandler) handleBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key := h.checkAPIKey(w, r, APIScopeClients)
+	if key == nil {
+		return
+	}
+	// Bans apply to all tokens, keys bound to tokens can only read them
+	if r.Method != http.MethodGet && len(key.Tokens) > 0 {
+		forbidden(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bans := make([]BanStatus, 0)
+		for _, ban := range h.server.Bans() {
+			status := BanStatus{IP: ban.IP}
+			if ban.Instance != uuid.Nil {
+				status.Instance = ban.Instance.String()
+			}
+			if !ban.Expires.IsZero() {
+				expires := ban.Expires
+				status.Expires = &expires
+			}
+			bans = append(bans, status)
+		}
+		json.NewEncoder(w).Encode(BansResponse{Bans: bans})
+
+	case http.MethodPost:
+		var req BanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Instance == "") == (req.IP == "") || req.Duration < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "either instance or ip is required",
+			})
+			return
+		}
+
+		duration := time.Duration(req.Duration) * time.Second
+		if req.Instance != "" {
+			instance, err := uuid.Parse(req.Instance)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(TokenResponse{
+					Success: false,
+					Error:   "invalid instance",
+				})
+				return
+			}
+			h.server.BanInstance(instance, duration)
+		} else {
+			h.server.BanIP(req.IP, duration)
+		}
+		json.NewEncoder(w).Encode(TokenResponse{Success: true})
+
+	case http.MethodDelete:
+		key := strings.TrimPrefix(r.URL.Path, "/api/bans/")
+		if key == "" || r.URL.Path == "/api/bans" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TokenResponse{
+				Success: false,
+				Error:   "ban not specified",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{Success: h.server.Unban(key)})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEvents streams the server events visible to the API key as server-sent events, filtered
+// by the token and type query parameters if given
+func (h *APIHandler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	key := h.checkAPIKey(w, r, APIScopeStatus)
+	if key == nil {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	tokens, types := query["token"], query["type"]
+	matches := func(event Event) bool {
+		if !key.allowsToken(event.Token) {
+			return false
+		}
+		if len(tokens) > 0 && !containsString(tokens, event.Token) {
+			return false
+		}
+		return len(types) == 0 || containsString(types, event.Type)
+	}
+
+	events, unsubscribe := h.server.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			if !matches(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the API
+func (h *APIHandler) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if h.checkAPIKey(w, r, APIScopeStatus) == nil {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package wssocks
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// APIScope grants access to a group of API operations
+type APIScope string
+
+const (
+	APIScopeStatus  APIScope = "status"  // Read the status, tokens, clients, channels and bans
+	APIScopeTokens  APIScope = "tokens"  // Add, update and remove tokens
+	APIScopeClients APIScope = "clients" // Kick clients, close channels and manage bans
+	APIScopeAdmin   APIScope = "admin"   // All operations
+)
+
+// APIKey grants access to the API with a set of scopes, optionally bound to some tokens
+type APIKey struct {
+	Key    string
+	Scopes []APIScope
+	Tokens []string // Tokens the key can see and manage, all if empty
+}
+
+// allows reports whether the key grants a scope
+func (k *APIKey) allows(scope APIScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == APIScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsToken reports whether the key can see and manage a token
+func (k *APIKey) allowsToken(token string) bool {
+	return len(k.Tokens) == 0 || containsString(k.Tokens, token)
+}
+
+// ParseAPIKey parses an API key given as key[:scopes[:tokens]], with comma-separated scopes and
+// tokens. Keys without scopes are admin keys.
+func ParseAPIKey(spec string) (APIKey, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	key := APIKey{Key: parts[0], Scopes: []APIScope{APIScopeAdmin}}
+	if key.Key == "" {
+		return APIKey{}, fmt.Errorf("empty API key")
+	}
+	if len(parts) > 1 {
+		key.Scopes = nil
+		for _, scope := range strings.Split(parts[1], ",") {
+			switch APIScope(scope) {
+			case APIScopeStatus, APIScopeTokens, APIScopeClients, APIScopeAdmin:
+				key.Scopes = append(key.Scopes, APIScope(scope))
+			default:
+				return APIKey{}, fmt.Errorf("unknown API scope: %s", scope)
+			}
+		}
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		key.Tokens = strings.Split(parts[2], ",")
+	}
+	return key, nil
+}
+
+// apiKeys returns the keys enabling the API, the APIKey option being an admin key
+func apiKeys(opt *ServerOption) []APIKey {
+	var keys []APIKey
+	if opt.APIKey != "" {
+		keys = append(keys, APIKey{Key: opt.APIKey, Scopes: []APIScope{APIScopeAdmin}})
+	}
+	return append(keys, opt.APIKeys...)
+}
+
+// findAPIKey returns the key matching provided, comparing all keys in constant time
+func findAPIKey(keys []APIKey, provided string) *APIKey {
+	providedHash := sha256.Sum256([]byte(provided))
+	var found *APIKey
+	for i := range keys {
+		keyHash := sha256.Sum256([]byte(keys[i].Key))
+		if subtle.ConstantTimeCompare(providedHash[:], keyHash[:]) == 1 && found == nil {
+			found = &keys[i]
+		}
+	}
+	return found
+}
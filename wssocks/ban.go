@@ -0,0 +1,161 @@
+package wssocks
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ban refuses the clients of an instance or from an IP until it expires
+type Ban struct {
+	Instance uuid.UUID // Banned client instance, nil when banning an IP
+	IP       string    // Banned client IP, empty when banning an instance
+	Expires  time.Time // Zero for bans that never expire
+}
+
+// key returns the key of the ban in the ban list
+func (b Ban) key() string {
+	if b.Instance != uuid.Nil {
+		return b.Instance.String()
+	}
+	return b.IP
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+func (b Ban) matches(instance uuid.UUID, ip string) bool {
+	if b.Instance != uuid.Nil {
+		return b.Instance == instance
+	}
+	return b.IP == ip
+}
+
+// BanInstance refuses the clients of an instance for duration, forever if zero, and disconnects
+// the connected ones
+func (s *WSSocksServer) BanInstance(instance uuid.UUID, duration time.Duration) {
+	s.addBan(Ban{Instance: instance}, duration)
+}
+
+// BanIP refuses the clients from an IP for duration, forever if zero, and disconnects the
+// connected ones
+func (s *WSSocksServer) BanIP(ip string, duration time.Duration) {
+	s.addBan(Ban{IP: ip}, duration)
+}
+
+func (s *WSSocksServer) addBan(ban Ban, duration time.Duration) {
+	if duration > 0 {
+		ban.Expires = time.Now().Add(duration)
+	}
+
+	s.banMu.Lock()
+	s.bans[ban.key()] = ban
+	s.banMu.Unlock()
+
+	s.log.Info().Str("ban", ban.key()).Time("expires", ban.Expires).Msg("Client banned")
+
+	// Disconnect the banned clients already connected
+	s.mu.RLock()
+	var conns []*WSConn
+	for _, clients := range s.tokenClients {
+		for _, client := range clients {
+			if ban.matches(client.Instance, client.Conn.GetClientIP()) {
+				conns = append(conns, client.Conn)
+			}
+		}
+	}
+	s.mu.RUnlock()
+	for _, ws := range conns {
+		ws.Close()
+	}
+}
+
+// Unban removes a ban by instance ID or IP, returning whether it existed
+func (s *WSSocksServer) Unban(key string) bool {
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+
+	ban, exists := s.bans[key]
+	delete(s.bans, key)
+	return exists && !ban.expired(time.Now())
+}
+
+// Bans returns the bans in effect, dropping the expired ones
+func (s *WSSocksServer) Bans() []Ban {
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(s.bans))
+	for key, ban := range s.bans {
+		if ban.expired(now) {
+			delete(s.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].key() < bans[j].key()
+	})
+	return bans
+}
+
+// isBanned reports whether a client of an instance connecting from an IP is banned
+func (s *WSSocksServer) isBanned(instance uuid.UUID, ip string) bool {
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+
+	keys := []string{ip}
+	if instance != uuid.Nil {
+		keys = append(keys, instance.String())
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		ban, exists := s.bans[key]
+		if !exists {
+			continue
+		}
+		if ban.expired(now) {
+			delete(s.bans, key)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// KickClient disconnects a client along with the other threads of its instance, returning the
+// number of connections closed
+func (s *WSSocksServer) KickClient(clientID uuid.UUID) int {
+	s.mu.RLock()
+	var target *clientInfo
+	for _, clients := range s.tokenClients {
+		for i := range clients {
+			if clients[i].ID == clientID {
+				target = &clients[i]
+			}
+		}
+	}
+	var conns []*WSConn
+	if target != nil {
+		for _, clients := range s.tokenClients {
+			for _, client := range clients {
+				if client.ID == clientID || (target.Instance != uuid.Nil && client.Instance == target.Instance) {
+					conns = append(conns, client.Conn)
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, ws := range conns {
+		ws.Close()
+	}
+	if len(conns) > 0 {
+		s.log.Info().Str("client_id", clientID.String()).Int("connections", len(conns)).Msg("Client kicked")
+	}
+	return len(conns)
+}
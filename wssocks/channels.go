@@ -0,0 +1,111 @@
+package wssocks
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Channel describes a channel relayed by the server
+type Channel struct {
+	ID           uuid.UUID
+	Protocol     string
+	Address      string    // Target address, the last one used for UDP
+	Port         int       // Target port
+	Token        string    // Token of the client opening the channel, the reverse token for SOCKS users of the server
+	Client       uuid.UUID // Client opening the channel, nil for SOCKS users of the server
+	Provider     uuid.UUID // Reverse client connecting to the target, nil if the server connects
+	StartedAt    time.Time
+	LastActivity time.Time
+	BytesUp      uint64 // Data sent toward the target
+	BytesDown    uint64 // Data received from the target
+}
+
+// Channels returns the channels open on the connections of the clients, oldest first
+func (s *WSSocksServer) Channels() []Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	channels := make(map[uuid.UUID]*Channel)
+	for _, clients := range s.tokenClients {
+		for _, client := range clients {
+			for _, c := range client.Conn.Channels() {
+				channel, exists := channels[c.ID]
+				if !exists {
+					channel = &Channel{ID: c.ID}
+					channels[c.ID] = channel
+				}
+
+				// The connector and provider of a channel both carry it, prefer the opening side
+				opener := !c.Outbound && client.Type != "reverse"
+				if opener || !exists {
+					channel.Protocol = c.Protocol
+					channel.StartedAt = c.StartedAt
+					channel.BytesUp = c.BytesUp
+					channel.BytesDown = c.BytesDown
+				}
+				if c.Address != "" {
+					channel.Address, channel.Port = c.Address, c.Port
+				}
+				if c.LastActivity.After(channel.LastActivity) {
+					channel.LastActivity = c.LastActivity
+				}
+				if opener {
+					channel.Client = client.ID
+					channel.Token = client.Token
+				} else {
+					channel.Provider = client.ID
+					if channel.Token == "" {
+						channel.Token = client.Token
+					}
+				}
+			}
+		}
+	}
+
+	result := make([]Channel, 0, len(channels))
+	for _, channel := range channels {
+		result = append(result, *channel)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+// CloseChannel closes a channel on the server and sends a disconnect to the clients carrying it,
+// returning whether it was open
+func (s *WSSocksServer) CloseChannel(channelID uuid.UUID) bool {
+	s.mu.RLock()
+	var conns []*WSConn
+	for _, clients := range s.tokenClients {
+		for _, client := range clients {
+			if _, ok := client.Conn.channels.Load(channelID); ok {
+				conns = append(conns, client.Conn)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(conns) == 0 {
+		return false
+	}
+
+	msg := DisconnectMessage{ChannelID: channelID}
+	for _, ws := range conns {
+		s.relay.logMessage(msg, "send", ws.Label())
+		if err := ws.WriteMessage(msg); err != nil {
+			s.log.Debug().Err(err).Msg("Failed to send disconnect message")
+		}
+	}
+
+	s.connCache.mu.Lock()
+	delete(s.connCache.channelIDToClient, channelID)
+	delete(s.connCache.channelIDToConnector, channelID)
+	s.connCache.mu.Unlock()
+	s.relay.disconnectChannel(channelID)
+
+	s.log.Info().Str("channel_id", channelID.String()).Msg("Channel closed")
+	return true
+}
@@ -3,6 +3,7 @@ package wssocks
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -49,8 +50,18 @@ type WSSocksClient struct {
 	socksWaitServer bool
 	socksReady      chan struct{}
 	noEnvProxy      bool
+	httpClient      *http.Client // Client for the HTTP transports
+	tlsConfig       *tls.Config  // TLS config for the TCP and QUIC transports
+	e2eKeys         *e2eKeys     // Shared by the connections to refuse channels replayed on any of them
 	numPartners     int
 
+	fallbackTransport string // HTTP transport used since the WebSocket upgrade was refused
+
+	transparentHost     string
+	transparentPort     int
+	transparentListener net.Listener
+	transparentUDP      *net.UDPConn
+
 	websockets     []*WSConn // Multiple WebSocket connections
 	currentIndex   int       // Current WebSocket index for round-robin
 	socksListener  net.Listener
@@ -68,25 +79,32 @@ type WSSocksClient struct {
 
 // ClientOption represents configuration options for WSSocksClient
 type ClientOption struct {
-	WSURL            string
-	Reverse          bool
-	SocksHost        string
-	SocksPort        int
-	SocksUsername    string
-	SocksPassword    string
-	SocksWaitServer  bool
-	Reconnect        bool
-	ReconnectDelay   time.Duration
-	Logger           zerolog.Logger
-	BufferSize       int
-	ChannelTimeout   time.Duration
-	ConnectTimeout   time.Duration
-	Threads          int
-	StrictConnect    bool
-	UpstreamProxy    string
-	UpstreamUsername string
-	UpstreamPassword string
-	NoEnvProxy       bool // Ignore environment proxy settings
+	WSURL               string
+	Reverse             bool
+	SocksHost           string
+	SocksPort           int
+	SocksUsername       string
+	SocksPassword       string
+	SocksWaitServer     bool
+	Reconnect           bool
+	ReconnectDelay      time.Duration
+	Logger              zerolog.Logger
+	BufferSize          int
+	ChannelTimeout      time.Duration
+	ConnectTimeout      time.Duration
+	Threads             int
+	StrictConnect       bool
+	UpstreamProxy       string
+	UpstreamUsername    string
+	UpstreamPassword    string
+	Dialer              Dialer      // Dialer for outbound connections, nil to dial directly
+	Compressions        []byte      // Accepted compressions in preference order, nil for all registered ones
+	AdaptiveCompression bool        // Decide compression by sampling the data instead of by size
+	E2ESecret           string      // Secret shared by connector and provider to encrypt their channels end-to-end
+	NoEnvProxy          bool        // Ignore environment proxy settings
+	TLSConfig           *tls.Config // TLS settings for tcp+tls:// and quic:// servers, verified with the system roots if nil
+	TransparentHost     string
+	TransparentPort     int // Transparent proxy listen port, disabled if 0 (Linux only)
 }
 
 // DefaultClientOption returns default client options
@@ -109,6 +127,8 @@ func DefaultClientOption() *ClientOption {
 		UpstreamUsername: "",
 		UpstreamPassword: "",
 		NoEnvProxy:       false,
+		TransparentHost:  "0.0.0.0",
+		TransparentPort:  0,
 	}
 }
 
@@ -215,12 +235,56 @@ func (o *ClientOption) WithUpstreamAuth(username, password string) *ClientOption
 	return o
 }
 
+// WithDialer sets the dialer used for outbound TCP and UDP traffic
+func (o *ClientOption) WithDialer(dialer Dialer) *ClientOption {
+	o.Dialer = dialer
+	return o
+}
+
+// WithCompressions sets the accepted compressions in preference order, an empty list disables compression
+func (o *ClientOption) WithCompressions(compressions []byte) *ClientOption {
+	o.Compressions = compressions
+	return o
+}
+
+// WithAdaptiveCompression controls whether compression is decided by sampling the data
+func (o *ClientOption) WithAdaptiveCompression(adaptive bool) *ClientOption {
+	o.AdaptiveCompression = adaptive
+	return o
+}
+
+// WithE2ESecret sets the secret shared by connectors and providers for end-to-end encryption.
+// A connector with a secret only opens encrypted channels, a provider with a secret accepts
+// them besides the plain channels requested by the server.
+func (o *ClientOption) WithE2ESecret(secret string) *ClientOption {
+	o.E2ESecret = secret
+	return o
+}
+
+// WithTLSConfig sets the TLS config used to connect to tcp+tls:// and quic:// servers
+func (o *ClientOption) WithTLSConfig(config *tls.Config) *ClientOption {
+	o.TLSConfig = config
+	return o
+}
+
 // WithNoEnvProxy sets whether to ignore environment proxy settings
 func (o *ClientOption) WithNoEnvProxy(noEnvProxy bool) *ClientOption {
 	o.NoEnvProxy = noEnvProxy
 	return o
 }
 
+// WithTransparentHost sets the transparent proxy listen address
+func (o *ClientOption) WithTransparentHost(host string) *ClientOption {
+	o.TransparentHost = host
+	return o
+}
+
+// WithTransparentPort sets the transparent proxy listen port, 0 disables it
+func (o *ClientOption) WithTransparentPort(port int) *ClientOption {
+	o.TransparentPort = port
+	return o
+}
+
 // NewWSSocksClient creates a new WSSocksClient instance
 func NewWSSocksClient(token string, opt *ClientOption) *WSSocksClient {
 	if opt == nil {
@@ -239,7 +303,10 @@ func NewWSSocksClient(token string, opt *ClientOption) *WSSocksClient {
 		WithConnectTimeout(opt.ConnectTimeout).
 		WithStrictConnect(opt.StrictConnect).
 		WithUpstreamProxy(opt.UpstreamProxy).
-		WithUpstreamAuth(opt.UpstreamUsername, opt.UpstreamPassword)
+		WithUpstreamAuth(opt.UpstreamUsername, opt.UpstreamPassword).
+		WithDialer(opt.Dialer).
+		WithCompressions(opt.Compressions).
+		WithAdaptiveCompression(opt.AdaptiveCompression)
 
 	client := &WSSocksClient{
 		instanceID:      uuid.New(),
@@ -253,6 +320,7 @@ func NewWSSocksClient(token string, opt *ClientOption) *WSSocksClient {
 		socksUsername:   opt.SocksUsername,
 		socksPassword:   opt.SocksPassword,
 		socksWaitServer: opt.SocksWaitServer,
+		e2eKeys:         newE2EKeys(opt.E2ESecret),
 		reconnect:       opt.Reconnect,
 		reconnectDelay:  opt.ReconnectDelay,
 		errors:          make(chan error, 1),
@@ -263,6 +331,10 @@ func NewWSSocksClient(token string, opt *ClientOption) *WSSocksClient {
 		threads:         opt.Threads,
 		websockets:      make([]*WSConn, 0, opt.Threads),
 		noEnvProxy:      opt.NoEnvProxy,
+		httpClient:      newTransportHTTPClient(opt.NoEnvProxy),
+		tlsConfig:       opt.TLSConfig,
+		transparentHost: opt.TransparentHost,
+		transparentPort: opt.TransparentPort,
 	}
 
 	return client
@@ -284,6 +356,9 @@ func convertWSPath(wsURL string) string {
 		u.Scheme = "ws"
 	case "https":
 		u.Scheme = "wss"
+	case "tcp+tls", "quic":
+		// The TCP and QUIC transports have no path, clients authenticate with a message
+		return u.String()
 	}
 
 	// Set path to /socket only if it's root path
@@ -385,6 +460,18 @@ func (c *WSSocksClient) getNextWebSocket() *WSConn {
 	return nil
 }
 
+// waitWebSocket waits up to timeout for an available WebSocket connection
+func (c *WSSocksClient) waitWebSocket(timeout time.Duration) *WSConn {
+	startTime := time.Now()
+	for time.Since(startTime) < timeout {
+		if ws := c.getNextWebSocket(); ws != nil {
+			return ws
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
 // startForward connects to WebSocket server in forward proxy mode
 func (c *WSSocksClient) startForward(ctx context.Context) error {
 	// Initialize socksReady channel
@@ -401,6 +488,15 @@ func (c *WSSocksClient) startForward(ctx context.Context) error {
 		}()
 	}
 
+	if c.transparentPort != 0 {
+		// Start transparent proxy listeners
+		go func() {
+			if err := c.runTransparentServer(ctx); err != nil {
+				c.errors <- fmt.Errorf("transparent proxy error: %w", err)
+			}
+		}()
+	}
+
 	var wg sync.WaitGroup
 	errChan := make(chan error, c.threads)
 
@@ -481,16 +577,6 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 		}
 	}
 
-	dialer := websocket.DefaultDialer
-	if c.noEnvProxy {
-		dialer = &websocket.Dialer{
-			Proxy:            nil, // Explicitly disable proxy
-			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
-			ReadBufferSize:   websocket.DefaultDialer.ReadBufferSize,
-			WriteBufferSize:  websocket.DefaultDialer.WriteBufferSize,
-		}
-	}
-
 	// Parse URL to check path
 	wsURLWithParams := c.wsURL
 	u, err := url.Parse(wsURLWithParams)
@@ -505,91 +591,18 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 		q.Set("token", hashStr)
 		q.Set("reverse", strconv.FormatBool(c.reverse))
 		q.Set("instance", c.instanceID.String())
+		q.Set("compression", formatCompressionList(c.relay.acceptedCompressions()))
+		q.Set("version", fmt.Sprintf("%d-%d", MinProtocolVersion, ProtocolVersion))
+		q.Set("capabilities", strconv.FormatUint(uint64(LocalCapabilities), 10))
 		u.RawQuery = q.Encode()
 		wsURLWithParams = u.String()
 	}
 
-	// Handle WebSocket connection with redirect support
-	var ws *websocket.Conn
-	var resp *http.Response
-	currentURL := wsURLWithParams
-	redirectsLeft := 5 // Maximum number of redirects to follow
-
-	for redirectsLeft >= 0 {
-		ws, resp, err = dialer.Dial(currentURL, nil)
-		if err == nil {
-			// Successfully connected
-			break
-		}
-
-		// Check if this is a redirect
-		if err == websocket.ErrBadHandshake && resp != nil && (resp.StatusCode >= 301 && resp.StatusCode <= 308) {
-			redirect := resp.Header.Get("Location")
-			if redirect == "" {
-				// No redirect URL provided
-				c.log.Warn().Int("status", resp.StatusCode).Msg("Received redirect status but no Location header")
-				return errors.New("redirect response missing Location header")
-			}
-
-			// Track number of redirects
-			redirectsLeft--
-			if redirectsLeft < 0 {
-				c.log.Warn().Msg("Too many redirects, giving up after 5 redirects")
-				return errors.New("too many redirects (maximum 5)")
-			}
-
-			// Log the redirect
-			c.log.Debug().
-				Str("from", currentURL).
-				Str("to", redirect).
-				Int("status", resp.StatusCode).
-				Int("redirects_left", redirectsLeft).
-				Msg("Following WebSocket redirect")
-
-			// Parse the redirect URL
-			redirectURL, parseErr := url.Parse(redirect)
-			if parseErr != nil {
-				c.log.Warn().Err(parseErr).Msg("Failed to parse redirect URL")
-				return parseErr
-			}
-
-			// Handle relative URLs
-			if !redirectURL.IsAbs() {
-				originalURL, _ := url.Parse(currentURL)
-				redirectURL = originalURL.ResolveReference(redirectURL)
-			}
-
-			// Ensure proper scheme (ws/wss)
-			if redirectURL.Scheme == "http" {
-				redirectURL.Scheme = "ws"
-			} else if redirectURL.Scheme == "https" {
-				redirectURL.Scheme = "wss"
-			}
-
-			// Update URL for next attempt
-			currentURL = redirectURL.String()
-			continue
-		}
-
-		// Not a redirect or another error occurred
-		if err == websocket.ErrBadHandshake {
-			statusMsg := "unknown"
-			if resp != nil {
-				statusMsg = resp.Status
-			}
-			c.batchLogger.log("handshake_error", c.threads, func(count, total int) {
-				c.log.Warn().Err(err).Str("status", statusMsg).Msgf("WebSocket handshake failed (%d/%d)", count, total)
-			})
-		} else {
-			c.batchLogger.log("dial_error", c.threads, func(count, total int) {
-				c.log.Warn().Err(err).Msgf("Failed to dial WebSocket (%d/%d)", count, total)
-			})
-		}
+	wsConn, err := c.dialTransport(ctx, wsURLWithParams, strconv.Itoa(index))
+	if err != nil {
 		return err
 	}
 
-	wsConn := NewWSConn(ws, strconv.Itoa(index), c.log)
-
 	c.mu.Lock()
 	if len(c.websockets) <= index {
 		c.websockets = append(c.websockets, wsConn)
@@ -601,9 +614,13 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 	// Send authentication if not using /socket path
 	if u.Path != "/socket" {
 		authMsg := AuthMessage{
-			Reverse:  c.reverse,
-			Token:    c.token,
-			Instance: c.instanceID,
+			Reverse:      c.reverse,
+			Token:        c.token,
+			Instance:     c.instanceID,
+			Compressions: c.relay.acceptedCompressions(),
+			MinVersion:   MinProtocolVersion,
+			MaxVersion:   ProtocolVersion,
+			Capabilities: LocalCapabilities,
 		}
 
 		c.relay.logMessage(authMsg, "send", wsConn.Label())
@@ -642,6 +659,19 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 		return &nonRetriableError{msg: "authentication failed"}
 	}
 
+	if authResponse.Version < MinProtocolVersion || authResponse.Version > ProtocolVersion {
+		wsConn.Close()
+		return &nonRetriableError{msg: fmt.Sprintf("unsupported protocol version: %d", authResponse.Version)}
+	}
+	wsConn.setProtocol(authResponse.Version, authResponse.Capabilities&LocalCapabilities, false)
+	if c.e2eKeys != nil {
+		wsConn.setE2EKeys(c.e2eKeys)
+	}
+
+	// Only use the compression selected by the server if it is accepted
+	offered := negotiableCompressions([]byte{authResponse.Compression}, wsConn.Capabilities())
+	wsConn.setCompression(c.relay.selectCompression(offered))
+
 	c.batchLogger.log("auth_success", c.threads, func(count, total int) {
 		mode := "forward"
 		if c.reverse {
@@ -664,17 +694,22 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 	}
 
 	errChan := make(chan error, 2)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Start message dispatcher and heartbeat
+	// Start message dispatcher and heartbeat, other transports check liveness themselves
 	go func() {
 		errChan <- c.messageDispatcher(ctx, wsConn)
 	}()
-	go func() {
-		errChan <- c.heartbeatHandler(ctx, wsConn)
-	}()
+	if wsConn.hasControl() {
+		go func() {
+			errChan <- c.heartbeatHandler(ctx, wsConn)
+		}()
+	}
 
 	// Wait for first error
 	err = <-errChan
+	c.relay.closeConnChannels(wsConn)
 
 	c.mu.Lock()
 	if index < len(c.websockets) {
@@ -697,6 +732,199 @@ func (c *WSSocksClient) maintainWebSocketConnection(ctx context.Context, index i
 	return err
 }
 
+// dialTransport connects to the server with the transport selected by the URL scheme. If the
+// WebSocket upgrade is refused, as by proxies blocking it, the HTTP transports are tried in turn
+// and the one that works is used for later connections.
+func (c *WSSocksClient) dialTransport(ctx context.Context, rawURL string, label string) (*WSConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	transport, scheme, err := parseTransportScheme(u.Scheme)
+	if err != nil {
+		return nil, &nonRetriableError{msg: err.Error()}
+	}
+
+	switch transport {
+	case TransportTCP, TransportQUIC:
+		// These transports have no well-known port to default to
+		if u.Port() == "" {
+			return nil, &nonRetriableError{msg: fmt.Sprintf("missing port in %s URL, e.g. %s://%s:8443", u.Scheme, u.Scheme, u.Host)}
+		}
+		dial := dialTCP
+		if transport == TransportQUIC {
+			dial = dialQUIC
+		}
+		conn, err := dial(ctx, u.Host, c.tlsConfig, transportHandshakeTimeout)
+		if err != nil {
+			c.batchLogger.log("dial_error", c.threads, func(count, total int) {
+				c.log.Warn().Err(err).Str("transport", transport).Msgf("Failed to connect to server (%d/%d)", count, total)
+			})
+			return nil, err
+		}
+		return NewTransportConn(conn, label), nil
+	case TransportStream, TransportPoll:
+		return c.dialHTTPTransport(ctx, u, scheme, transport, label)
+	}
+
+	c.mu.RLock()
+	fallback := c.fallbackTransport
+	c.mu.RUnlock()
+	if fallback != "" {
+		wsConn, err := c.dialHTTPTransport(ctx, u, scheme, fallback, label)
+		if err == nil {
+			return wsConn, nil
+		}
+		// Start over with WebSocket next time, the network may have changed
+		c.mu.Lock()
+		c.fallbackTransport = ""
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	ws, err := c.dialWebSocket(rawURL)
+	if err == nil {
+		return NewWSConn(ws, label, c.log), nil
+	}
+	if err != websocket.ErrBadHandshake {
+		return nil, err
+	}
+
+	for _, fallback := range []string{TransportStream, TransportPoll} {
+		wsConn, fallbackErr := c.dialHTTPTransport(ctx, u, scheme, fallback, label)
+		if fallbackErr != nil {
+			c.log.Debug().Err(fallbackErr).Str("transport", fallback).Msg("Fallback transport unavailable")
+			continue
+		}
+		c.mu.Lock()
+		c.fallbackTransport = fallback
+		c.mu.Unlock()
+		c.batchLogger.log("transport_fallback", c.threads, func(count, total int) {
+			c.log.Info().Str("transport", fallback).Msgf("WebSocket unavailable, falling back to HTTP transport (%d/%d)", count, total)
+		})
+		return wsConn, nil
+	}
+	return nil, err
+}
+
+// dialHTTPTransport connects to the endpoint of an HTTP transport below the WebSocket path
+func (c *WSSocksClient) dialHTTPTransport(ctx context.Context, u *url.URL, scheme string, transport string, label string) (*WSConn, error) {
+	endpoint := httpTransportURL(u, scheme, transport)
+
+	var conn Transport
+	var err error
+	switch transport {
+	case TransportStream:
+		conn, err = dialStream(ctx, c.httpClient, endpoint, transportHandshakeTimeout)
+	case TransportPoll:
+		conn, err = dialPoll(ctx, c.httpClient, endpoint, transportHandshakeTimeout)
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", transport)
+	}
+	if err != nil {
+		c.batchLogger.log("dial_error", c.threads, func(count, total int) {
+			c.log.Warn().Err(err).Str("transport", transport).Msgf("Failed to connect to server (%d/%d)", count, total)
+		})
+		return nil, err
+	}
+	return NewTransportConn(conn, label), nil
+}
+
+// dialWebSocket connects to the server with WebSocket, following redirects
+func (c *WSSocksClient) dialWebSocket(wsURL string) (*websocket.Conn, error) {
+	dialer := websocket.DefaultDialer
+	if c.noEnvProxy {
+		dialer = &websocket.Dialer{
+			Proxy:            nil, // Explicitly disable proxy
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+			ReadBufferSize:   websocket.DefaultDialer.ReadBufferSize,
+			WriteBufferSize:  websocket.DefaultDialer.WriteBufferSize,
+		}
+	}
+
+	// Handle WebSocket connection with redirect support
+	var ws *websocket.Conn
+	var resp *http.Response
+	var err error
+	currentURL := wsURL
+	redirectsLeft := 5 // Maximum number of redirects to follow
+
+	for redirectsLeft >= 0 {
+		ws, resp, err = dialer.Dial(currentURL, nil)
+		if err == nil {
+			// Successfully connected
+			break
+		}
+
+		// Check if this is a redirect
+		if err == websocket.ErrBadHandshake && resp != nil && (resp.StatusCode >= 301 && resp.StatusCode <= 308) {
+			redirect := resp.Header.Get("Location")
+			if redirect == "" {
+				// No redirect URL provided
+				c.log.Warn().Int("status", resp.StatusCode).Msg("Received redirect status but no Location header")
+				return nil, errors.New("redirect response missing Location header")
+			}
+
+			// Track number of redirects
+			redirectsLeft--
+			if redirectsLeft < 0 {
+				c.log.Warn().Msg("Too many redirects, giving up after 5 redirects")
+				return nil, errors.New("too many redirects (maximum 5)")
+			}
+
+			// Log the redirect
+			c.log.Debug().
+				Str("from", currentURL).
+				Str("to", redirect).
+				Int("status", resp.StatusCode).
+				Int("redirects_left", redirectsLeft).
+				Msg("Following WebSocket redirect")
+
+			// Parse the redirect URL
+			redirectURL, parseErr := url.Parse(redirect)
+			if parseErr != nil {
+				c.log.Warn().Err(parseErr).Msg("Failed to parse redirect URL")
+				return nil, parseErr
+			}
+
+			// Handle relative URLs
+			if !redirectURL.IsAbs() {
+				originalURL, _ := url.Parse(currentURL)
+				redirectURL = originalURL.ResolveReference(redirectURL)
+			}
+
+			// Ensure proper scheme (ws/wss)
+			if redirectURL.Scheme == "http" {
+				redirectURL.Scheme = "ws"
+			} else if redirectURL.Scheme == "https" {
+				redirectURL.Scheme = "wss"
+			}
+
+			// Update URL for next attempt
+			currentURL = redirectURL.String()
+			continue
+		}
+
+		// Not a redirect or another error occurred
+		if err == websocket.ErrBadHandshake {
+			statusMsg := "unknown"
+			if resp != nil {
+				statusMsg = resp.Status
+			}
+			c.batchLogger.log("handshake_error", c.threads, func(count, total int) {
+				c.log.Warn().Err(err).Str("status", statusMsg).Msgf("WebSocket handshake failed (%d/%d)", count, total)
+			})
+		} else {
+			c.batchLogger.log("dial_error", c.threads, func(count, total int) {
+				c.log.Warn().Err(err).Msgf("Failed to dial WebSocket (%d/%d)", count, total)
+			})
+		}
+		return nil, err
+	}
+
+	return ws, nil
+}
+
 // startReverse connects to WebSocket server in reverse proxy mode
 func (c *WSSocksClient) startReverse(ctx context.Context) error {
 	var wg sync.WaitGroup
@@ -779,7 +1007,7 @@ func (c *WSSocksClient) messageDispatcher(ctx context.Context, ws *WSConn) error
 				}
 
 			case ConnectResponseMessage:
-				if !c.relay.option.StrictConnect {
+				if _, awaited := c.relay.awaitedConnects.Load(m.ChannelID); !awaited && !c.relay.option.StrictConnect {
 					if m.Success {
 						c.relay.SetConnectionSuccess(m.ChannelID)
 					} else {
@@ -914,16 +1142,11 @@ func (c *WSSocksClient) handleSocksRequest(ctx context.Context, socksConn net.Co
 	defer socksConn.Close()
 
 	// Wait up to 10 seconds for WebSocket connection
-	startTime := time.Now()
-	for time.Since(startTime) < 10*time.Second {
-		ws := c.getNextWebSocket()
-		if ws != nil {
-			if err := c.relay.HandleSocksRequest(ctx, ws, socksConn, c.socksUsername, c.socksPassword); err != nil && !errors.Is(err, context.Canceled) {
-				c.log.Warn().Err(err).Msg("Error handling SOCKS request")
-			}
-			return
+	if ws := c.waitWebSocket(10 * time.Second); ws != nil {
+		if err := c.relay.HandleSocksRequest(ctx, ws, socksConn, c.socksUsername, c.socksPassword); err != nil && !errors.Is(err, context.Canceled) {
+			c.log.Warn().Err(err).Msg("Error handling SOCKS request")
 		}
-		time.Sleep(100 * time.Millisecond)
+		return
 	}
 
 	c.log.Warn().Msg("No valid websockets connection after waiting 10s, refusing socks request")
@@ -948,6 +1171,18 @@ func (c *WSSocksClient) Close() {
 		c.socksListener = nil
 	}
 
+	// Close transparent proxy listeners if they exist
+	if c.transparentListener != nil {
+		if err := c.transparentListener.Close(); err != nil {
+			c.log.Warn().Err(err).Msg("Error closing transparent listener")
+		}
+		c.transparentListener = nil
+	}
+	if c.transparentUDP != nil {
+		c.transparentUDP.Close()
+		c.transparentUDP = nil
+	}
+
 	// Close WebSocket connections
 	for _, ws := range c.websockets {
 		if ws != nil {
@@ -0,0 +1,362 @@
+package wssocks
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Maximum size of decompressed data, matching the WebSocket read limit
+	maxDecompressedSize = 32 * 1024 * 1024
+
+	// Data smaller than this is never compressed in adaptive mode
+	adaptiveCompressionMinSize = 1024
+	// Size of the sample used to estimate compressibility in adaptive mode
+	adaptiveCompressionSampleSize = 4096
+	// Entropy in bits per byte above which data is considered already compressed or encrypted
+	adaptiveCompressionMaxEntropy = 7.2
+)
+
+// Compressor is a codec for the data of DataMessages
+type Compressor interface {
+	// Compress returns the compressed data
+	Compress(data []byte) ([]byte, error)
+	// Decompress returns the original data, reading at most limit bytes of it
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// AppendCompressor is optionally implemented by codecs able to compress into a caller buffer,
+// which avoids an allocation per DataMessage
+type AppendCompressor interface {
+	// AppendCompress appends the compressed data to dst and returns the extended buffer
+	AppendCompress(dst, data []byte) ([]byte, error)
+}
+
+type registeredCompressor struct {
+	name       string
+	compressor Compressor
+}
+
+var (
+	compressorsMu    sync.RWMutex
+	compressors      = map[byte]registeredCompressor{}
+	compressionOrder []byte // Registration order, used as default preference order
+)
+
+func init() {
+	RegisterCompressor(DataCompressionGzip, "gzip", gzipCompressor{})
+	RegisterCompressor(DataCompressionDeflate, "deflate", flateCompressor{})
+	RegisterCompressor(DataCompressionLZ4, "lz4", lz4Compressor{})
+}
+
+// RegisterCompressor registers a codec under a compression flag and a name, so it can be
+// negotiated with peers registering the same codec, e.g. zstd or snappy from third party
+// packages. Flags below 0x10 are reserved for the built-in codecs. Registering an existing
+// flag replaces its codec. It must be called before clients or servers are started.
+func RegisterCompressor(id byte, name string, c Compressor) {
+	if id == DataCompressionNone {
+		panic("wssocks: cannot register a compressor for DataCompressionNone")
+	}
+
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	if _, exists := compressors[id]; !exists {
+		compressionOrder = append(compressionOrder, id)
+	}
+	compressors[id] = registeredCompressor{name: strings.ToLower(name), compressor: c}
+}
+
+// Compressions returns the flags of the registered codecs in registration order
+func Compressions() []byte {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	return append([]byte(nil), compressionOrder...)
+}
+
+// CompressionByName returns the flag of the codec registered with the given name
+func CompressionByName(name string) (byte, bool) {
+	name = strings.ToLower(name)
+	if name == "none" {
+		return DataCompressionNone, true
+	}
+
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	for id, c := range compressors {
+		if c.name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// CompressionName returns the name of the codec registered for a compression flag
+func CompressionName(id byte) string {
+	if id == DataCompressionNone {
+		return "none"
+	}
+
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	if c, ok := compressors[id]; ok {
+		return c.name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// ParseCompressions parses a comma-separated list of codec names, "none" alone disables compression
+func ParseCompressions(names string) ([]byte, error) {
+	ids := []byte{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := CompressionByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown compression: %s", name)
+		}
+		if id != DataCompressionNone {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// formatCompressionList encodes compression flags for the "compression" URL query parameter
+func formatCompressionList(ids []byte) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(int(id))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseCompressionList decodes the "compression" URL query parameter, skipping invalid flags
+func parseCompressionList(list string) []byte {
+	ids := []byte{}
+	for _, part := range strings.Split(list, ",") {
+		if id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8); err == nil {
+			ids = append(ids, byte(id))
+		}
+	}
+	return ids
+}
+
+// negotiableCompressions returns the compressions usable with a peer, peers without
+// CapabilityCompression only know gzip
+func negotiableCompressions(ids []byte, capabilities Capability) []byte {
+	if capabilities.Has(CapabilityCompression) {
+		return ids
+	}
+	for _, id := range ids {
+		if id == DataCompressionGzip {
+			return []byte{DataCompressionGzip}
+		}
+	}
+	return []byte{}
+}
+
+func getCompressor(id byte) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[id]
+	return c.compressor, ok
+}
+
+// compressData appends data compressed with the codec of a compression flag to dst
+func compressData(id byte, dst, data []byte) ([]byte, error) {
+	c, ok := getCompressor(id)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression: %d", id)
+	}
+	if ac, ok := c.(AppendCompressor); ok {
+		return ac.AppendCompress(dst, data)
+	}
+	compressed, err := c.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, compressed...), nil
+}
+
+// decompressData decompresses data with the codec of a compression flag
+func decompressData(id byte, data []byte) ([]byte, error) {
+	c, ok := getCompressor(id)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression: %d", id)
+	}
+	return c.Decompress(data, maxDecompressedSize)
+}
+
+// readAllLimit reads r to the end, failing if it holds more than limit bytes
+func readAllLimit(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// appendWriter is an io.Writer appending to a byte slice
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// Codec states are large, they are pooled along with their input and output
+type gzipWriter struct {
+	w   *gzip.Writer
+	out appendWriter
+}
+
+type gzipReader struct {
+	r   gzip.Reader
+	src bytes.Reader
+}
+
+type flateWriter struct {
+	w   *flate.Writer
+	out appendWriter
+}
+
+type flateReader struct {
+	r   io.ReadCloser
+	src bytes.Reader
+}
+
+var (
+	gzipWriterPool = sync.Pool{New: func() any {
+		w := &gzipWriter{}
+		w.w = gzip.NewWriter(&w.out)
+		return w
+	}}
+	gzipReaderPool = sync.Pool{New: func() any {
+		return &gzipReader{}
+	}}
+	flateWriterPool = sync.Pool{New: func() any {
+		w := &flateWriter{}
+		// Only fails for invalid levels
+		w.w, _ = flate.NewWriter(&w.out, flate.DefaultCompression)
+		return w
+	}}
+	flateReaderPool = sync.Pool{New: func() any {
+		r := &flateReader{}
+		r.r = flate.NewReader(&r.src)
+		return r
+	}}
+)
+
+type gzipCompressor struct{}
+
+func (c gzipCompressor) Compress(data []byte) ([]byte, error) {
+	return c.AppendCompress(nil, data)
+}
+
+func (gzipCompressor) AppendCompress(dst, data []byte) ([]byte, error) {
+	w := gzipWriterPool.Get().(*gzipWriter)
+	defer gzipWriterPool.Put(w)
+
+	w.out.buf = dst
+	defer func() { w.out.buf = nil }()
+	w.w.Reset(&w.out)
+	if _, err := w.w.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip compression failed: %w", err)
+	}
+	if err := w.w.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close failed: %w", err)
+	}
+	return w.out.buf, nil
+}
+
+func (gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r := gzipReaderPool.Get().(*gzipReader)
+	defer gzipReaderPool.Put(r)
+
+	r.src.Reset(data)
+	if err := r.r.Reset(&r.src); err != nil {
+		return nil, fmt.Errorf("gzip reader creation failed: %w", err)
+	}
+	decompressed, err := readAllLimit(&r.r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression failed: %w", err)
+	}
+	return decompressed, nil
+}
+
+// flateCompressor is raw deflate, gzip without its header and checksum
+type flateCompressor struct{}
+
+func (c flateCompressor) Compress(data []byte) ([]byte, error) {
+	return c.AppendCompress(nil, data)
+}
+
+func (flateCompressor) AppendCompress(dst, data []byte) ([]byte, error) {
+	w := flateWriterPool.Get().(*flateWriter)
+	defer flateWriterPool.Put(w)
+
+	w.out.buf = dst
+	defer func() { w.out.buf = nil }()
+	w.w.Reset(&w.out)
+	if _, err := w.w.Write(data); err != nil {
+		return nil, fmt.Errorf("deflate compression failed: %w", err)
+	}
+	if err := w.w.Close(); err != nil {
+		return nil, fmt.Errorf("deflate close failed: %w", err)
+	}
+	return w.out.buf, nil
+}
+
+func (flateCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r := flateReaderPool.Get().(*flateReader)
+	defer flateReaderPool.Put(r)
+
+	r.src.Reset(data)
+	if err := r.r.(flate.Resetter).Reset(&r.src, nil); err != nil {
+		return nil, fmt.Errorf("deflate reader creation failed: %w", err)
+	}
+	decompressed, err := readAllLimit(r.r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("deflate decompression failed: %w", err)
+	}
+	return decompressed, nil
+}
+
+// isCompressible estimates whether data is worth compressing from the byte entropy of a
+// sample, already compressed or encrypted data is close to 8 bits per byte
+func isCompressible(data []byte) bool {
+	sample := data
+	if len(sample) > adaptiveCompressionSampleSize {
+		sample = sample[:adaptiveCompressionSampleSize]
+	}
+
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+
+	entropy := 0.0
+	total := float64(len(sample))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy < adaptiveCompressionMaxEntropy
+}
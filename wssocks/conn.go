@@ -1,26 +1,45 @@
 package wssocks
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 )
 
-// WSConn wraps a websocket.Conn with mutex protection
+// WSConn is a connection between a client and a server, carrying messages over a Transport
+// with mutex protection
 type WSConn struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
+	transport Transport
+	mu        sync.Mutex
 
 	pingTime time.Time  // Track when ping was sent
 	pingMu   sync.Mutex // Mutex for ping timing
 
 	label    string
 	clientIP string
+
+	compression  atomic.Int32  // Compression negotiated for sent data
+	version      atomic.Int32  // Protocol version negotiated for the connection
+	capabilities atomic.Uint32 // Capabilities supported by both peers
+
+	streams atomic.Pointer[streamTable] // Set when compact frames are negotiated
+	e2e     atomic.Pointer[e2eSession]  // Set when end-to-end encryption is enabled
+
+	connectedAt   time.Time
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	rtt           atomic.Int64 // Last round-trip time measured with a ping, in nanoseconds
+	channels      sync.Map     // map[uuid.UUID]*channelStats of the channels open on the connection
+	channelCount  atomic.Int32
+	channelHook   atomic.Pointer[func(ConnChannel, bool)] // Called when a channel opens or closes
 }
 
 func (c *WSConn) Label() string {
@@ -31,46 +50,316 @@ func (c *WSConn) setLabel(label string) {
 	c.label = label
 }
 
+// Compression returns the compression negotiated for the data sent on the connection
+func (c *WSConn) Compression() byte {
+	return byte(c.compression.Load())
+}
+
+func (c *WSConn) setCompression(compression byte) {
+	c.compression.Store(int32(compression))
+}
+
+// Version returns the protocol version negotiated for the connection
+func (c *WSConn) Version() byte {
+	return byte(c.version.Load())
+}
+
+// Capabilities returns the capabilities supported by both peers of the connection
+func (c *WSConn) Capabilities() Capability {
+	return Capability(c.capabilities.Load())
+}
+
+// setProtocol sets the negotiated protocol, server tells which side of the connection this is
+func (c *WSConn) setProtocol(version byte, capabilities Capability, server bool) {
+	c.version.Store(int32(version))
+	c.capabilities.Store(uint32(capabilities))
+	if capabilities.Has(CapabilityCompactFrames) {
+		c.streams.Store(newStreamTable(server))
+	} else {
+		c.streams.Store(nil)
+	}
+}
+
+// setE2EKeys enables end-to-end encryption of the channels opened on the connection and of
+// the encrypted channels requested by the peer
+func (c *WSConn) setE2EKeys(keys *e2eKeys) {
+	c.e2e.Store(newE2ESession(keys))
+}
+
+// E2EEnabled reports whether end-to-end encrypted channels can be opened on the connection
+func (c *WSConn) E2EEnabled() bool {
+	return c.e2e.Load() != nil
+}
+
+// e2eAccepted reports whether an encrypted channel requested by the peer can be served, that
+// is whether its connect request was authenticated with the shared secret
+func (c *WSConn) e2eAccepted(channelID uuid.UUID) bool {
+	e2e := c.e2e.Load()
+	return e2e != nil && e2e.accepted(channelID)
+}
+
+// ConnectedAt returns when the connection was established
+func (c *WSConn) ConnectedAt() time.Time {
+	return c.connectedAt
+}
+
+// BytesSent returns the number of frame bytes sent on the connection
+func (c *WSConn) BytesSent() uint64 {
+	return c.bytesSent.Load()
+}
+
+// BytesReceived returns the number of frame bytes received on the connection
+func (c *WSConn) BytesReceived() uint64 {
+	return c.bytesReceived.Load()
+}
+
+// RTT returns the last round-trip time measured with a ping, zero if none was measured
+func (c *WSConn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// ActiveChannels returns the number of channels open on the connection
+func (c *WSConn) ActiveChannels() int {
+	return int(c.channelCount.Load())
+}
+
+// ChannelIDs returns the IDs of the channels open on the connection
+func (c *WSConn) ChannelIDs() []uuid.UUID {
+	var ids []uuid.UUID
+	c.channels.Range(func(key, _ any) bool {
+		ids = append(ids, key.(uuid.UUID))
+		return true
+	})
+	return ids
+}
+
+// ConnChannel describes a channel open on a connection
+type ConnChannel struct {
+	ID           uuid.UUID
+	Protocol     string
+	Address      string // Target address, the last one used for UDP
+	Port         int
+	Outbound     bool // Opened by this side of the connection
+	StartedAt    time.Time
+	LastActivity time.Time
+	BytesUp      uint64 // Data sent toward the target
+	BytesDown    uint64 // Data received from the target
+}
+
+// channelStats tracks the activity of a channel open on a connection
+type channelStats struct {
+	protocol     string
+	outbound     bool
+	startedAt    time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds
+	bytesUp      atomic.Uint64
+	bytesDown    atomic.Uint64
+
+	mu      sync.Mutex
+	address string
+	port    int
+}
+
+func (s *channelStats) snapshot(id uuid.UUID) ConnChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ConnChannel{
+		ID:           id,
+		Protocol:     s.protocol,
+		Address:      s.address,
+		Port:         s.port,
+		Outbound:     s.outbound,
+		StartedAt:    s.startedAt,
+		LastActivity: time.Unix(0, s.lastActivity.Load()),
+		BytesUp:      s.bytesUp.Load(),
+		BytesDown:    s.bytesDown.Load(),
+	}
+}
+
+// Channels returns the channels open on the connection
+func (c *WSConn) Channels() []ConnChannel {
+	var channels []ConnChannel
+	c.channels.Range(func(key, value any) bool {
+		channels = append(channels, value.(*channelStats).snapshot(key.(uuid.UUID)))
+		return true
+	})
+	return channels
+}
+
+// setChannelHook sets a function called when a channel opens or closes on the connection
+func (c *WSConn) setChannelHook(hook func(channel ConnChannel, opened bool)) {
+	c.channelHook.Store(&hook)
+}
+
+// closeChannels forgets the channels still open, calling the hook for each, and returns them
+func (c *WSConn) closeChannels() []uuid.UUID {
+	var ids []uuid.UUID
+	c.channels.Range(func(key, value any) bool {
+		id := key.(uuid.UUID)
+		c.forgetChannel(id)
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// forgetChannel drops a channel that ended without a message closing it on the connection,
+// freeing its stream ID
+func (c *WSConn) forgetChannel(id uuid.UUID) {
+	if streams := c.streams.Load(); streams != nil {
+		streams.forget(id)
+	}
+	c.removeChannel(id)
+}
+
+func (c *WSConn) removeChannel(id uuid.UUID) {
+	value, loaded := c.channels.LoadAndDelete(id)
+	if !loaded {
+		return
+	}
+	c.channelCount.Add(-1)
+	if hook := c.channelHook.Load(); hook != nil {
+		(*hook)(value.(*channelStats).snapshot(id), false)
+	}
+}
+
+// trackChannel follows the channels opened and closed by the messages on the connection,
+// outbound is set for the messages sent
+func (c *WSConn) trackChannel(msg BaseMessage, outbound bool) {
+	var closed uuid.UUID
+	switch m := msg.(type) {
+	case DataMessage:
+		value, ok := c.channels.Load(m.ChannelID)
+		if !ok {
+			return
+		}
+		stats := value.(*channelStats)
+		stats.lastActivity.Store(time.Now().UnixNano())
+		if outbound != stats.outbound {
+			stats.bytesDown.Add(uint64(len(m.Data)))
+			return
+		}
+		stats.bytesUp.Add(uint64(len(m.Data)))
+		if m.TargetAddr != "" {
+			stats.mu.Lock()
+			stats.address, stats.port = m.TargetAddr, m.TargetPort
+			stats.mu.Unlock()
+		}
+		return
+	case ConnectMessage:
+		now := time.Now()
+		stats := &channelStats{
+			protocol:  m.Protocol,
+			outbound:  outbound,
+			startedAt: now,
+			address:   m.Address,
+			port:      m.Port,
+		}
+		stats.lastActivity.Store(now.UnixNano())
+		if _, loaded := c.channels.LoadOrStore(m.ChannelID, stats); !loaded {
+			c.channelCount.Add(1)
+			if hook := c.channelHook.Load(); hook != nil {
+				(*hook)(stats.snapshot(m.ChannelID), true)
+			}
+		}
+		return
+	case ConnectResponseMessage:
+		if m.Success {
+			return
+		}
+		closed = m.ChannelID
+	case DisconnectMessage:
+		closed = m.ChannelID
+	default:
+		return
+	}
+	c.removeChannel(closed)
+}
+
 // GetClientIP returns the client IP address
 func (c *WSConn) GetClientIP() string {
 	return c.clientIP
 }
 
-// SetClientIPFromRequest extracts and sets the client IP from HTTP request
+// SetClientIPFromRequest sets the client IP to the remote address of an HTTP request, without
+// trusting forwarded headers
 func (c *WSConn) SetClientIPFromRequest(r *http.Request) {
-	c.clientIP = getClientIPFromRequest(r)
+	c.clientIP = getClientIPFromRequest(r, nil)
 }
 
-// getClientIPFromRequest extracts client IP from HTTP request
-func getClientIPFromRequest(r *http.Request) string {
-	// Check CF-Connecting-IP header first
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
+// getClientIPFromRequest extracts client IP from HTTP request. The CF-Connecting-IP and
+// X-Forwarded-For headers can be forged by clients, so they are only used for requests of the
+// trusted proxies.
+func getClientIPFromRequest(r *http.Request, trusted []*net.IPNet) string {
+	// Get the remote address
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip, trusted) {
 		return ip
 	}
 
-	// Check X-Forwarded-For header
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		if idx := strings.Index(ip, ","); idx != -1 {
-			return strings.TrimSpace(ip[:idx])
-		}
-		return strings.TrimSpace(ip)
+	// Check CF-Connecting-IP header first
+	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
+		return strings.TrimSpace(cfIP)
 	}
 
-	// Get the remote address
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+	// Check X-Forwarded-For header, in which each proxy appends the address it was reached
+	// from, so the client is the last address not of a trusted proxy
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := strings.TrimSpace(forwarded[i])
+		if forwardedIP == "" {
+			continue
+		}
+		ip = forwardedIP
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
 	}
 	return ip
 }
 
+// isTrustedProxy reports whether ip is in one of the trusted ranges
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses proxy addresses given as IPs or CIDR ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
 // NewWSConn creates a new mutex-protected websocket connection
 func NewWSConn(conn *websocket.Conn, label string, logger zerolog.Logger) *WSConn {
-	wsConn := &WSConn{
-		conn:  conn,
-		label: label,
-	}
+	wsConn := NewTransportConn(&websocketTransport{conn: conn}, label)
 
 	// Set read limit
 	conn.SetReadLimit(32 * 1024 * 1024) // 32MB max message size
@@ -80,6 +369,7 @@ func NewWSConn(conn *websocket.Conn, label string, logger zerolog.Logger) *WSCon
 		wsConn.pingMu.Lock()
 		rtt := time.Since(wsConn.pingTime)
 		wsConn.pingMu.Unlock()
+		wsConn.rtt.Store(int64(rtt))
 
 		// Log the actual RTT when pong is received
 		logger.
@@ -93,33 +383,107 @@ func NewWSConn(conn *websocket.Conn, label string, logger zerolog.Logger) *WSCon
 	return wsConn
 }
 
-// SyncWriteBinary performs thread-safe binary writes to the websocket connection
+// NewTransportConn creates a new connection carrying messages over a transport
+func NewTransportConn(transport Transport, label string) *WSConn {
+	wsConn := &WSConn{
+		transport:   transport,
+		label:       label,
+		connectedAt: time.Now(),
+	}
+	// Peers not negotiating compression always accept gzip and only speak the first version
+	wsConn.setCompression(DataCompressionGzip)
+	wsConn.setProtocol(MinProtocolVersion, 0, false)
+	return wsConn
+}
+
+// SyncWriteBinary performs thread-safe binary writes to the connection
 func (c *WSConn) SyncWriteBinary(data []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+	return c.writeFrame(data)
 }
 
-// ReadMessage reads a BaseMessage from the websocket connection
+// writeFrame writes a frame to the transport, with the write lock held
+func (c *WSConn) writeFrame(data []byte) error {
+	if err := c.transport.WriteFrame(data); err != nil {
+		return err
+	}
+	c.bytesSent.Add(uint64(len(data)))
+	return nil
+}
+
+// ReadMessage reads a BaseMessage from the connection
 func (c *WSConn) ReadMessage() (BaseMessage, error) {
-	_, data, err := c.conn.ReadMessage()
+	data, err := c.transport.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	c.bytesReceived.Add(uint64(len(data)))
+	msg, err := ParseMessage(data)
 	if err != nil {
 		return nil, err
 	}
-	return ParseMessage(data)
+	if streams := c.streams.Load(); streams != nil {
+		if msg, err = streams.incoming(msg); err != nil {
+			return nil, err
+		}
+	}
+	if e2e := c.e2e.Load(); e2e != nil {
+		msg = e2e.incoming(msg)
+	}
+	c.trackChannel(msg, false)
+	return msg, nil
 }
 
-// WriteMessage writes a BaseMessage to the websocket connection
+// WriteMessage writes a BaseMessage to the connection
 func (c *WSConn) WriteMessage(msg BaseMessage) error {
-	data, err := PackMessage(msg)
+	c.trackChannel(msg, true)
+	if e2e := c.e2e.Load(); e2e != nil {
+		msg = e2e.outgoing(msg)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	streams := c.streams.Load()
+	if _, ok := msg.(ConnectMessage); ok && streams != nil {
+		// Stream IDs are assigned while holding the write lock, so connect messages are
+		// written in the order of their IDs
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		data, err := AppendMessage(*buf, streams.outgoing(msg))
+		if err != nil {
+			return err
+		}
+		*buf = data
+		return c.writeFrame(data)
+	}
+
+	if streams != nil {
+		msg = streams.outgoing(msg)
+	}
+	data, err := AppendMessage(*buf, msg)
 	if err != nil {
 		return err
 	}
+	*buf = data
+	// The frame is written before returning, so the buffer can be reused afterwards
 	return c.SyncWriteBinary(data)
 }
 
-// SyncWriteControl performs thread-safe control message writes and tracks ping time
+// hasControl reports whether the transport has control messages to send heartbeats with
+func (c *WSConn) hasControl() bool {
+	_, ok := c.transport.(controlWriter)
+	return ok
+}
+
+// SyncWriteControl performs thread-safe control message writes and tracks ping time, it does
+// nothing on transports without control messages
 func (c *WSConn) SyncWriteControl(messageType int, data []byte, deadline time.Time) error {
+	cw, ok := c.transport.(controlWriter)
+	if !ok {
+		return nil
+	}
+
 	if messageType == websocket.PingMessage {
 		c.pingMu.Lock()
 		c.pingTime = time.Now()
@@ -128,10 +492,10 @@ func (c *WSConn) SyncWriteControl(messageType int, data []byte, deadline time.Ti
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.conn.WriteControl(messageType, data, deadline)
+	return cw.WriteControl(messageType, data, deadline)
 }
 
-// Close closes the underlying websocket connection
+// Close closes the underlying transport
 func (c *WSConn) Close() error {
-	return c.conn.Close()
+	return c.transport.Close()
 }
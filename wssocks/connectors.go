@@ -0,0 +1,81 @@
+package wssocks
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// connectorMeta records how a connector token was created
+type connectorMeta struct {
+	createdAt time.Time
+	createdBy uuid.UUID // Provider adding the token with a connector message, nil if added on the server
+}
+
+// ConnectorInfo describes a connector token of a reverse token
+type ConnectorInfo struct {
+	Token     string
+	CreatedAt time.Time
+	CreatedBy uuid.UUID   // Provider that added the token with a connector message, nil if added on the server
+	Clients   []uuid.UUID // Connectors connected with the token
+}
+
+// Connectors returns the connector tokens of a reverse token, including those added by its
+// providers, and whether the reverse token exists
+func (s *WSSocksServer) Connectors(reverseToken string) ([]ConnectorInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.isReverseToken(reverseToken) {
+		return nil, false
+	}
+
+	connectors := make([]ConnectorInfo, 0)
+	for _, connectorToken := range s.connectorTokensOf(reverseToken) {
+		meta := s.connectorMeta[connectorToken]
+		info := ConnectorInfo{
+			Token:     connectorToken,
+			CreatedAt: meta.createdAt,
+			CreatedBy: meta.createdBy,
+		}
+		for _, client := range s.tokenClients[connectorToken] {
+			info.Clients = append(info.Clients, client.ID)
+		}
+		connectors = append(connectors, info)
+	}
+	sort.Slice(connectors, func(i, j int) bool {
+		return connectors[i].CreatedAt.Before(connectors[j].CreatedAt)
+	})
+	return connectors, true
+}
+
+// RemoveConnectors removes the connector tokens of a reverse token, or only connectorToken if set,
+// disconnecting their connectors, and returns the tokens removed
+func (s *WSSocksServer) RemoveConnectors(reverseToken string, connectorToken string) []string {
+	s.mu.RLock()
+	var tokens []string
+	for _, token := range s.connectorTokensOf(reverseToken) {
+		if connectorToken == "" || token == connectorToken {
+			tokens = append(tokens, token)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, token := range tokens {
+		s.RemoveToken(token)
+	}
+	return tokens
+}
+
+// connectorTokensOf returns the connector tokens forwarding to a reverse token or to the internal
+// tokens of its autonomy clients, must be called with the server lock held
+func (s *WSSocksServer) connectorTokensOf(reverseToken string) []string {
+	var tokens []string
+	for connectorToken, target := range s.connectorTokens {
+		if target == reverseToken || containsString(s.internalTokens[reverseToken], target) {
+			tokens = append(tokens, connectorToken)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,449 @@
+package wssocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// channelAddr is the address of the remote end of a tunneled connection
+type channelAddr struct {
+	network string
+	address string
+}
+
+func (a channelAddr) Network() string { return a.network }
+func (a channelAddr) String() string  { return a.address }
+
+// channelConn is a net.Conn tunneled through a TCP channel of the relay
+type channelConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr  { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr { return c.remote }
+
+// Dial connects to addr on the named network through the WebSocket tunnel, without going
+// through the local SOCKS server. It can be used as http.Transport.DialContext.
+// Only "tcp", "tcp4", "tcp6", "udp", "udp4" and "udp6" networks are supported. Networks
+// with an address family resolve domain names locally to an address of that family, others
+// leave the resolution to the remote side.
+// This function is only available in forward proxy mode.
+func (c *WSSocksClient) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.reverse {
+		return nil, errors.New("dial is only available in forward proxy mode")
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	if host, err = resolveFamily(ctx, network, host); err != nil {
+		return nil, err
+	}
+	if network[0] == 'u' {
+		return c.dialUDP(ctx, network, host, port)
+	}
+
+	ws, err := c.waitWebSocketContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		defer remote.Close()
+		// The connection is only returned once the remote side connected, as with net.Dial
+		err := c.relay.handleTCPRequest(context.Background(), ws, remote, host, port, func(err error) error {
+			result <- err
+			return nil
+		}, true)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			c.log.Debug().Err(err).Str("addr", addr).Msg("Tunneled connection closed")
+		}
+		// Unblock Dial when the request failed before a result was reported
+		select {
+		case result <- ErrConnectFailed:
+		default:
+		}
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			local.Close()
+			return nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+	case <-ctx.Done():
+		local.Close()
+		return nil, ctx.Err()
+	}
+
+	return &channelConn{
+		Conn:   local,
+		local:  channelAddr{network: "wssocks", address: "local"},
+		remote: channelAddr{network: network, address: addr},
+	}, nil
+}
+
+// resolveFamily returns host as an address of the family of network, resolving domain names
+// locally, or host unchanged for networks without a family
+func resolveFamily(ctx context.Context, network, host string) (string, error) {
+	var family string
+	switch network[len(network)-1] {
+	case '4':
+		family = "ip4"
+	case '6':
+		family = "ip6"
+	default:
+		return host, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if (ip.To4() != nil) != (family == "ip4") {
+			return "", &net.AddrError{Err: "address family mismatch", Addr: host}
+		}
+		return host, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, family, host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0].String(), nil
+}
+
+// ListenPacket opens a UDP channel through the WebSocket tunnel and returns it as a
+// net.PacketConn. Each WriteTo is sent to the given address, which may also be a
+// domain name, and ReadFrom returns replies with their source address.
+// This function is only available in forward proxy mode.
+func (c *WSSocksClient) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if c.reverse {
+		return nil, errors.New("listen packet is only available in forward proxy mode")
+	}
+
+	ws, err := c.waitWebSocketContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.relay.OpenUDPChannel(ctx, ws)
+}
+
+// dialUDP returns a connected UDP conn tunneled through a UDP channel, once the remote side
+// opened the channel. Domain names are resolved locally, as replies come from addresses.
+func (c *WSSocksClient) dialUDP(ctx context.Context, network, host string, port int) (net.Conn, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+
+	ws, err := c.waitWebSocketContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := c.relay.openUDPChannel(ctx, ws, true)
+	if err != nil {
+		return nil, err
+	}
+	return &connectedPacketConn{channelPacketConn: pc, remote: &net.UDPAddr{IP: ip, Port: port}}, nil
+}
+
+// waitWebSocketContext waits for an available WebSocket connection until ctx is done,
+// or for at most 10 seconds if ctx has no deadline
+func (c *WSSocksClient) waitWebSocketContext(ctx context.Context) (*WSConn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ws := c.getNextWebSocket(); ws != nil {
+			return ws, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no valid websockets connection: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// OpenUDPChannel requests a new UDP channel through ws and returns it as a net.PacketConn
+func (r *Relay) OpenUDPChannel(ctx context.Context, ws *WSConn) (net.PacketConn, error) {
+	return r.openUDPChannel(ctx, ws, r.option.StrictConnect)
+}
+
+// openUDPChannel is OpenUDPChannel, waiting for the remote side to open the channel if strict
+// whatever the mode of the relay
+func (r *Relay) openUDPChannel(ctx context.Context, ws *WSConn, strict bool) (*channelPacketConn, error) {
+	channelID := uuid.New()
+	queue := make(chan BaseMessage, 1000)
+	r.messageQueues.Store(channelID, queue)
+
+	request := ConnectMessage{
+		Protocol:  "udp",
+		ChannelID: channelID,
+	}
+	r.log.Debug().Msg("Requesting UDP channel")
+	connected, err := r.connectChannel(ctx, ws, request, queue, strict)
+	if err != nil || !connected {
+		r.messageQueues.Delete(channelID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrConnectFailed
+	}
+
+	channelCtx, cancel := context.WithCancel(context.Background())
+	r.udpChannels.Store(channelID, cancel)
+	r.updateActivityTime(channelID)
+
+	return &channelPacketConn{
+		relay:         r,
+		ws:            ws,
+		channelID:     channelID,
+		queue:         queue,
+		ctx:           channelCtx,
+		cancel:        cancel,
+		readDeadline:  newPipeDeadline(),
+		writeDeadline: newPipeDeadline(),
+	}, nil
+}
+
+// channelPacketConn is a net.PacketConn backed by a UDP channel of the relay
+type channelPacketConn struct {
+	relay     *Relay
+	ws        *WSConn
+	channelID uuid.UUID
+	queue     chan BaseMessage
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	readDeadline  *pipeDeadline
+	writeDeadline *pipeDeadline
+	closeOnce     sync.Once
+}
+
+// ReadFrom reads the next datagram received on the channel
+func (c *channelPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return 0, nil, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, nil, os.ErrDeadlineExceeded
+		case msg := <-c.queue:
+			dataMsg, ok := msg.(DataMessage)
+			if !ok {
+				c.relay.log.Debug().Str("type", msg.GetType()).Msg("Unexpected message type for data")
+				continue
+			}
+			c.relay.updateActivityTime(c.channelID)
+
+			var addr net.Addr
+			if ip := net.ParseIP(dataMsg.Address); ip != nil {
+				addr = &net.UDPAddr{IP: ip, Port: dataMsg.Port}
+			} else {
+				addr = channelAddr{network: "udp", address: net.JoinHostPort(dataMsg.Address, strconv.Itoa(dataMsg.Port))}
+			}
+			return copy(p, dataMsg.Data), addr, nil
+		}
+	}
+}
+
+// WriteTo sends a datagram to addr through the channel
+func (c *channelPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.ctx.Done():
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	var host string
+	var port int
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		host, port = udpAddr.IP.String(), udpAddr.Port
+	} else {
+		h, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0, err
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return 0, fmt.Errorf("invalid port: %s", portStr)
+		}
+		host = h
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.relay.updateActivityTime(c.channelID)
+
+	msg := DataMessage{
+		Protocol:    "udp",
+		ChannelID:   c.channelID,
+		Data:        data,
+		TargetAddr:  host,
+		TargetPort:  port,
+		Compression: c.relay.determineCompression(c.ws, data),
+	}
+	c.relay.logMessage(msg, "send", c.ws.Label())
+	if err := c.ws.WriteMessage(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the channel and notifies the remote side
+func (c *channelPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.relay.udpChannels.Delete(c.channelID)
+		c.relay.messageQueues.Delete(c.channelID)
+		c.relay.lastActivity.Delete(c.channelID)
+
+		disconnectMsg := DisconnectMessage{
+			ChannelID: c.channelID,
+		}
+		c.relay.logMessage(disconnectMsg, "send", c.ws.Label())
+		c.ws.WriteMessage(disconnectMsg)
+	})
+	return nil
+}
+
+func (c *channelPacketConn) LocalAddr() net.Addr {
+	return channelAddr{network: "wssocks", address: c.channelID.String()}
+}
+
+func (c *channelPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *channelPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *channelPacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connectedPacketConn is a channelPacketConn bound to a single remote address
+type connectedPacketConn struct {
+	*channelPacketConn
+	remote *net.UDPAddr
+}
+
+// Read returns the next datagram of the remote address, dropping those of other sources as
+// connected UDP sockets do
+func (c *connectedPacketConn) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(p)
+		if err != nil {
+			return n, err
+		}
+		if src, ok := addr.(*net.UDPAddr); ok && src.Port == c.remote.Port && src.IP.Equal(c.remote.IP) {
+			return n, nil
+		}
+		c.relay.log.Debug().Str("addr", addr.String()).Msg("Dropping datagram of another source")
+	}
+}
+
+func (c *connectedPacketConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.remote)
+}
+
+func (c *connectedPacketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// pipeDeadline is a deadline that can be waited on and changed at any time
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Closed when the deadline expires
+}
+
+func newPipeDeadline() *pipeDeadline {
+	return &pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, a zero time disables it
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,10 @@
+//go:build go1.21
+
+package wssocks
+
+import "net/http"
+
+// enableFullDuplex allows an HTTP/1.1 handler to read the request body after writing the response
+func enableFullDuplex(w http.ResponseWriter) error {
+	return http.NewResponseController(w).EnableFullDuplex()
+}
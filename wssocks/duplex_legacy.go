@@ -0,0 +1,13 @@
+//go:build !go1.21
+
+package wssocks
+
+import (
+	"errors"
+	"net/http"
+)
+
+// enableFullDuplex is unavailable before Go 1.21, streaming then requires HTTP/2
+func enableFullDuplex(w http.ResponseWriter) error {
+	return errors.New("full-duplex HTTP/1.1 requires Go 1.21")
+}
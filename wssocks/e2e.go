@@ -0,0 +1,309 @@
+package wssocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Length of the sequence number prefixed to encrypted data
+const e2eSeqSize = 8
+
+// Overhead of end-to-end encryption on the data of a DataMessage
+const e2eOverhead = e2eSeqSize + 16
+
+// Lengths of the nonce and tag of encrypted connect requests, the nonce being a timestamp in
+// seconds followed by random bytes
+const (
+	e2eNonceSize = 16
+	e2eTagSize   = 16
+)
+
+// e2eReplayWindow bounds the age of accepted connect requests, channel IDs are remembered
+// that long to refuse replayed channels
+const e2eReplayWindow = 5 * time.Minute
+
+// Reason given when refusing an encrypted channel without the shared secret or whose connect
+// request is forged, tampered or replayed
+const e2eRefusedReason = "end-to-end encrypted channel refused"
+
+// e2eKeys holds the keys derived from the shared secret of a client, with the channel IDs its
+// connections accepted recently
+type e2eKeys struct {
+	prk        []byte // Pseudorandom key extracted from the shared secret
+	connectKey []byte // Key authenticating connect requests
+
+	mu        sync.Mutex
+	seen      map[uuid.UUID]time.Time // Timestamps of the accepted connect requests
+	lastPrune time.Time
+}
+
+// newE2EKeys derives the keys of a shared secret, nil if the secret is empty
+func newE2EKeys(secret string) *e2eKeys {
+	if secret == "" {
+		return nil
+	}
+	prk := hkdfExtract([]byte("wssocks e2e"), []byte(secret))
+	return &e2eKeys{
+		prk:        prk,
+		connectKey: hkdfExpand(prk, []byte("connect"), 32),
+		seen:       make(map[uuid.UUID]time.Time),
+		lastPrune:  time.Now(),
+	}
+}
+
+// connectTag authenticates the target of a connect request and the nonce of its channel
+func (k *e2eKeys) connectTag(m ConnectMessage) []byte {
+	mac := hmac.New(sha256.New, k.connectKey)
+	mac.Write(m.ChannelID[:])
+	mac.Write(m.E2ENonce)
+	mac.Write([]byte{protocolToBytes(m.Protocol), byte(len(m.Address))})
+	mac.Write([]byte(m.Address))
+	mac.Write([]byte{byte(m.Port >> 8), byte(m.Port)})
+	return mac.Sum(nil)[:e2eTagSize]
+}
+
+// accept checks a connect request of the peer, refusing forged or tampered requests, requests
+// outside of the replay window and channel IDs already accepted
+func (k *e2eKeys) accept(m ConnectMessage) bool {
+	if len(m.E2ENonce) != e2eNonceSize || !hmac.Equal(m.E2ETag, k.connectTag(m)) {
+		return false
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(m.E2ENonce)), 0)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	if sent.Before(now.Add(-e2eReplayWindow)) || sent.After(now.Add(e2eReplayWindow)) {
+		return false
+	}
+	if now.Sub(k.lastPrune) > time.Minute {
+		for channelID, t := range k.seen {
+			if t.Before(now.Add(-e2eReplayWindow)) {
+				delete(k.seen, channelID)
+			}
+		}
+		k.lastPrune = now
+	}
+	if _, ok := k.seen[m.ChannelID]; ok {
+		return false
+	}
+	k.seen[m.ChannelID] = sent
+	return true
+}
+
+// e2eSession encrypts the data of end-to-end encrypted channels of a WebSocket connection.
+// The connector opens these channels and the provider serving them accepts them, both
+// deriving the keys of each channel from a secret they share and a nonce chosen by the
+// connector, so the server relaying the data between them only sees channel metadata, which
+// it cannot change. The secret must not be the connector token, which the server knows.
+type e2eSession struct {
+	keys *e2eKeys
+
+	mu       sync.Mutex
+	channels map[uuid.UUID]*e2eChannel
+}
+
+// e2eChannel holds the keys of one direction each and the sequence numbers of a channel
+type e2eChannel struct {
+	mu      sync.Mutex
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64 // Highest sequence number received, older ones are replays
+}
+
+func newE2ESession(keys *e2eKeys) *e2eSession {
+	return &e2eSession{
+		keys:     keys,
+		channels: make(map[uuid.UUID]*e2eChannel),
+	}
+}
+
+// outgoing marks the channels opened on the connection as encrypted and encrypts their data
+func (s *e2eSession) outgoing(msg BaseMessage) BaseMessage {
+	switch m := msg.(type) {
+	case ConnectMessage:
+		m.Encrypted = true
+		m.E2ENonce = make([]byte, e2eNonceSize)
+		binary.BigEndian.PutUint64(m.E2ENonce, uint64(time.Now().Unix()))
+		rand.Read(m.E2ENonce[8:])
+		m.E2ETag = s.keys.connectTag(m)
+		s.register(m.ChannelID, m.E2ENonce, true)
+		return m
+	case DataMessage:
+		if ch := s.channel(m.ChannelID); ch != nil {
+			m.Data = ch.seal(e2eAdditionalData(m), m.Data)
+			// Ciphertext does not compress
+			m.Compression = DataCompressionNone
+			return m
+		}
+	case ConnectResponseMessage:
+		if !m.Success {
+			s.unregister(m.ChannelID)
+		}
+	case DisconnectMessage:
+		s.unregister(m.ChannelID)
+	}
+	return msg
+}
+
+// incoming registers the encrypted channels requested by the peer and decrypts their data.
+// Channels whose connect request is not accepted are not registered, and refused.
+func (s *e2eSession) incoming(msg BaseMessage) BaseMessage {
+	switch m := msg.(type) {
+	case ConnectMessage:
+		if !m.Encrypted {
+			break
+		}
+		if s.keys.accept(m) {
+			s.register(m.ChannelID, m.E2ENonce, false)
+		} else {
+			// Requests replayed while their channel is open end it
+			s.unregister(m.ChannelID)
+		}
+	case DataMessage:
+		if ch := s.channel(m.ChannelID); ch != nil {
+			data, ok := ch.open(e2eAdditionalData(m), m.Data)
+			if !ok {
+				// Forged, tampered or replayed data is dropped as sent to an unknown channel
+				m.ChannelID = uuid.Nil
+				return m
+			}
+			m.Data = data
+			return m
+		}
+	case ConnectResponseMessage:
+		if !m.Success {
+			s.unregister(m.ChannelID)
+		}
+	case DisconnectMessage:
+		s.unregister(m.ChannelID)
+	}
+	return msg
+}
+
+// register derives the keys of a channel, initiator tells whether this peer opened it
+func (s *e2eSession) register(channelID uuid.UUID, nonce []byte, initiator bool) {
+	toProvider := s.cipher(channelID, nonce, "connector to provider")
+	toConnector := s.cipher(channelID, nonce, "provider to connector")
+	ch := &e2eChannel{send: toConnector, recv: toProvider}
+	if initiator {
+		ch.send, ch.recv = toProvider, toConnector
+	}
+
+	s.mu.Lock()
+	s.channels[channelID] = ch
+	s.mu.Unlock()
+}
+
+func (s *e2eSession) unregister(channelID uuid.UUID) {
+	s.mu.Lock()
+	delete(s.channels, channelID)
+	s.mu.Unlock()
+}
+
+func (s *e2eSession) channel(channelID uuid.UUID) *e2eChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channels[channelID]
+}
+
+// accepted reports whether an encrypted channel requested by the peer was accepted
+func (s *e2eSession) accepted(channelID uuid.UUID) bool {
+	return s.channel(channelID) != nil
+}
+
+// cipher returns the AES-256-GCM cipher of one direction of a channel
+func (s *e2eSession) cipher(channelID uuid.UUID, nonce []byte, direction string) cipher.AEAD {
+	info := append([]byte(direction), channelID[:]...)
+	info = append(info, nonce...)
+	// Neither call fails with a 32 bytes key and the standard nonce size
+	block, _ := aes.NewCipher(hkdfExpand(s.keys.prk, info, 32))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// e2eAdditionalData returns the metadata of a DataMessage authenticated with its data: the
+// channel, the protocol and the addresses of UDP datagrams
+func e2eAdditionalData(m DataMessage) []byte {
+	ad := make([]byte, 0, 64)
+	ad = append(ad, m.ChannelID[:]...)
+	ad = append(ad, protocolToBytes(m.Protocol))
+	if m.Protocol == "udp" {
+		ad = append(ad, byte(len(m.Address)))
+		ad = append(ad, m.Address...)
+		ad = append(ad, byte(m.Port>>8), byte(m.Port))
+		ad = append(ad, byte(len(m.TargetAddr)))
+		ad = append(ad, m.TargetAddr...)
+		ad = append(ad, byte(m.TargetPort>>8), byte(m.TargetPort))
+	}
+	return ad
+}
+
+// seal encrypts data as Seq(8) + Ciphertext(N) + Tag(16), the sequence number being the nonce
+func (c *e2eChannel) seal(ad, data []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sendSeq++
+	out := make([]byte, e2eSeqSize, e2eSeqSize+len(data)+c.send.Overhead())
+	binary.BigEndian.PutUint64(out, c.sendSeq)
+	return c.send.Seal(out, e2eNonce(c.sendSeq), data, ad)
+}
+
+// open decrypts data sealed by the peer, rejecting replayed sequence numbers
+func (c *e2eChannel) open(ad, data []byte) ([]byte, bool) {
+	if len(data) < e2eOverhead {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := binary.BigEndian.Uint64(data)
+	if seq <= c.recvSeq {
+		return nil, false
+	}
+	plain, err := c.recv.Open(nil, e2eNonce(seq), data[e2eSeqSize:], ad)
+	if err != nil {
+		return nil, false
+	}
+	c.recvSeq = seq
+	return plain, true
+}
+
+func e2eNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// hkdfExtract is the extract step of HKDF-SHA256 (RFC 5869)
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is the expand step of HKDF-SHA256 (RFC 5869)
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, t []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,108 @@
+package wssocks
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types published by the server
+const (
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventTokenAdded         = "token_added"
+	EventTokenRemoved       = "token_removed"
+	EventConnectorAdded     = "connector_added"
+	EventChannelOpened      = "channel_opened"
+	EventChannelClosed      = "channel_closed"
+	EventAuthFailed         = "auth_failed"
+)
+
+// eventBufferSize is the number of events a subscriber can lag behind before missing some
+const eventBufferSize = 256
+
+// Event describes something that happened on the server
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Token     string    `json:"token,omitempty"`      // Token concerned, not set for auth failures with unknown tokens
+	ClientID  string    `json:"client_id,omitempty"`  // Client concerned
+	ChannelID string    `json:"channel_id,omitempty"` // Channel opened or closed
+	IP        string    `json:"ip,omitempty"`         // Client IP
+	Detail    string    `json:"detail,omitempty"`     // Client or token type, channel target, or auth error
+}
+
+// eventHub delivers events to subscribers
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	channels    sync.Map // map[uuid.UUID]struct{} of the channels reported open
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan Event]struct{})}
+}
+
+// publish sends an event to all subscribers, those not keeping up miss it
+func (h *eventHub) publish(event Event) {
+	event.Time = time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events of the server and a function ending the
+// subscription. Events are dropped if the receiver does not keep up.
+func (s *WSSocksServer) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	s.events.mu.Lock()
+	s.events.subscribers[ch] = struct{}{}
+	s.events.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			delete(s.events.subscribers, ch)
+			s.events.mu.Unlock()
+		})
+	}
+}
+
+// channelEvents returns the hook of a client connection publishing its channels opening and
+// closing. Channels relayed between a connector and a provider are reported once.
+func (s *WSSocksServer) channelEvents(token string, clientID uuid.UUID) func(ConnChannel, bool) {
+	return func(channel ConnChannel, opened bool) {
+		event := Event{
+			Token:     token,
+			ClientID:  clientID.String(),
+			ChannelID: channel.ID.String(),
+		}
+		if opened {
+			if _, loaded := s.events.channels.LoadOrStore(channel.ID, struct{}{}); loaded {
+				return
+			}
+			event.Type = EventChannelOpened
+			event.Detail = channel.Protocol
+			if channel.Address != "" {
+				event.Detail += " " + net.JoinHostPort(channel.Address, strconv.Itoa(channel.Port))
+			}
+		} else {
+			if _, loaded := s.events.channels.LoadAndDelete(channel.ID); !loaded {
+				return
+			}
+			event.Type = EventChannelClosed
+		}
+		s.events.publish(event)
+	}
+}
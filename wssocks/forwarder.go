@@ -110,7 +110,7 @@ func (s *DynamicForwarder) ProcessReads(conn io.Reader) {
 				Protocol:    s.protocol,
 				ChannelID:   s.channelID,
 				Data:        dataToSend,
-				Compression: s.relay.determineCompression(sentBytes),
+				Compression: s.relay.determineCompression(s.ws, dataToSend),
 			}
 			s.relay.logMessage(msg, "send", s.ws.Label())
 			if err := s.ws.WriteMessage(msg); err != nil {
@@ -291,7 +291,7 @@ func (s *DynamicForwarder) processReadsImmediate(conn io.Reader, buffer []byte)
 			Protocol:    s.protocol,
 			ChannelID:   s.channelID,
 			Data:        data,
-			Compression: s.relay.determineCompression(n),
+			Compression: s.relay.determineCompression(s.ws, data),
 		}
 
 		s.relay.logMessage(msg, "send", s.ws.Label())
@@ -308,10 +308,10 @@ func (s *DynamicForwarder) processReadsImmediate(conn io.Reader, buffer []byte)
 }
 
 // ProcessUDPReads handles reading from a UDP connection with appropriate metadata
-func (s *DynamicForwarder) ProcessUDPReads(conn *net.UDPConn) {
+func (s *DynamicForwarder) ProcessUDPReads(conn net.PacketConn) {
 	buffer := make([]byte, s.bufferSize)
 	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		n, remoteAddr, err := conn.ReadFrom(buffer)
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok {
 				if opErr.Err.Error() == "use of closed network connection" {
@@ -337,13 +337,14 @@ func (s *DynamicForwarder) ProcessUDPReads(conn *net.UDPConn) {
 		// Update activity time
 		s.relay.updateActivityTime(s.channelID)
 
+		remoteHost, remotePort := splitAddr(remoteAddr)
 		msg := DataMessage{
 			Protocol:    s.protocol,
 			ChannelID:   s.channelID,
 			Data:        buffer[:n],
-			Address:     remoteAddr.IP.String(),
-			Port:        remoteAddr.Port,
-			Compression: s.relay.determineCompression(n),
+			Address:     remoteHost,
+			Port:        remotePort,
+			Compression: s.relay.determineCompression(s.ws, buffer[:n]),
 		}
 		s.relay.logMessage(msg, "send", s.ws.Label())
 		if err := s.ws.WriteMessage(msg); err != nil {
@@ -0,0 +1,174 @@
+package wssocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// Maximum size of a frame, matching the WebSocket read limit
+	maxFrameSize = 32 * 1024 * 1024
+	// Buffers grown beyond this size are left to the garbage collector instead of being reused
+	maxPooledBufferSize = 256 * 1024
+)
+
+// bufferPool holds the buffers used to pack messages and compress data
+var bufferPool = sync.Pool{New: func() any {
+	buf := make([]byte, 0, 16*1024)
+	return &buf
+}}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+// FrameWriter writes messages to a byte stream, each one as a frame prefixed by its length:
+//
+//	Length(4) + Message(N)
+type FrameWriter struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewFrameWriter returns a FrameWriter writing to w, it is safe for concurrent use
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteMessage writes a message as a single frame with one write to the underlying stream
+func (w *FrameWriter) WriteMessage(msg BaseMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, err := AppendMessage(append(w.buf[:0], 0, 0, 0, 0), msg)
+	if err != nil {
+		return err
+	}
+	return w.write(buf)
+}
+
+// WriteFrame writes an already packed message as a single frame
+func (w *FrameWriter) WriteFrame(frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(append(append(w.buf[:0], 0, 0, 0, 0), frame...))
+}
+
+// write fills in the length prefix of buf and writes it
+func (w *FrameWriter) write(buf []byte) error {
+	if len(buf)-4 > maxFrameSize {
+		return fmt.Errorf("frame exceeds %d bytes", maxFrameSize)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	if cap(buf) <= maxPooledBufferSize {
+		w.buf = buf
+	}
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// FrameReader reads the frames written by a FrameWriter from a byte stream
+type FrameReader struct {
+	r      *bufio.Reader
+	header [4]byte // Length prefix of the frame being read, kept here so it does not escape
+}
+
+// NewFrameReader returns a FrameReader reading from r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// ReadFrame returns the next frame without its length prefix, io.EOF if the stream ended
+// between frames and io.ErrUnexpectedEOF if it ended within one. The frame is a new buffer
+// the caller keeps, see ReadPooledFrame to reuse buffers.
+func (r *FrameReader) ReadFrame() ([]byte, error) {
+	size, err := r.readSize()
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, size)
+	if err := r.readBody(frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Frame is a frame read into a pooled buffer by ReadPooledFrame
+type Frame struct {
+	Data []byte
+}
+
+var framePool = sync.Pool{New: func() any { return new(Frame) }}
+
+// ReadPooledFrame is ReadFrame reading into a pooled buffer, which is given back with Release.
+// Messages parsed from the frame reference its data, so neither may be used after Release.
+// Connections keep the messages they read in channel queues and use ReadFrame instead.
+func (r *FrameReader) ReadPooledFrame() (*Frame, error) {
+	size, err := r.readSize()
+	if err != nil {
+		return nil, err
+	}
+	f := framePool.Get().(*Frame)
+	if cap(f.Data) < int(size) {
+		f.Data = make([]byte, size)
+	}
+	f.Data = f.Data[:size]
+	if err := r.readBody(f.Data); err != nil {
+		f.Release()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Release gives the buffer of the frame back to the pool
+func (f *Frame) Release() {
+	if cap(f.Data) > maxPooledBufferSize {
+		f.Data = nil
+	}
+	framePool.Put(f)
+}
+
+// readSize reads the length prefix of the next frame
+func (r *FrameReader) readSize() (uint32, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(r.header[:])
+	if size > maxFrameSize {
+		return 0, fmt.Errorf("frame exceeds %d bytes", maxFrameSize)
+	}
+	return size, nil
+}
+
+// readBody reads the content of a frame into frame
+func (r *FrameReader) readBody(frame []byte) error {
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadMessage reads and parses the next frame
+func (r *FrameReader) ReadMessage() (BaseMessage, error) {
+	frame, err := r.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(frame)
+}
@@ -0,0 +1,147 @@
+package wssocks
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	tokenSweepInterval = time.Second
+	tokenExpiryWarning = time.Minute // Clients are warned this long before their token expires
+)
+
+// TokenLimits restricts the use of a token, zero values are unlimited
+type TokenLimits struct {
+	ExpiresAt  time.Time // Token is removed once expired
+	MaxClients int       // Connections of clients using the token at the same time
+	MaxBytes   int64     // Bytes sent and received by the clients of the token before it is removed
+}
+
+// limited reports whether any limit is set
+func (l TokenLimits) limited() bool {
+	return !l.ExpiresAt.IsZero() || l.MaxClients > 0 || l.MaxBytes > 0
+}
+
+// setTokenLimits sets the limits of a token, must be called with the server lock held
+func (s *WSSocksServer) setTokenLimits(token string, limits TokenLimits) {
+	if !limits.limited() {
+		delete(s.tokenLimits, token)
+		return
+	}
+	if current, exists := s.tokenLimits[token]; !exists || !current.ExpiresAt.Equal(limits.ExpiresAt) {
+		delete(s.tokenWarned, token)
+	}
+	s.tokenLimits[token] = limits
+}
+
+// removeTokenLimits forgets the limits and usage of a token, must be called with the server
+// lock held
+func (s *WSSocksServer) removeTokenLimits(token string) {
+	delete(s.tokenLimits, token)
+	delete(s.tokenBytes, token)
+	delete(s.tokenWarned, token)
+}
+
+// tokenUsage returns the clients connected with a token and the bytes they transferred, including
+// the clients already disconnected, must be called with the server lock held
+func (s *WSSocksServer) tokenUsage(token string) (int, int64) {
+	clients := 0
+	bytes := s.tokenBytes[token]
+	for _, infos := range s.tokenClients {
+		for _, client := range infos {
+			if client.Token == token {
+				clients++
+				bytes += int64(client.Conn.BytesSent() + client.Conn.BytesReceived())
+			}
+		}
+	}
+	return clients, bytes
+}
+
+// checkTokenLimits returns why a new client of a token is refused, empty if it is accepted, must
+// be called with the server lock held until the client is registered
+func (s *WSSocksServer) checkTokenLimits(token string) string {
+	limits, exists := s.tokenLimits[token]
+	if !exists {
+		return ""
+	}
+	clients, bytes := s.tokenUsage(token)
+	switch {
+	case !limits.ExpiresAt.IsZero() && !time.Now().Before(limits.ExpiresAt):
+		return "token expired"
+	case limits.MaxBytes > 0 && bytes >= limits.MaxBytes:
+		return "token byte limit exceeded"
+	case limits.MaxClients > 0 && clients >= limits.MaxClients:
+		return "too many clients for token"
+	}
+	return ""
+}
+
+// sweepTokens removes the tokens that expired or exceeded their byte limit until ctx is done,
+// warning their clients before expiry
+func (s *WSSocksServer) sweepTokens(ctx context.Context) {
+	ticker := time.NewTicker(tokenSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var expired, expiring []string
+
+		// Scan without blocking authentication, the write lock is only taken to warn
+		s.mu.RLock()
+		for token, limits := range s.tokenLimits {
+			_, bytes := s.tokenUsage(token)
+			if (!limits.ExpiresAt.IsZero() && !now.Before(limits.ExpiresAt)) || (limits.MaxBytes > 0 && bytes >= limits.MaxBytes) {
+				expired = append(expired, token)
+				continue
+			}
+			if limits.ExpiresAt.IsZero() || limits.ExpiresAt.Sub(now) > tokenExpiryWarning || s.tokenWarned[token] {
+				continue
+			}
+			expiring = append(expiring, token)
+		}
+		s.mu.RUnlock()
+
+		warnings := make(map[*WSConn]LogMessage)
+		if len(expiring) > 0 {
+			s.mu.Lock()
+			for _, token := range expiring {
+				limits, exists := s.tokenLimits[token]
+				if !exists || s.tokenWarned[token] {
+					continue
+				}
+				s.tokenWarned[token] = true
+				msg := LogMessage{
+					Level: LogLevelWarn,
+					Msg:   fmt.Sprintf("Token expires in %s, the connection will be closed", limits.ExpiresAt.Sub(now).Round(time.Second)),
+				}
+				for _, infos := range s.tokenClients {
+					for _, client := range infos {
+						if client.Token == token {
+							warnings[client.Conn] = msg
+						}
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+
+		for ws, msg := range warnings {
+			s.relay.logMessage(msg, "send", ws.Label())
+			if err := ws.WriteMessage(msg); err != nil {
+				s.log.Debug().Err(err).Msg("Failed to send token expiry warning")
+			}
+		}
+		for _, token := range expired {
+			s.log.Info().Str("token", token).Msg("Token expired or exceeded its byte limit")
+			s.RemoveToken(token)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package wssocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenListener is a net.Listener yielding the connections requested by clients of a token
+type tokenListener struct {
+	server    *WSSocksServer
+	token     string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen returns a listener accepting the TCP connections requested through the given token,
+// so they can be handled by the application instead of the server dialing the requested
+// targets. For a forward token these are the connections requested by its clients, for a
+// reverse token the connections requested by its connectors from the networks of the
+// providers, which are then not routed to a provider. The LocalAddr of an accepted connection
+// is the requested target and its RemoteAddr is the address of the requesting client. UDP
+// requests of the token are refused while the listener is open. Closing the listener restores
+// the default behaviour.
+func (s *WSSocksServer) Listen(token string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.forwardTokens[token]; !ok && !s.isReverseToken(token) {
+		return nil, fmt.Errorf("token does not exist")
+	}
+	if _, exists := s.listeners[token]; exists {
+		return nil, fmt.Errorf("token is already being listened on")
+	}
+
+	l := &tokenListener{
+		server: s,
+		token:  token,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	s.listeners[token] = l
+	return l, nil
+}
+
+// Accept waits for and returns the next connection requested by a client
+func (l *tokenListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, already accepted connections are not affected
+func (l *tokenListener) Close() error {
+	l.server.mu.Lock()
+	if l.server.listeners[l.token] == l {
+		delete(l.server.listeners, l.token)
+	}
+	l.server.mu.Unlock()
+
+	l.shutdown()
+	return nil
+}
+
+func (l *tokenListener) shutdown() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+func (l *tokenListener) Addr() net.Addr {
+	return channelAddr{network: "wssocks", address: "listener"}
+}
+
+// listenerOf returns the listener of a token, if any
+func (s *WSSocksServer) listenerOf(token string) *tokenListener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listeners[token]
+}
+
+// handleListenerConnect hands a connect request of a client over to a listener
+func (s *WSSocksServer) handleListenerConnect(ctx context.Context, ws *WSConn, request ConnectMessage, l *tokenListener) error {
+	if request.Protocol != "tcp" {
+		return s.refuseConnect(ws, request, "protocol not supported by listener")
+	}
+	if request.Encrypted {
+		return s.refuseConnect(ws, request, e2eRefusedReason)
+	}
+
+	local, remote := net.Pipe()
+	conn := &channelConn{
+		Conn:   local,
+		local:  channelAddr{network: "tcp", address: net.JoinHostPort(request.Address, strconv.Itoa(request.Port))},
+		remote: channelAddr{network: "wssocks", address: ws.GetClientIP()},
+	}
+
+	timer := time.NewTimer(s.relay.option.ConnectTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		return s.refuseConnect(ws, request, "listener closed")
+	case <-timer.C:
+		return s.refuseConnect(ws, request, "listener accept timeout")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.log.Debug().Str("address", request.Address).Int("port", request.Port).Msg("Connection handed over to listener")
+	return s.relay.ServeTCPConnection(ctx, ws, request, remote)
+}
+
+// refuseConnect answers a connect request with a failure response
+func (s *WSSocksServer) refuseConnect(ws *WSConn, request ConnectMessage, reason string) error {
+	return s.relay.refuseConnect(ws, request, reason)
+}
@@ -0,0 +1,220 @@
+package wssocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// LZ4 block format, see https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+// The compressed data is the size of the original data as a little endian uint32 followed by
+// a single LZ4 block, which is much faster than deflate at the cost of a lower ratio.
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // The last bytes of a block are always literals
+	lz4MatchLimit   = 12 // A match cannot start in the last bytes of a block
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 12
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+type lz4Compressor struct{}
+
+func (c lz4Compressor) Compress(data []byte) ([]byte, error) {
+	return c.AppendCompress(nil, data)
+}
+
+func (lz4Compressor) AppendCompress(dst, data []byte) ([]byte, error) {
+	if uint64(len(data)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("lz4 compression failed: data too large")
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	return lz4CompressBlock(dst, data), nil
+}
+
+func (lz4Compressor) Decompress(data []byte, limit int) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("lz4 decompression failed: %w", errLZ4Corrupt)
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > uint64(limit) {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", limit)
+	}
+	// Bound the allocation by the best ratio LZ4 can reach
+	if uint64(size) > uint64(len(data))*256 {
+		return nil, fmt.Errorf("lz4 decompression failed: %w", errLZ4Corrupt)
+	}
+	decompressed, err := lz4DecompressBlock(data[4:], int(size))
+	if err != nil {
+		return nil, fmt.Errorf("lz4 decompression failed: %w", err)
+	}
+	return decompressed, nil
+}
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4CompressBlock appends src compressed as an LZ4 block to dst
+func lz4CompressBlock(dst, src []byte) []byte {
+	// Positions of the last occurrences of hashed sequences, plus one so zero means none
+	var table [1 << lz4HashLog]int32
+
+	anchor := 0
+	if len(src) > lz4MatchLimit {
+		limit := len(src) - lz4MatchLimit
+		matchEnd := len(src) - lz4LastLiterals
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := lz4Hash(seq)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				// Skip faster through data without matches
+				i += 1 + (i-anchor)>>6
+				continue
+			}
+
+			// Extend the match backwards over pending literals, then forwards
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+			length := lz4MinMatch
+			for i+length < matchEnd && src[i+length] == src[ref+length] {
+				length++
+			}
+
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, length)
+			i += length
+			anchor = i
+		}
+	}
+
+	// Last sequence, literals only
+	literals := src[anchor:]
+	if len(literals) < 15 {
+		dst = append(dst, byte(len(literals))<<4)
+	} else {
+		dst = append(dst, 0xF0)
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	return append(dst, literals...)
+}
+
+// lz4AppendSequence appends literals followed by a match of length bytes at offset
+func lz4AppendSequence(dst, literals []byte, offset, length int) []byte {
+	length -= lz4MinMatch
+
+	var token byte
+	if len(literals) < 15 {
+		token = byte(len(literals)) << 4
+	} else {
+		token = 0xF0
+	}
+	if length < 15 {
+		token |= byte(length)
+	} else {
+		token |= 0x0F
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if length >= 15 {
+		dst = lz4AppendLength(dst, length-15)
+	}
+	return dst
+}
+
+// lz4AppendLength appends the remainder of a length not fitting in its token
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// lz4ReadLength reads the remainder of a length from src at i, returning the new position
+func lz4ReadLength(src []byte, i, n int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, errLZ4Corrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return i, n, nil
+		}
+	}
+}
+
+// lz4DecompressBlock returns the data of an LZ4 block, which must be size bytes long
+func lz4DecompressBlock(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	i := 0
+	var err error
+	for {
+		if i >= len(src) {
+			return nil, errLZ4Corrupt
+		}
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			if i, literals, err = lz4ReadLength(src, i, literals); err != nil {
+				return nil, err
+			}
+		}
+		if literals > len(src)-i || literals > size-len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errLZ4Corrupt
+		}
+
+		length := int(token & 0x0F)
+		if length == 15 {
+			if i, length, err = lz4ReadLength(src, i, length); err != nil {
+				return nil, err
+			}
+		}
+		length += lz4MinMatch
+		if length > size-len(dst) {
+			return nil, errLZ4Corrupt
+		}
+
+		// Matches may overlap the data they produce
+		start := len(dst) - offset
+		if offset >= length {
+			dst = append(dst, dst[start:start+length]...)
+		} else {
+			for k := 0; k < length; k++ {
+				dst = append(dst, dst[start+k])
+			}
+		}
+	}
+
+	if len(dst) != size {
+		return nil, errLZ4Corrupt
+	}
+	return dst, nil
+}
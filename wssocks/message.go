@@ -1,12 +1,10 @@
 package wssocks
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/hex"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"io"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -18,13 +16,21 @@ All messages start with:
     Version(1) + Type(1)
 
 AuthMessage:
-    Version(1) + Type(1) + TokenLen(1) + Token(N) + Reverse(1) + Instance(16)
+    Version(1) + Type(1) + TokenLen(1) + Token(N) + Reverse(1) + Instance(16) +
+    CompressionCount(1) + Compressions(N) + MinVersion(1) + MaxVersion(1) + Capabilities(4)
 
 AuthResponseMessage:
-    Version(1) + Type(1) + Success(1) + [ErrorLen(1) + Error(N) if !Success]
+    Version(1) + Type(1) + Success(1) + [ErrorLen(1) + Error(N) if !Success] +
+    [Compression(1) + Version(1) + Capabilities(4) if Success]
+
+Fields after the Instance of AuthMessage and after the Success of AuthResponseMessage are
+missing when sent by older peers, which are then assumed to only support gzip compression,
+protocol version 1 and no capabilities.
 
 ConnectMessage:
-    Version(1) + Type(1) + Protocol(1) + ChannelID(16) + [AddrLen(1) + Addr(N) + Port(2) if TCP]
+    Version(1) + Type(1) + Protocol(1) + ChannelID(16) + [AddrLen(1) + Addr(N) + Port(2) if TCP] +
+    [E2ENonce(16) + E2ETag(16) if encrypted] + [StreamID(varint) if compact frames are negotiated]
+    The Protocol has the BinaryProtocolEncrypted bit set for end-to-end encrypted channels.
 
 ConnectResponseMessage:
     Version(1) + Type(1) + Success(1) + ChannelID(16) + [ErrorLen(1) + Error(N) if !Success]
@@ -33,6 +39,10 @@ DataMessage:
     Version(1) + Type(1) + Protocol(1) + ChannelID(16) + Compression(1) + DataLen(4) + Data(N) +
     [if UDP: AddrLen(1) + Addr(N) + Port(2) + TargetAddrLen(1) + TargetAddr(N) + TargetPort(2)]
 
+CompactDataMessage (DataMessage of a channel with a stream ID):
+    Version(1) + Type(1) + Protocol(1) + StreamID(varint) + Compression(1) + DataLen(varint) + Data(N) +
+    [if UDP: AddrLen(1) + Addr(N) + Port(2) + TargetAddrLen(1) + TargetAddr(N) + TargetPort(2)]
+
 DisconnectMessage:
     Version(1) + Type(1) + ChannelID(16)
 
@@ -49,8 +59,9 @@ ServerMessage:
 */
 
 const (
-	// Protocol version
-	ProtocolVersion = byte(0x01)
+	// Highest and lowest supported protocol versions
+	ProtocolVersion    = byte(0x01)
+	MinProtocolVersion = byte(0x01)
 
 	// Binary message types
 	BinaryTypeAuth              = byte(0x01)
@@ -63,10 +74,13 @@ const (
 	BinaryTypeConnectorResponse = byte(0x08)
 	BinaryTypeLog               = byte(0x09)
 	BinaryTypePartners          = byte(0x0A)
+	BinaryTypeCompactData       = byte(0x0B)
 
 	// Protocol types
 	BinaryProtocolTCP = byte(0x01)
 	BinaryProtocolUDP = byte(0x02)
+	// Flag set on the protocol of ConnectMessages opening end-to-end encrypted channels
+	BinaryProtocolEncrypted = byte(0x80)
 
 	// Binary connector operations
 	BinaryConnectorOperationAdd    = byte(0x01)
@@ -85,10 +99,61 @@ const (
 	TypePartners          = "partners"
 
 	// Compression flags
-	DataCompressionNone = byte(0x00)
-	DataCompressionGzip = byte(0x01)
+	DataCompressionNone    = byte(0x00)
+	DataCompressionGzip    = byte(0x01)
+	DataCompressionDeflate = byte(0x02)
+	DataCompressionLZ4     = byte(0x03)
+)
+
+// Capability is a bitmap of optional protocol features, exchanged during authentication so
+// that a feature is only used when both peers support it
+type Capability uint32
+
+const (
+	// CapabilityCompression means compressions other than gzip are negotiated
+	CapabilityCompression Capability = 1 << iota
+	// CapabilityCompactFrames means channels get short stream IDs used by compact data frames
+	CapabilityCompactFrames
 )
 
+// LocalCapabilities are the capabilities supported by this implementation
+const LocalCapabilities = CapabilityCompression | CapabilityCompactFrames
+
+// Has reports whether all capabilities of c2 are set in c
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+// negotiateVersion returns the highest protocol version within the range supported by a peer
+func negotiateVersion(minVersion, maxVersion byte) (byte, bool) {
+	version := ProtocolVersion
+	if maxVersion < version {
+		version = maxVersion
+	}
+	if version < minVersion || version < MinProtocolVersion {
+		return 0, false
+	}
+	return version, true
+}
+
+// parseVersionRange parses a "min-max" protocol version range or a single version, falling
+// back to the first version if it is invalid
+func parseVersionRange(versions string) (byte, byte) {
+	minStr, maxStr, found := strings.Cut(versions, "-")
+	if !found {
+		maxStr = minStr
+	}
+	minVersion, err := strconv.ParseUint(minStr, 10, 8)
+	if err != nil {
+		return MinProtocolVersion, MinProtocolVersion
+	}
+	maxVersion, err := strconv.ParseUint(maxStr, 10, 8)
+	if err != nil {
+		return MinProtocolVersion, MinProtocolVersion
+	}
+	return byte(minVersion), byte(maxVersion)
+}
+
 // BaseMessage defines the common interface for all message types
 type BaseMessage interface {
 	GetType() string
@@ -96,9 +161,13 @@ type BaseMessage interface {
 
 // AuthMessage represents an authentication request
 type AuthMessage struct {
-	Token    string    `json:"token"`
-	Reverse  bool      `json:"reverse"`
-	Instance uuid.UUID `json:"instance"`
+	Token        string     `json:"token"`
+	Reverse      bool       `json:"reverse"`
+	Instance     uuid.UUID  `json:"instance"`
+	Compressions []byte     `json:"compressions,omitempty"` // Accepted compressions in preference order
+	MinVersion   byte       `json:"min_version,omitempty"`
+	MaxVersion   byte       `json:"max_version,omitempty"`
+	Capabilities Capability `json:"capabilities,omitempty"`
 }
 
 func (m AuthMessage) GetType() string {
@@ -107,8 +176,11 @@ func (m AuthMessage) GetType() string {
 
 // AuthResponseMessage represents an authentication response
 type AuthResponseMessage struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success      bool       `json:"success"`
+	Error        string     `json:"error,omitempty"`
+	Compression  byte       `json:"compression,omitempty"`  // Compression selected for the connection
+	Version      byte       `json:"version,omitempty"`      // Protocol version selected for the connection
+	Capabilities Capability `json:"capabilities,omitempty"` // Capabilities supported by both peers
 }
 
 func (m AuthResponseMessage) GetType() string {
@@ -121,6 +193,10 @@ type ConnectMessage struct {
 	Address   string    `json:"address,omitempty"`
 	Port      int       `json:"port,omitempty"`
 	ChannelID uuid.UUID `json:"channel_id"`
+	StreamID  uint64    `json:"stream_id,omitempty"` // Short ID for compact data frames, 0 if unused
+	Encrypted bool      `json:"encrypted,omitempty"` // Data is encrypted between connector and provider
+	E2ENonce  []byte    `json:"e2e_nonce,omitempty"` // Nonce of the connector for the keys of an encrypted channel
+	E2ETag    []byte    `json:"e2e_tag,omitempty"`   // Tag authenticating the target and nonce of an encrypted channel
 }
 
 func (m ConnectMessage) GetType() string {
@@ -148,6 +224,7 @@ type DataMessage struct {
 	Port        int       `json:"port,omitempty"`
 	TargetAddr  string    `json:"target_addr,omitempty"`
 	TargetPort  int       `json:"target_port,omitempty"`
+	StreamID    uint64    `json:"stream_id,omitempty"` // Sent as a compact frame if not 0
 }
 
 func (m DataMessage) GetType() string {
@@ -237,25 +314,6 @@ func bytesToProtocol(b byte) string {
 	}
 }
 
-func uuidToBytes(uuid string) ([]byte, error) {
-	// Remove hyphens from UUID string
-	uuid = strings.ReplaceAll(uuid, "-", "")
-	if len(uuid) != 32 {
-		return nil, fmt.Errorf("invalid UUID length")
-	}
-	return hex.DecodeString(uuid)
-}
-
-func bytesToUUID(b []byte) string {
-	if len(b) != 16 {
-		return ""
-	}
-	uuid := hex.EncodeToString(b)
-	// Insert hyphens to make standard UUID format
-	return fmt.Sprintf("%s-%s-%s-%s-%s",
-		uuid[0:8], uuid[8:12], uuid[12:16], uuid[16:20], uuid[20:])
-}
-
 func boolToByte(b bool) byte {
 	if b {
 		return 1
@@ -292,20 +350,26 @@ func bytesToOperation(b byte) string {
 
 // PackMessage converts a message to binary format
 func PackMessage(msg BaseMessage) ([]byte, error) {
+	return AppendMessage(nil, msg)
+}
+
+// AppendMessage appends the binary format of a message to buf and returns the extended buffer,
+// so frames can be packed into reused buffers without allocating
+func AppendMessage(buf []byte, msg BaseMessage) ([]byte, error) {
 	// Start with version
-	buf := []byte{ProtocolVersion}
+	buf = append(buf, ProtocolVersion)
 
 	switch m := msg.(type) {
 	case AuthMessage:
 		buf = append(buf, BinaryTypeAuth)
 		buf = append(buf, byte(len(m.Token)))
-		buf = append(buf, []byte(m.Token)...)
+		buf = append(buf, m.Token...)
 		buf = append(buf, boolToByte(m.Reverse))
-		instanceID, err := uuidToBytes(m.Instance.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid Instance: %w", err)
-		}
-		buf = append(buf, instanceID...)
+		buf = append(buf, m.Instance[:]...)
+		buf = append(buf, byte(len(m.Compressions)))
+		buf = append(buf, m.Compressions...)
+		buf = append(buf, m.MinVersion, m.MaxVersion)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(m.Capabilities))
 		return buf, nil
 
 	case AuthResponseMessage:
@@ -313,112 +377,115 @@ func PackMessage(msg BaseMessage) ([]byte, error) {
 		buf = append(buf, boolToByte(m.Success))
 		if !m.Success {
 			buf = append(buf, byte(len(m.Error)))
-			buf = append(buf, []byte(m.Error)...)
+			buf = append(buf, m.Error...)
+		} else {
+			buf = append(buf, m.Compression, m.Version)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(m.Capabilities))
 		}
 		return buf, nil
 
 	case ConnectMessage:
 		buf = append(buf, BinaryTypeConnect)
-		buf = append(buf, protocolToBytes(m.Protocol))
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
+		protocol := protocolToBytes(m.Protocol)
+		if m.Encrypted {
+			protocol |= BinaryProtocolEncrypted
 		}
-		buf = append(buf, channelID...)
+		buf = append(buf, protocol)
+		buf = append(buf, m.ChannelID[:]...)
 		if m.Protocol == "tcp" {
 			buf = append(buf, byte(len(m.Address)))
-			buf = append(buf, []byte(m.Address)...)
+			buf = append(buf, m.Address...)
 			buf = append(buf, byte(m.Port>>8), byte(m.Port))
 		}
+		if m.Encrypted {
+			if len(m.E2ENonce) != e2eNonceSize || len(m.E2ETag) != e2eTagSize {
+				return nil, fmt.Errorf("invalid encrypted connect message nonce or tag")
+			}
+			buf = append(buf, m.E2ENonce...)
+			buf = append(buf, m.E2ETag...)
+		}
+		if m.StreamID != 0 {
+			buf = binary.AppendUvarint(buf, m.StreamID)
+		}
 		return buf, nil
 
 	case ConnectResponseMessage:
 		buf = append(buf, BinaryTypeConnectResponse)
 		buf = append(buf, boolToByte(m.Success))
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
-		}
-		buf = append(buf, channelID...)
+		buf = append(buf, m.ChannelID[:]...)
 		if !m.Success {
 			buf = append(buf, byte(len(m.Error)))
-			buf = append(buf, []byte(m.Error)...)
+			buf = append(buf, m.Error...)
 		}
 		return buf, nil
 
 	case DataMessage:
-		buf = append(buf, BinaryTypeData)
-		buf = append(buf, protocolToBytes(m.Protocol))
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
-		}
-		buf = append(buf, channelID...)
-
-		// Handle compression
-		compressedData := m.Data
+		// Handle compression, sending the data as is if it does not shrink
+		data := m.Data
 		compression := m.Compression
-		if compression == DataCompressionGzip {
-			var b bytes.Buffer
-			w := gzip.NewWriter(&b)
-			if _, err := w.Write(m.Data); err != nil {
-				return nil, fmt.Errorf("gzip compression failed: %w", err)
+		if compression != DataCompressionNone {
+			scratch := getBuffer()
+			defer putBuffer(scratch)
+			compressed, err := compressData(compression, (*scratch)[:0], m.Data)
+			if err != nil {
+				return nil, err
 			}
-			if err := w.Close(); err != nil {
-				return nil, fmt.Errorf("gzip close failed: %w", err)
+			*scratch = compressed
+			if len(compressed) < len(m.Data) {
+				data = compressed
+			} else {
+				compression = DataCompressionNone
 			}
-			compressedData = b.Bytes()
 		}
 
-		buf = append(buf, compression)
-		dataLen := uint32(len(compressedData))
-		buf = append(buf, byte(dataLen>>24), byte(dataLen>>16), byte(dataLen>>8), byte(dataLen))
-		buf = append(buf, compressedData...)
+		if m.StreamID != 0 {
+			// Compact frame for channels with a stream ID
+			buf = append(buf, BinaryTypeCompactData)
+			buf = append(buf, protocolToBytes(m.Protocol))
+			buf = binary.AppendUvarint(buf, m.StreamID)
+			buf = append(buf, compression)
+			buf = binary.AppendUvarint(buf, uint64(len(data)))
+		} else {
+			buf = append(buf, BinaryTypeData)
+			buf = append(buf, protocolToBytes(m.Protocol))
+			buf = append(buf, m.ChannelID[:]...)
+			buf = append(buf, compression)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+		}
+		buf = append(buf, data...)
 		if m.Protocol == "udp" {
 			buf = append(buf, byte(len(m.Address)))
-			buf = append(buf, []byte(m.Address)...)
+			buf = append(buf, m.Address...)
 			buf = append(buf, byte(m.Port>>8), byte(m.Port))
 			buf = append(buf, byte(len(m.TargetAddr)))
-			buf = append(buf, []byte(m.TargetAddr)...)
+			buf = append(buf, m.TargetAddr...)
 			buf = append(buf, byte(m.TargetPort>>8), byte(m.TargetPort))
 		}
 		return buf, nil
 
 	case DisconnectMessage:
 		buf = append(buf, BinaryTypeDisconnect)
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
-		}
-		buf = append(buf, channelID...)
+		buf = append(buf, m.ChannelID[:]...)
 		return buf, nil
 
 	case ConnectorMessage:
 		buf = append(buf, BinaryTypeConnector)
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
-		}
-		buf = append(buf, channelID...)
+		buf = append(buf, m.ChannelID[:]...)
 		buf = append(buf, byte(len(m.ConnectorToken)))
-		buf = append(buf, []byte(m.ConnectorToken)...)
+		buf = append(buf, m.ConnectorToken...)
 		buf = append(buf, operationToBytes(m.Operation))
 		return buf, nil
 
 	case ConnectorResponseMessage:
 		buf = append(buf, BinaryTypeConnectorResponse)
-		channelID, err := uuidToBytes(m.ChannelID.String())
-		if err != nil {
-			return nil, fmt.Errorf("invalid ChannelID: %w", err)
-		}
-		buf = append(buf, channelID...)
+		buf = append(buf, m.ChannelID[:]...)
 		buf = append(buf, boolToByte(m.Success))
 		if !m.Success {
 			buf = append(buf, byte(len(m.Error)))
-			buf = append(buf, []byte(m.Error)...)
+			buf = append(buf, m.Error...)
 		} else if m.ConnectorToken != "" {
 			buf = append(buf, byte(len(m.ConnectorToken)))
-			buf = append(buf, []byte(m.ConnectorToken)...)
+			buf = append(buf, m.ConnectorToken...)
 		}
 		return buf, nil
 
@@ -428,8 +495,7 @@ func PackMessage(msg BaseMessage) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal log message: %w", err)
 		}
-		dataLen := uint32(len(jsonData))
-		buf = append(buf, byte(dataLen>>24), byte(dataLen>>16), byte(dataLen>>8), byte(dataLen))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(jsonData)))
 		buf = append(buf, jsonData...)
 		return buf, nil
 
@@ -439,8 +505,7 @@ func PackMessage(msg BaseMessage) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal partners message: %w", err)
 		}
-		dataLen := uint32(len(jsonData))
-		buf = append(buf, byte(dataLen>>24), byte(dataLen>>16), byte(dataLen>>8), byte(dataLen))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(jsonData)))
 		buf = append(buf, jsonData...)
 		return buf, nil
 
@@ -456,7 +521,7 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 	}
 
 	version := data[0]
-	if version != ProtocolVersion {
+	if version < MinProtocolVersion || version > ProtocolVersion {
 		return nil, fmt.Errorf("unsupported protocol version: %d, data: %x", version, data)
 	}
 
@@ -474,15 +539,38 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		}
 		token := string(payload[1 : 1+tokenLen])
 		reverse := byteToBool(payload[1+tokenLen])
-		instance, err := uuid.Parse(bytesToUUID(payload[1+tokenLen+1 : 1+tokenLen+1+16]))
+		instance, err := uuid.FromBytes(payload[1+tokenLen+1 : 1+tokenLen+1+16])
 		if err != nil {
 			return nil, fmt.Errorf("invalid Instance: %w", err)
 		}
-		return AuthMessage{
+		msg := AuthMessage{
 			Token:    token,
 			Reverse:  reverse,
 			Instance: instance,
-		}, nil
+		}
+		payload = payload[1+tokenLen+1+16:]
+		if len(payload) == 0 {
+			// Older clients always accept gzip
+			msg.Compressions = []byte{DataCompressionGzip}
+		} else {
+			count := int(payload[0])
+			if len(payload) < 1+count {
+				return nil, fmt.Errorf("invalid auth message compressions")
+			}
+			msg.Compressions = append([]byte{}, payload[1:1+count]...)
+			payload = payload[1+count:]
+		}
+		if len(payload) == 0 {
+			// Older clients only speak the first version
+			msg.MinVersion, msg.MaxVersion = MinProtocolVersion, MinProtocolVersion
+		} else {
+			if len(payload) < 6 { // MinVersion(1) + MaxVersion(1) + Capabilities(4)
+				return nil, fmt.Errorf("invalid auth message versions")
+			}
+			msg.MinVersion, msg.MaxVersion = payload[0], payload[1]
+			msg.Capabilities = Capability(binary.BigEndian.Uint32(payload[2:6]))
+		}
+		return msg, nil
 
 	case BinaryTypeAuthResponse:
 		if len(payload) < 1 {
@@ -492,7 +580,21 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		msg := AuthResponseMessage{
 			Success: success,
 		}
-		if !success && len(payload) > 1 {
+		if success {
+			// Older servers always accept gzip and only speak the first version
+			msg.Compression = DataCompressionGzip
+			msg.Version = MinProtocolVersion
+			if len(payload) > 1 {
+				msg.Compression = payload[1]
+			}
+			if len(payload) > 2 {
+				if len(payload) < 7 { // Success(1) + Compression(1) + Version(1) + Capabilities(4)
+					return nil, fmt.Errorf("invalid auth response capabilities")
+				}
+				msg.Version = payload[2]
+				msg.Capabilities = Capability(binary.BigEndian.Uint32(payload[3:7]))
+			}
+		} else if len(payload) > 1 {
 			errorLen := int(payload[1])
 			if len(payload) < 2+errorLen {
 				return nil, fmt.Errorf("invalid auth response error length")
@@ -505,17 +607,18 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		if len(payload) < 17 { // Protocol(1) + ChannelID(16)
 			return nil, fmt.Errorf("invalid connect message")
 		}
-		protocol := bytesToProtocol(payload[0])
-		channelID, err := uuid.Parse(bytesToUUID(payload[1:17]))
+		protocol := bytesToProtocol(payload[0] &^ BinaryProtocolEncrypted)
+		channelID, err := uuid.FromBytes(payload[1:17])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
 		msg := ConnectMessage{
 			Protocol:  protocol,
 			ChannelID: channelID,
+			Encrypted: payload[0]&BinaryProtocolEncrypted != 0,
 		}
+		payload = payload[17:]
 		if protocol == "tcp" {
-			payload = payload[17:]
 			if len(payload) < 1 {
 				return nil, fmt.Errorf("invalid tcp connect message")
 			}
@@ -525,6 +628,22 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 			}
 			msg.Address = string(payload[1 : 1+addrLen])
 			msg.Port = int(uint16(payload[1+addrLen])<<8 | uint16(payload[1+addrLen+1]))
+			payload = payload[1+addrLen+2:]
+		}
+		if msg.Encrypted {
+			if len(payload) < e2eNonceSize+e2eTagSize {
+				return nil, fmt.Errorf("invalid encrypted connect message")
+			}
+			msg.E2ENonce = append([]byte(nil), payload[:e2eNonceSize]...)
+			msg.E2ETag = append([]byte(nil), payload[e2eNonceSize:e2eNonceSize+e2eTagSize]...)
+			payload = payload[e2eNonceSize+e2eTagSize:]
+		}
+		if len(payload) > 0 {
+			streamID, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid connect message stream ID")
+			}
+			msg.StreamID = streamID
 		}
 		return msg, nil
 
@@ -533,7 +652,7 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 			return nil, fmt.Errorf("invalid connect response message")
 		}
 		success := byteToBool(payload[0])
-		channelID, err := uuid.Parse(bytesToUUID(payload[1:17]))
+		channelID, err := uuid.FromBytes(payload[1:17])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
@@ -558,7 +677,7 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 			return nil, fmt.Errorf("invalid data message")
 		}
 		protocol := bytesToProtocol(payload[0])
-		channelID, err := uuid.Parse(bytesToUUID(payload[1:17]))
+		channelID, err := uuid.FromBytes(payload[1:17])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
@@ -568,57 +687,45 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 			return nil, fmt.Errorf("invalid data message length")
 		}
 
-		// Handle decompression
-		rawData := payload[22 : 22+dataLen]
-		var decompressedData []byte
-		if compression == DataCompressionGzip {
-			r, err := gzip.NewReader(bytes.NewReader(rawData))
-			if err != nil {
-				return nil, fmt.Errorf("gzip reader creation failed: %w", err)
-			}
-			decompressedData, err = io.ReadAll(r)
-			if err != nil {
-				return nil, fmt.Errorf("gzip decompression failed: %w", err)
-			}
-			if err := r.Close(); err != nil {
-				return nil, fmt.Errorf("gzip close failed: %w", err)
-			}
-		} else {
-			decompressedData = rawData
+		msg, err := parseDataPayload(protocol, compression, payload[22:22+dataLen], payload[22+int(dataLen):])
+		if err != nil {
+			return nil, err
 		}
+		msg.ChannelID = channelID
+		return msg, nil
 
-		msg := DataMessage{
-			Protocol:    protocol,
-			ChannelID:   channelID,
-			Compression: compression,
-			Data:        decompressedData,
+	case BinaryTypeCompactData:
+		if len(payload) < 1 { // Protocol(1)
+			return nil, fmt.Errorf("invalid compact data message")
 		}
-		if protocol == "udp" {
-			payload = payload[22+int(dataLen):]
-			if len(payload) < 1 {
-				return nil, fmt.Errorf("invalid udp data message")
-			}
-			addrLen := int(payload[0])
-			if len(payload) < 1+addrLen+2+1 {
-				return nil, fmt.Errorf("invalid udp data message length")
-			}
-			msg.Address = string(payload[1 : 1+addrLen])
-			msg.Port = int(uint16(payload[1+addrLen])<<8 | uint16(payload[1+addrLen+1]))
-			payload = payload[1+addrLen+2:]
-			targetAddrLen := int(payload[0])
-			if len(payload) < 1+targetAddrLen+2 {
-				return nil, fmt.Errorf("invalid udp data message target address")
-			}
-			msg.TargetAddr = string(payload[1 : 1+targetAddrLen])
-			msg.TargetPort = int(uint16(payload[1+targetAddrLen])<<8 | uint16(payload[1+targetAddrLen+1]))
+		protocol := bytesToProtocol(payload[0])
+		streamID, n := binary.Uvarint(payload[1:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid compact data message stream ID")
+		}
+		payload = payload[1+n:]
+		if len(payload) < 1 { // Compression(1)
+			return nil, fmt.Errorf("invalid compact data message")
+		}
+		compression := payload[0]
+		dataLen, n := binary.Uvarint(payload[1:])
+		if n <= 0 || dataLen > uint64(len(payload)-1-n) {
+			return nil, fmt.Errorf("invalid compact data message length")
+		}
+		payload = payload[1+n:]
+
+		msg, err := parseDataPayload(protocol, compression, payload[:dataLen], payload[dataLen:])
+		if err != nil {
+			return nil, err
 		}
+		msg.StreamID = streamID
 		return msg, nil
 
 	case BinaryTypeDisconnect:
 		if len(payload) < 16 { // ChannelID(16)
 			return nil, fmt.Errorf("invalid disconnect message")
 		}
-		channelID, err := uuid.Parse(bytesToUUID(payload[:16]))
+		channelID, err := uuid.FromBytes(payload[:16])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
@@ -630,7 +737,7 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		if len(payload) < 16 { // ChannelID(16)
 			return nil, fmt.Errorf("invalid connector message")
 		}
-		channelID, err := uuid.Parse(bytesToUUID(payload[:16]))
+		channelID, err := uuid.FromBytes(payload[:16])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
@@ -657,7 +764,7 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		if len(payload) < 17 { // ChannelID(16) + Success(1)
 			return nil, fmt.Errorf("invalid connector response message")
 		}
-		channelID, err := uuid.Parse(bytesToUUID(payload[:16]))
+		channelID, err := uuid.FromBytes(payload[:16])
 		if err != nil {
 			return nil, fmt.Errorf("invalid ChannelID: %w", err)
 		}
@@ -718,3 +825,41 @@ func ParseMessage(data []byte) (BaseMessage, error) {
 		return nil, fmt.Errorf("unknown binary message type: %d", msgType)
 	}
 }
+
+// parseDataPayload decompresses the data of a data message and parses the UDP addresses in rest
+func parseDataPayload(protocol string, compression byte, rawData, rest []byte) (DataMessage, error) {
+	decompressedData := rawData
+	if compression != DataCompressionNone {
+		var err error
+		decompressedData, err = decompressData(compression, rawData)
+		if err != nil {
+			return DataMessage{}, err
+		}
+	}
+
+	msg := DataMessage{
+		Protocol:    protocol,
+		Compression: compression,
+		Data:        decompressedData,
+	}
+	if protocol == "udp" {
+		payload := rest
+		if len(payload) < 1 {
+			return DataMessage{}, fmt.Errorf("invalid udp data message")
+		}
+		addrLen := int(payload[0])
+		if len(payload) < 1+addrLen+2+1 {
+			return DataMessage{}, fmt.Errorf("invalid udp data message length")
+		}
+		msg.Address = string(payload[1 : 1+addrLen])
+		msg.Port = int(uint16(payload[1+addrLen])<<8 | uint16(payload[1+addrLen+1]))
+		payload = payload[1+addrLen+2:]
+		targetAddrLen := int(payload[0])
+		if len(payload) < 1+targetAddrLen+2 {
+			return DataMessage{}, fmt.Errorf("invalid udp data message target address")
+		}
+		msg.TargetAddr = string(payload[1 : 1+targetAddrLen])
+		msg.TargetPort = int(uint16(payload[1+targetAddrLen])<<8 | uint16(payload[1+targetAddrLen+1]))
+	}
+	return msg, nil
+}
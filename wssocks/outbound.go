@@ -0,0 +1,451 @@
+package wssocks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zetxtech/wssocks/socks5"
+)
+
+// ErrUDPNotSupported is returned when opening a UDP socket through an upstream proxy that cannot carry UDP
+var ErrUDPNotSupported = errors.New("upstream proxy does not support UDP")
+
+// Dialer opens the outbound connections of a relay to the targets requested through the tunnel.
+// It can be replaced to bind to a specific source address or interface, to use a network
+// namespace, to go through an upstream proxy or to mock the network in tests.
+type Dialer interface {
+	// DialContext connects to address on the named network
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenPacket opens a packet socket on the local address for UDP traffic
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// DirectDialer is the default Dialer, connecting directly from the local host.
+// Set Dialer.LocalAddr or the Control functions to bind to a source address or interface.
+type DirectDialer struct {
+	Dialer       net.Dialer
+	ListenConfig net.ListenConfig
+}
+
+// DialContext connects to address on the named network
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+// ListenPacket opens a packet socket on the local address
+func (d *DirectDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return d.ListenConfig.ListenPacket(ctx, network, address)
+}
+
+// socks5Dialer connects through an upstream SOCKS5 proxy
+type socks5Dialer struct {
+	proxy    string
+	username string
+	password string
+	local    bool // socks5 scheme, resolve domain names before sending them to the proxy
+	forward  Dialer
+}
+
+// NewSocks5Dialer returns a Dialer connecting through the SOCKS5 proxy at address, reached
+// with forward. UDP sockets are UDP associations of the proxy.
+func NewSocks5Dialer(address, username, password string, forward Dialer) Dialer {
+	if forward == nil {
+		forward = &DirectDialer{}
+	}
+	return &socks5Dialer{
+		proxy:    address,
+		username: username,
+		password: password,
+		forward:  forward,
+	}
+}
+
+// DialContext connects to address through the SOCKS5 proxy
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if d.local && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].String()
+	}
+
+	// Connect to SOCKS5 proxy
+	proxyConn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy error: %w", err)
+	}
+
+	// Bound the handshake by the dial context
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+		defer proxyConn.SetDeadline(time.Time{})
+	}
+
+	// Negotiate with SOCKS5 proxy
+	if err := socks5.ClientHandshake(proxyConn, d.username, d.password); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks5 handshake error: %w", err)
+	}
+
+	// Send connect request
+	if _, _, err := socks5.ClientRequest(proxyConn, socks5.CmdConnect, host, port); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks5 connect error: %w", err)
+	}
+
+	return proxyConn, nil
+}
+
+// ListenPacket opens a UDP association through the SOCKS5 proxy, the local packet socket
+// exchanging datagrams with the relay of the proxy is opened with the forward dialer
+func (d *socks5Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	proxyConn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy error: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+	}
+	if err := socks5.ClientHandshake(proxyConn, d.username, d.password); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks5 handshake error: %w", err)
+	}
+	relayHost, relayPort, err := socks5.ClientRequest(proxyConn, socks5.CmdUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks5 udp associate error: %w", err)
+	}
+	proxyConn.SetDeadline(time.Time{})
+
+	// An unspecified relay address means the relay is on the proxy host
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		relayHost, _, _ = net.SplitHostPort(d.proxy)
+	}
+	relayIP := net.ParseIP(relayHost)
+	if relayIP == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", relayHost)
+		if err != nil {
+			proxyConn.Close()
+			return nil, fmt.Errorf("resolve udp relay error: %w", err)
+		}
+		relayIP = ips[0]
+	}
+
+	pc, err := d.forward.ListenPacket(ctx, network, address)
+	if err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+	conn := socks5.NewUDPConn(proxyConn, pc, &net.UDPAddr{IP: relayIP, Port: relayPort})
+	if d.local {
+		return conn, nil
+	}
+	return &remoteResolvePacketConn{UDPConn: conn}, nil
+}
+
+// remoteResolvePacketConn is a UDP association of a SOCKS5 proxy resolving domain names, its
+// WriteTo accepts destinations with a domain name which are sent to the proxy unresolved
+type remoteResolvePacketConn struct {
+	*socks5.UDPConn
+}
+
+// socks4Dialer connects through an upstream SOCKS4 or SOCKS4a proxy
+type socks4Dialer struct {
+	proxy   string
+	userID  string
+	remote  bool // SOCKS4a, let the proxy resolve domain names
+	forward Dialer
+}
+
+// DialContext connects to address through the SOCKS4 proxy
+func (d *socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// SOCKS4 only carries IPv4 addresses, SOCKS4a adds domain names
+	var ip4 net.IP
+	var domain string
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 = ip.To4(); ip4 == nil {
+			return nil, fmt.Errorf("socks4 does not support IPv6 address: %s", host)
+		}
+	} else if d.remote {
+		ip4 = net.IPv4(0, 0, 0, 1).To4()
+		domain = host
+	} else {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip4 = ips[0].To4()
+	}
+
+	proxyConn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy error: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+		defer proxyConn.SetDeadline(time.Time{})
+	}
+
+	request := []byte{0x04, 0x01}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	request = append(request, ip4...)
+	request = append(request, d.userID...)
+	request = append(request, 0x00)
+	if domain != "" {
+		request = append(request, domain...)
+		request = append(request, 0x00)
+	}
+	if _, err := proxyConn.Write(request); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks4 connect error: %w", err)
+	}
+
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(proxyConn, response); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks4 connect error: %w", err)
+	}
+	if response[1] != 0x5A {
+		proxyConn.Close()
+		return nil, fmt.Errorf("socks4 connect error: request rejected: %d", response[1])
+	}
+
+	return proxyConn, nil
+}
+
+// ListenPacket fails since SOCKS4 cannot carry UDP
+func (d *socks4Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, ErrUDPNotSupported
+}
+
+// httpDialer connects through an upstream HTTP or HTTPS proxy using CONNECT
+type httpDialer struct {
+	proxy     string
+	username  string
+	password  string
+	tlsConfig *tls.Config // Set for HTTPS proxies
+	forward   Dialer
+}
+
+// DialContext connects to address through the HTTP proxy
+func (d *httpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyConn, err := d.forward.DialContext(ctx, "tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy error: %w", err)
+	}
+
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(proxyConn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			proxyConn.Close()
+			return nil, fmt.Errorf("proxy tls handshake error: %w", err)
+		}
+		proxyConn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+		defer proxyConn.SetDeadline(time.Time{})
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.username != "" || d.password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(proxyConn); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("http connect error: %w", err)
+	}
+
+	reader := bufio.NewReader(proxyConn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("http connect error: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		proxyConn.Close()
+		return nil, fmt.Errorf("http connect error: proxy responded %s", response.Status)
+	}
+
+	// Keep any data the proxy sent along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: proxyConn, reader: reader}, nil
+	}
+	return proxyConn, nil
+}
+
+// ListenPacket fails since HTTP CONNECT cannot carry UDP
+func (d *httpDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, ErrUDPNotSupported
+}
+
+// bufferedConn is a net.Conn whose reads are served from reader first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// udpDirectDialer opens UDP sockets with direct when the upstream dialer cannot carry UDP
+type udpDirectDialer struct {
+	Dialer
+	direct Dialer
+}
+
+// ListenPacket opens a packet socket through the upstream, or directly if it cannot carry UDP
+func (d *udpDirectDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	conn, err := d.Dialer.ListenPacket(ctx, network, address)
+	if errors.Is(err, ErrUDPNotSupported) {
+		return d.direct.ListenPacket(ctx, network, address)
+	}
+	return conn, err
+}
+
+// NewProxyDialer returns a Dialer connecting through the upstream proxy described by proxyURL,
+// reached with forward. Supported schemes are socks5, socks5h, socks4, socks4a, http and https,
+// with optional credentials in the URL user info. As with curl, socks5 and socks4 resolve domain
+// names locally while socks5h and socks4a let the proxy resolve them.
+func NewProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = &DirectDialer{}
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL: missing host")
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	address := func(defaultPort string) string {
+		port := u.Port()
+		if port == "" {
+			port = defaultPort
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		return &socks5Dialer{
+			proxy:    address("1080"),
+			username: username,
+			password: password,
+			local:    strings.EqualFold(u.Scheme, "socks5"),
+			forward:  forward,
+		}, nil
+	case "socks4", "socks4a":
+		return &socks4Dialer{
+			proxy:   address("1080"),
+			userID:  username,
+			remote:  strings.EqualFold(u.Scheme, "socks4a"),
+			forward: forward,
+		}, nil
+	case "http":
+		return &httpDialer{
+			proxy:    address("80"),
+			username: username,
+			password: password,
+			forward:  forward,
+		}, nil
+	case "https":
+		return &httpDialer{
+			proxy:     address("443"),
+			username:  username,
+			password:  password,
+			tlsConfig: &tls.Config{ServerName: u.Hostname()},
+			forward:   forward,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+}
+
+// NewProxyChainDialer returns a Dialer connecting through a chain of upstream proxies, the
+// first proxy is reached with forward and each following one through the previous proxies.
+// UDP is refused with ErrUDPNotSupported if any proxy of the chain cannot carry it, unless
+// udpDirect is set, in which case such UDP traffic is sent directly with forward.
+func NewProxyChainDialer(proxyURLs []string, forward Dialer, udpDirect bool) (Dialer, error) {
+	if forward == nil {
+		forward = &DirectDialer{}
+	}
+
+	dialer := forward
+	for _, proxyURL := range proxyURLs {
+		next, err := NewProxyDialer(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		dialer = next
+	}
+
+	if udpDirect {
+		return &udpDirectDialer{Dialer: dialer, direct: forward}, nil
+	}
+	return dialer, nil
+}
+
+// splitAddr returns the host and port of a network address
+func splitAddr(addr net.Addr) (string, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String(), a.Port
+	case *net.TCPAddr:
+		return a.IP.String(), a.Port
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
@@ -2,7 +2,6 @@ package wssocks
 
 import (
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +13,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
+	"github.com/zetxtech/wssocks/socks5"
 )
 
 const (
@@ -32,6 +32,9 @@ const (
 	DefaultCompressionThreshold = 512 * 1024
 )
 
+// ErrConnectFailed is reported to front-ends when the remote side could not open a connection
+var ErrConnectFailed = errors.New("remote connection failed")
+
 // RelayOption contains configuration options for Relay
 type RelayOption struct {
 	// BufferSize controls the size of reusable buffers
@@ -48,6 +51,10 @@ type RelayOption struct {
 	UpstreamUsername string
 	UpstreamPassword string
 
+	// Dialer opens outbound connections, defaults to dialing directly
+	// When an upstream proxy is set, it is used to reach the proxy
+	Dialer Dialer
+
 	// Adaptive batching configuration
 	EnableDynamicBatching bool
 	MaxBatchWaitTime      time.Duration
@@ -58,6 +65,11 @@ type RelayOption struct {
 	LowSpeedThreshold float64
 	// CompressionThreshold defines the data size in bytes above which compression is applied
 	CompressionThreshold int
+	// Compressions lists the accepted compressions in preference order, nil for all registered ones
+	Compressions []byte
+	// AdaptiveCompression compresses data above 1KB that looks compressible from a sample,
+	// instead of compressing data above CompressionThreshold
+	AdaptiveCompression bool
 }
 
 // NewDefaultRelayOption creates a RelayOption with default values
@@ -113,6 +125,12 @@ func (o *RelayOption) WithUpstreamAuth(username, password string) *RelayOption {
 	return o
 }
 
+// WithDialer sets the dialer used for outbound TCP and UDP traffic
+func (o *RelayOption) WithDialer(dialer Dialer) *RelayOption {
+	o.Dialer = dialer
+	return o
+}
+
 // WithDynamicBatching enables or disables adaptive batching for SOCKS TCP
 func (o *RelayOption) WithDynamicBatching(enabled bool) *RelayOption {
 	o.EnableDynamicBatching = enabled
@@ -162,6 +180,18 @@ func (o *RelayOption) WithCompressionThreshold(threshold int) *RelayOption {
 	return o
 }
 
+// WithCompressions sets the accepted compressions in preference order, an empty list disables compression
+func (o *RelayOption) WithCompressions(compressions []byte) *RelayOption {
+	o.Compressions = compressions
+	return o
+}
+
+// WithAdaptiveCompression controls whether compression is decided by sampling the data
+func (o *RelayOption) WithAdaptiveCompression(adaptive bool) *RelayOption {
+	o.AdaptiveCompression = adaptive
+	return o
+}
+
 // Relay handles stream transport between SOCKS5 and WebSocket
 type Relay struct {
 	log                  zerolog.Logger
@@ -171,8 +201,10 @@ type Relay struct {
 	udpClientAddrs       sync.Map // map[uuid.UUID]*net.UDPAddr
 	lastActivity         sync.Map // map[uuid.UUID]time.Time
 	option               *RelayOption
+	dialer               Dialer
 	done                 chan struct{}
 	connectionSuccessMap sync.Map
+	awaitedConnects      sync.Map  // Channels waiting for their connect response whatever the mode
 	bufferPool           sync.Pool // Buffer pool for reusing byte slices
 }
 
@@ -182,9 +214,18 @@ func NewRelay(logger zerolog.Logger, option *RelayOption) *Relay {
 		option = NewDefaultRelayOption()
 	}
 
+	dialer := option.Dialer
+	if dialer == nil {
+		dialer = &DirectDialer{}
+	}
+	if option.UpstreamProxy != "" {
+		dialer = NewSocks5Dialer(option.UpstreamProxy, option.UpstreamUsername, option.UpstreamPassword, dialer)
+	}
+
 	r := &Relay{
 		log:    logger,
 		option: option,
+		dialer: dialer,
 		done:   make(chan struct{}),
 		bufferPool: sync.Pool{
 			New: func() interface{} {
@@ -260,51 +301,26 @@ func (r *Relay) updateActivityTime(channelID uuid.UUID) {
 
 // RefuseSocksRequest refuses a SOCKS5 client request with the specified reason
 func (r *Relay) RefuseSocksRequest(conn net.Conn, reason byte) error {
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return fmt.Errorf("read error: %w", err)
-	}
-	if n == 0 || buffer[0] != 0x05 {
-		return fmt.Errorf("invalid socks version")
-	}
-
-	// Send auth method response
-	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
-		return fmt.Errorf("write auth response error: %w", err)
-	}
-
-	// Read request
-	n, err = conn.Read(buffer)
-	if err != nil {
-		if err == io.EOF {
+	if _, err := socks5.Handshake(conn, nil); err != nil {
+		if errors.Is(err, io.EOF) {
 			r.log.Debug().Msg("Client closed SOCKS connection")
 			return nil
 		}
-		return fmt.Errorf("read request error: %w", err)
-	}
-	if n < 7 {
-		return fmt.Errorf("request too short")
+		return err
 	}
 
-	// Send refusal response
-	response := []byte{
-		0x05,                   // version
-		reason,                 // reply code
-		0x00,                   // reserved
-		0x01,                   // address type (IPv4)
-		0x00, 0x00, 0x00, 0x00, // IP address
-		0x00, 0x00, // port
-	}
-	if _, err := conn.Write(response); err != nil {
+	if err := socks5.WriteReply(conn, reason, nil); err != nil {
 		return fmt.Errorf("write refusal response error: %w", err)
 	}
-
 	return nil
 }
 
 // HandleNetworkConnection handles network connection based on protocol type
 func (r *Relay) HandleNetworkConnection(ctx context.Context, ws *WSConn, request ConnectMessage) error {
+	if request.Encrypted && !ws.e2eAccepted(request.ChannelID) {
+		// Serving the channel would hand ciphertext, or data of a forged request, to the target
+		return r.refuseConnect(ws, request, e2eRefusedReason)
+	}
 	if request.Protocol == "tcp" {
 		return r.HandleTCPConnection(ctx, ws, request)
 	} else if request.Protocol == "udp" {
@@ -313,6 +329,22 @@ func (r *Relay) HandleNetworkConnection(ctx context.Context, ws *WSConn, request
 	return fmt.Errorf("unsupported protocol: %s", request.Protocol)
 }
 
+// refuseConnect answers a connect request with a failure response
+func (r *Relay) refuseConnect(ws *WSConn, request ConnectMessage, reason string) error {
+	r.messageQueues.Delete(request.ChannelID)
+
+	response := ConnectResponseMessage{
+		Success:   false,
+		Error:     reason,
+		ChannelID: request.ChannelID,
+	}
+	r.logMessage(response, "send", ws.Label())
+	if err := ws.WriteMessage(response); err != nil {
+		return fmt.Errorf("write error response error: %w", err)
+	}
+	return nil
+}
+
 // HandleTCPConnection handles TCP network connection
 func (r *Relay) HandleTCPConnection(ctx context.Context, ws *WSConn, request ConnectMessage) error {
 	if request.Port <= 0 || request.Port > 65535 {
@@ -320,19 +352,13 @@ func (r *Relay) HandleTCPConnection(ctx context.Context, ws *WSConn, request Con
 	}
 
 	// Connect to target
-	targetAddr := fmt.Sprintf("%s:%d", request.Address, request.Port)
+	targetAddr := net.JoinHostPort(request.Address, strconv.Itoa(request.Port))
 	r.log.Debug().Str("address", request.Address).Int("port", request.Port).
 		Str("target", targetAddr).Msg("Attempting TCP connection to")
 
-	var conn net.Conn
-	var err error
-
-	// Use upstream SOCKS5 proxy if configured
-	if r.option.UpstreamProxy != "" {
-		conn, err = r.dialViaSocks5(targetAddr)
-	} else {
-		conn, err = net.DialTimeout("tcp", targetAddr, r.option.ConnectTimeout)
-	}
+	dialCtx, cancel := context.WithTimeout(ctx, r.option.ConnectTimeout)
+	conn, err := r.dialer.DialContext(dialCtx, "tcp", targetAddr)
+	cancel()
 
 	if err != nil {
 		r.log.Debug().
@@ -354,6 +380,12 @@ func (r *Relay) HandleTCPConnection(ctx context.Context, ws *WSConn, request Con
 		return nil
 	}
 
+	return r.ServeTCPConnection(ctx, ws, request, conn)
+}
+
+// ServeTCPConnection accepts a TCP connect request using an already established conn to the
+// target instead of dialing it, then relays the channel until either side closes
+func (r *Relay) ServeTCPConnection(ctx context.Context, ws *WSConn, request ConnectMessage, conn net.Conn) error {
 	// Create child context
 	childCtx, cancel := context.WithCancel(ctx)
 	r.tcpChannels.Store(request.ChannelID, cancel)
@@ -362,6 +394,8 @@ func (r *Relay) HandleTCPConnection(ctx context.Context, ws *WSConn, request Con
 		conn.Close()
 		r.tcpChannels.Delete(request.ChannelID)
 		r.lastActivity.Delete(request.ChannelID)
+		// Channels ended by the target or timed out are not closed by a message
+		ws.forgetChannel(request.ChannelID)
 	}()
 
 	// Send success response
@@ -378,190 +412,29 @@ func (r *Relay) HandleTCPConnection(ctx context.Context, ws *WSConn, request Con
 	return r.HandleRemoteTCPForward(childCtx, ws, conn, request.ChannelID)
 }
 
-// dialViaSocks5 establishes a connection through an upstream SOCKS5 proxy
-func (r *Relay) dialViaSocks5(targetAddr string) (net.Conn, error) {
-	// Connect to SOCKS5 proxy
-	proxyConn, err := net.DialTimeout("tcp", r.option.UpstreamProxy, r.option.ConnectTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("connect to proxy error: %w", err)
-	}
-
-	// Negotiate with SOCKS5 proxy
-	if err := r.socks5Handshake(proxyConn); err != nil {
-		proxyConn.Close()
-		return nil, fmt.Errorf("socks5 handshake error: %w", err)
-	}
-
-	// Send connect request
-	if err := r.socks5Connect(proxyConn, targetAddr); err != nil {
-		proxyConn.Close()
-		return nil, fmt.Errorf("socks5 connect error: %w", err)
-	}
-
-	return proxyConn, nil
-}
-
-// socks5Handshake performs SOCKS5 protocol handshake with authentication if needed
-func (r *Relay) socks5Handshake(conn net.Conn) error {
-	// Initial handshake
-	if r.option.UpstreamUsername != "" && r.option.UpstreamPassword != "" {
-		// Auth required
-		if _, err := conn.Write([]byte{0x05, 0x01, 0x02}); err != nil {
-			return err
-		}
-	} else {
-		// No auth
-		if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
-			return err
-		}
-	}
-
-	// Read response
-	response := make([]byte, 2)
-	if _, err := io.ReadFull(conn, response); err != nil {
-		return err
-	}
-
-	if response[0] != 0x05 {
-		return fmt.Errorf("invalid socks version: %d", response[0])
-	}
-
-	// Handle authentication if required
-	if response[1] == 0x02 {
-		if err := r.socks5Auth(conn); err != nil {
-			return err
-		}
-	} else if response[1] != 0x00 {
-		return fmt.Errorf("unsupported auth method: %d", response[1])
-	}
-
-	return nil
-}
-
-// socks5Auth performs username/password authentication
-func (r *Relay) socks5Auth(conn net.Conn) error {
-	// Username/Password auth version
-	auth := []byte{0x01}
-
-	// Add username
-	auth = append(auth, byte(len(r.option.UpstreamUsername)))
-	auth = append(auth, []byte(r.option.UpstreamUsername)...)
-
-	// Add password
-	auth = append(auth, byte(len(r.option.UpstreamPassword)))
-	auth = append(auth, []byte(r.option.UpstreamPassword)...)
-
-	if _, err := conn.Write(auth); err != nil {
-		return err
-	}
-
-	// Read auth response
-	response := make([]byte, 2)
-	if _, err := io.ReadFull(conn, response); err != nil {
-		return err
-	}
-
-	if response[0] != 0x01 || response[1] != 0x00 {
-		return fmt.Errorf("authentication failed")
-	}
-
-	return nil
-}
-
-// socks5Connect sends connect request to SOCKS5 proxy
-func (r *Relay) socks5Connect(conn net.Conn, targetAddr string) error {
-	host, portStr, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		return err
-	}
-
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return err
-	}
-
-	// Prepare connect request
-	request := []byte{0x05, 0x01, 0x00}
-
-	// Add address
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			request = append(request, 0x01)
-			request = append(request, ip4...)
-		} else {
-			request = append(request, 0x04)
-			request = append(request, ip...)
-		}
-	} else {
-		request = append(request, 0x03, byte(len(host)))
-		request = append(request, []byte(host)...)
-	}
-
-	// Add port
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, uint16(port))
-	request = append(request, portBytes...)
-
-	// Send request
-	if _, err := conn.Write(request); err != nil {
-		return err
-	}
-
-	// Read response
-	response := make([]byte, 4)
-	if _, err := io.ReadFull(conn, response); err != nil {
-		return err
-	}
-
-	if response[0] != 0x05 {
-		return fmt.Errorf("invalid socks version: %d", response[0])
-	}
-
-	if response[1] != 0x00 {
-		return fmt.Errorf("connection failed: %d", response[1])
-	}
-
-	// Skip the rest of the response (bound address and port)
-	switch response[3] {
-	case 0x01:
-		_, err = io.ReadFull(conn, make([]byte, 4+2)) // IPv4 + Port
-	case 0x03:
-		domainLen := make([]byte, 1)
-		_, err = io.ReadFull(conn, domainLen)
-		if err == nil {
-			_, err = io.ReadFull(conn, make([]byte, int(domainLen[0])+2)) // Domain + Port
-		}
-	case 0x04:
-		_, err = io.ReadFull(conn, make([]byte, 16+2)) // IPv6 + Port
-	}
-
-	return err
-}
-
 // HandleUDPConnection handles UDP network connection
 func (r *Relay) HandleUDPConnection(ctx context.Context, ws *WSConn, request ConnectMessage) error {
+	// Opening the socket may involve an upstream proxy handshake
+	dialCtx, dialCancel := context.WithTimeout(ctx, r.option.ConnectTimeout)
+	defer dialCancel()
+
 	// Try dual-stack first
-	localAddr := &net.UDPAddr{
-		IP:   net.IPv6zero,
-		Port: 0,
+	conn, err := r.dialer.ListenPacket(dialCtx, "udp", "[::]:0")
+	if err != nil && !errors.Is(err, ErrUDPNotSupported) {
+		// Fallback to IPv4-only if dual-stack fails
+		conn, err = r.dialer.ListenPacket(dialCtx, "udp4", "0.0.0.0:0")
 	}
-	conn, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		// Fallback to IPv4-only if dual-stack fails
-		localAddr.IP = net.IPv4zero
-		conn, err = net.ListenUDP("udp", localAddr)
-		if err != nil {
-			response := ConnectResponseMessage{
-				Success:   false,
-				Error:     err.Error(),
-				ChannelID: request.ChannelID,
-			}
-			r.logMessage(response, "send", ws.Label())
-			if err := ws.WriteMessage(response); err != nil {
-				return fmt.Errorf("write error response error: %w", err)
-			}
-			return fmt.Errorf("udp listen error: %w", err)
+		response := ConnectResponseMessage{
+			Success:   false,
+			Error:     err.Error(),
+			ChannelID: request.ChannelID,
 		}
+		r.logMessage(response, "send", ws.Label())
+		if err := ws.WriteMessage(response); err != nil {
+			return fmt.Errorf("write error response error: %w", err)
+		}
+		return fmt.Errorf("udp listen error: %w", err)
 	}
 
 	// Create child context
@@ -572,6 +445,8 @@ func (r *Relay) HandleUDPConnection(ctx context.Context, ws *WSConn, request Con
 		conn.Close()
 		r.udpChannels.Delete(request.ChannelID)
 		r.lastActivity.Delete(request.ChannelID)
+		// Channels ended by the target or timed out are not closed by a message
+		ws.forgetChannel(request.ChannelID)
 	}()
 
 	// Send success response
@@ -590,328 +465,194 @@ func (r *Relay) HandleUDPConnection(ctx context.Context, ws *WSConn, request Con
 
 // HandleSocksRequest handles incoming SOCKS5 client request
 func (r *Relay) HandleSocksRequest(ctx context.Context, ws *WSConn, socksConn net.Conn, socksUsername string, socksPassword string) error {
-	buffer := make([]byte, 1024)
-
-	// Read version and auth methods
-	n, err := socksConn.Read(buffer)
+	request, err := socks5.Handshake(socksConn, socks5.StaticAuth(socksUsername, socksPassword))
 	if err != nil {
-		return fmt.Errorf("read version error: %w", err)
-	}
-	if n < 2 || buffer[0] != 0x05 {
-		return fmt.Errorf("invalid socks version")
+		if errors.Is(err, io.EOF) {
+			r.log.Debug().Msg("Client closed SOCKS connection")
+			return nil
+		}
+		return err
 	}
+	return r.ServeSocksRequest(ctx, ws, socksConn, request)
+}
 
-	nmethods := int(buffer[1])
-	methods := buffer[2 : 2+nmethods]
-
-	if socksUsername != "" && socksPassword != "" {
-		// Require username/password authentication
-		var hasUserPass bool
-		for _, method := range methods {
-			if method == 0x02 {
-				hasUserPass = true
-				break
-			}
-		}
-		if !hasUserPass {
-			if _, err := socksConn.Write([]byte{0x05, 0xFF}); err != nil {
-				return fmt.Errorf("write auth method error: %w", err)
+// ServeSocksRequest serves a SOCKS5 request whose handshake has already been completed
+func (r *Relay) ServeSocksRequest(ctx context.Context, ws *WSConn, socksConn net.Conn, request *socks5.Request) error {
+	switch request.Command {
+	case socks5.CmdConnect:
+		return r.HandleTCPRequest(ctx, ws, socksConn, request.Host, request.Port, func(err error) error {
+			if err != nil {
+				// Return connection failure response to SOCKS client
+				return socks5.WriteReply(socksConn, socks5.RepHostUnreachable, nil)
 			}
-			return fmt.Errorf("no username/password auth method")
-		}
+			return socks5.WriteReply(socksConn, socks5.RepSuccess, nil)
+		})
 
-		// Send auth method response (username/password)
-		if _, err := socksConn.Write([]byte{0x05, 0x02}); err != nil {
-			return fmt.Errorf("write auth response error: %w", err)
-		}
+	case socks5.CmdUDPAssociate:
+		return r.handleSocksUDPAssociate(ctx, ws, socksConn)
 
-		// Read auth version
-		_, err = socksConn.Read(buffer[:1])
-		if err != nil {
-			return fmt.Errorf("read auth version error: %w", err)
-		}
-		if buffer[0] != 0x01 {
-			return fmt.Errorf("invalid auth version")
-		}
-
-		// Read username length
-		_, err = socksConn.Read(buffer[:1])
-		if err != nil {
-			return fmt.Errorf("read username length error: %w", err)
+	default:
+		if err := socks5.WriteReply(socksConn, socks5.RepCommandNotSupported, nil); err != nil {
+			return fmt.Errorf("write command not supported response error: %w", err)
 		}
-		ulen := int(buffer[0])
+		return fmt.Errorf("unsupported command: %d", request.Command)
+	}
+}
 
-		// Read username
-		_, err = socksConn.Read(buffer[:ulen])
-		if err != nil {
-			return fmt.Errorf("read username error: %w", err)
-		}
-		username := string(buffer[:ulen])
+// HandleTCPRequest opens a TCP channel to host:port and relays conn through it. It can be
+// used by any front-end that has already determined the target, such as SOCKS5 CONNECT or
+// transparent proxying. If reply is not nil it is called once the connection result is
+// known, with ErrConnectFailed on failure, so the front-end can answer its client.
+func (r *Relay) HandleTCPRequest(ctx context.Context, ws *WSConn, conn net.Conn, host string, port int, reply func(err error) error) error {
+	return r.handleTCPRequest(ctx, ws, conn, host, port, reply, r.option.StrictConnect)
+}
 
-		// Read password length
-		_, err = socksConn.Read(buffer[:1])
-		if err != nil {
-			return fmt.Errorf("read password length error: %w", err)
-		}
-		plen := int(buffer[0])
+// handleTCPRequest is HandleTCPRequest, waiting for the connection result if strict whatever
+// the mode of the relay
+func (r *Relay) handleTCPRequest(ctx context.Context, ws *WSConn, conn net.Conn, host string, port int, reply func(err error) error, strict bool) error {
+	channelID := uuid.New()
+	r.log.Trace().Str("channel_id", channelID.String()).Msg("Starting TCP request handling")
 
-		// Read password
-		_, err = socksConn.Read(buffer[:plen])
-		if err != nil {
-			return fmt.Errorf("read password error: %w", err)
-		}
-		password := string(buffer[:plen])
+	channelQueue := make(chan BaseMessage, 1000)
+	r.messageQueues.Store(channelID, channelQueue)
+	defer r.messageQueues.Delete(channelID)
 
-		if username != socksUsername || password != socksPassword {
-			if _, err := socksConn.Write([]byte{0x01, 0x01}); err != nil {
-				return fmt.Errorf("write auth failure response error: %w", err)
+	// Send connection request to server
+	request := ConnectMessage{
+		Protocol:  "tcp",
+		Address:   host,
+		Port:      port,
+		ChannelID: channelID,
+	}
+	r.log.Debug().Str("address", host).Int("port", port).Msg("Requesting TCP connecting to")
+	connected, err := r.connectChannel(ctx, ws, request, channelQueue, strict)
+	if err != nil || !connected {
+		if reply != nil {
+			if rerr := reply(ErrConnectFailed); rerr != nil && err == nil {
+				return fmt.Errorf("write failure response error: %w", rerr)
 			}
-			return fmt.Errorf("authentication failed")
 		}
-
-		// Send auth success response
-		if _, err := socksConn.Write([]byte{0x01, 0x00}); err != nil {
-			return fmt.Errorf("write auth success response error: %w", err)
-		}
-	} else {
-		// No authentication required
-		if _, err := socksConn.Write([]byte{0x05, 0x00}); err != nil {
-			return fmt.Errorf("write auth response error: %w", err)
-		}
-	}
-
-	// Read request
-	n, err = socksConn.Read(buffer)
-	if err != nil {
-		if err == io.EOF {
-			r.log.Debug().Msg("Client closed SOCKS connection")
-			return nil
-		}
-		return fmt.Errorf("read request error: %w", err)
-	}
-	if n < 7 {
-		return fmt.Errorf("request too short")
+		return err
 	}
 
-	cmd := buffer[1]
-	atyp := buffer[3]
-	var targetAddr string
-	var targetPort uint16
-	var offset int
-
-	// Parse address
-	switch atyp {
-	case 0x01: // IPv4
-		if n < 10 {
-			return fmt.Errorf("request too short for IPv4")
-		}
-		targetAddr = net.IP(buffer[4:8]).String()
-		offset = 8
-	case 0x03: // Domain
-		domainLen := int(buffer[4])
-		if n < 5+domainLen+2 {
-			return fmt.Errorf("request too short for domain")
-		}
-		targetAddr = string(buffer[5 : 5+domainLen])
-		offset = 5 + domainLen
-	case 0x04: // IPv6
-		if n < 22 {
-			return fmt.Errorf("request too short for IPv6")
+	if reply != nil {
+		if err := reply(nil); err != nil {
+			return fmt.Errorf("write success response error: %w", err)
 		}
-		targetAddr = net.IP(buffer[4:20]).String()
-		offset = 20
-	default:
-		return fmt.Errorf("unsupported address type: %d", atyp)
 	}
 
-	targetPort = binary.BigEndian.Uint16(buffer[offset : offset+2])
+	// Start TCP relay
+	return r.HandleSocksTCPForward(ctx, ws, conn, channelID)
+}
 
-	// Generate unique client ID and connect ID
+// handleSocksUDPAssociate handles a SOCKS5 UDP ASSOCIATE request
+func (r *Relay) handleSocksUDPAssociate(ctx context.Context, ws *WSConn, socksConn net.Conn) error {
 	channelID := uuid.New()
-	r.log.Trace().Str("channel_id", channelID.String()).Msg("Starting SOCKS request handling")
-
-	// Handle different commands
-	switch cmd {
-	case 0x01: // CONNECT
-		channelQueue := make(chan BaseMessage, 1000)
-		r.messageQueues.Store(channelID, channelQueue)
-		defer r.messageQueues.Delete(channelID)
-
-		// Send connection request to server
-		requestData := ConnectMessage{
-			Protocol:  "tcp",
-			Address:   targetAddr,
-			Port:      int(targetPort),
-			ChannelID: channelID,
-		}
-		r.log.Debug().Str("address", targetAddr).Int("port", int(targetPort)).Msg("Requesting TCP connecting to")
-		r.logMessage(requestData, "send", ws.Label())
-		if err := ws.WriteMessage(requestData); err != nil {
-			// Return connection failure response to SOCKS client (0x04 = Host unreachable)
-			resp := []byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-			socksConn.Write(resp)
-			return fmt.Errorf("write connect request error: %w", err)
-		}
-
-		var response ConnectResponseMessage
-		if r.option.StrictConnect {
-			// Wait for response with timeout in strict mode
-			select {
-			case msg := <-channelQueue:
-				var ok bool
-				response, ok = msg.(ConnectResponseMessage)
-				if !ok {
-					resp := []byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-					if _, err := socksConn.Write(resp); err != nil {
-						return fmt.Errorf("write failure response error: %w", err)
-					}
-					return fmt.Errorf("unexpected message type for connect response")
-				}
-			case <-time.After(r.option.ConnectTimeout + 5*time.Second):
-				// Return connection failure response to SOCKS client (0x04 = Host unreachable)
-				resp := []byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-				if _, err := socksConn.Write(resp); err != nil {
-					return fmt.Errorf("write failure response error: %w", err)
-				}
-				r.log.Debug().Str("addr", targetAddr).Int("port", int(targetPort)).Msg("Remote connection response timeout")
-				return nil
-			}
-			if !response.Success {
-				// Return connection failure response to SOCKS client (0x04 = Host unreachable)
-				resp := []byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-				if _, err := socksConn.Write(resp); err != nil {
-					return fmt.Errorf("write failure response error: %w", err)
-				}
-				r.log.Debug().Str("error", response.Error).Msg("Remote connection failed")
-				return nil
-			}
-			r.log.Trace().Str("addr", targetAddr).Int("port", int(targetPort)).Msg("Remote successfully connected")
-		} else {
-			r.log.Trace().Str("addr", targetAddr).Int("port", int(targetPort)).Msg("Assume successful connection in non-strict mode")
-
-			go func() {
-				timer := time.NewTimer(r.option.ConnectTimeout + 5*time.Second)
-				defer timer.Stop()
-
-				select {
-				case <-timer.C:
-					if _, ok := r.connectionSuccessMap.LoadAndDelete(channelID); !ok {
-						r.log.Debug().
-							Str("addr", targetAddr).
-							Int("port", int(targetPort)).
-							Msg("Connection timeout without success confirmation")
-						r.disconnectChannel(channelID)
-					}
-				case <-ctx.Done():
-					return
-				}
-			}()
-		}
+	r.log.Trace().Str("channel_id", channelID.String()).Msg("Starting UDP associate handling")
 
-		// Send success response to client
-		resp := []byte{
-			0x05,                   // version
-			0x00,                   // success
-			0x00,                   // reserved
-			0x01,                   // IPv4
-			0x00, 0x00, 0x00, 0x00, // IP address
-			0x00, 0x00, // port
-		}
-		if _, err := socksConn.Write(resp); err != nil {
-			return fmt.Errorf("write success response error: %w", err)
-		}
+	// Create UDP socket
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		socks5.WriteReply(socksConn, socks5.RepGeneralFailure, nil)
+		return fmt.Errorf("listen UDP error: %w", err)
+	}
 
-		// Start TCP relay
-		return r.HandleSocksTCPForward(ctx, ws, socksConn, channelID)
+	// Create temporary queue for connection response
+	connectQueue := make(chan BaseMessage, 1000)
+	r.messageQueues.Store(channelID, connectQueue)
+	defer r.messageQueues.Delete(channelID)
 
-	case 0x03: // UDP ASSOCIATE
-		// Create UDP socket
-		udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	// Send UDP associate request to server
+	request := ConnectMessage{
+		Protocol:  "udp",
+		ChannelID: channelID,
+	}
+	r.log.Debug().Msg("Requesting UDP Associate")
+	connected, err := r.connectChannel(ctx, ws, request, connectQueue, r.option.StrictConnect)
+	if err != nil || !connected {
+		udpConn.Close()
+		socks5.WriteReply(socksConn, socks5.RepGeneralFailure, nil)
 		if err != nil {
-			return fmt.Errorf("resolve UDP addr error: %w", err)
+			return err
 		}
+		return fmt.Errorf("UDP association failed")
+	}
 
-		udpConn, err := net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			return fmt.Errorf("listen UDP error: %w", err)
-		}
+	// Send UDP associate response
+	if err := socks5.WriteReply(socksConn, socks5.RepSuccess, udpConn.LocalAddr()); err != nil {
+		udpConn.Close()
+		return fmt.Errorf("write UDP associate response error: %w", err)
+	}
 
-		localAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	r.log.Trace().Str("addr", udpConn.LocalAddr().String()).Msg("UDP association established")
 
-		// Create temporary queue for connection response
-		connectQueue := make(chan BaseMessage, 1000)
-		r.messageQueues.Store(channelID, connectQueue)
-		defer r.messageQueues.Delete(channelID)
+	// Start UDP relay
+	return r.HandleSocksUDPForward(ctx, ws, udpConn, socksConn, channelID)
+}
 
-		// Send UDP associate request to server
-		requestData := ConnectMessage{
-			Protocol:  "udp",
-			ChannelID: channelID,
-		}
-		r.log.Debug().Msg("Requesting UDP Associate")
-		r.logMessage(requestData, "send", ws.Label())
-		if err := ws.WriteMessage(requestData); err != nil {
-			udpConn.Close()
-			return fmt.Errorf("write UDP request error: %w", err)
+// connectChannel sends a connect request for a new channel through the WebSocket. If strict,
+// it waits on queue for the remote result and returns false if the remote side refused the
+// connection or did not answer in time. Otherwise success is assumed and TCP channels are
+// disconnected later if no confirmation arrives.
+func (r *Relay) connectChannel(ctx context.Context, ws *WSConn, request ConnectMessage, queue chan BaseMessage, strict bool) (bool, error) {
+	if strict {
+		r.awaitedConnects.Store(request.ChannelID, struct{}{})
+		defer r.awaitedConnects.Delete(request.ChannelID)
+	}
+
+	r.logMessage(request, "send", ws.Label())
+	if err := ws.WriteMessage(request); err != nil {
+		return false, fmt.Errorf("write connect request error: %w", err)
+	}
+
+	if !strict {
+		if request.Protocol != "tcp" {
+			return true, nil
 		}
+		r.log.Trace().Str("addr", request.Address).Int("port", request.Port).Msg("Assume successful connection in non-strict mode")
+
+		go func() {
+			timer := time.NewTimer(r.option.ConnectTimeout + 5*time.Second)
+			defer timer.Stop()
 
-		if r.option.StrictConnect {
-			// Wait for response with timeout
-			var response ConnectResponseMessage
 			select {
-			case msg := <-connectQueue:
-				var ok bool
-				response, ok = msg.(ConnectResponseMessage)
-				if !ok {
-					resp := []byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-					if _, err := socksConn.Write(resp); err != nil {
-						return fmt.Errorf("write failure response error: %w", err)
-					}
-					return fmt.Errorf("unexpected message type for connect response")
+			case <-timer.C:
+				if _, ok := r.connectionSuccessMap.LoadAndDelete(request.ChannelID); !ok {
+					r.log.Debug().
+						Str("addr", request.Address).
+						Int("port", request.Port).
+						Msg("Connection timeout without success confirmation")
+					r.disconnectChannel(request.ChannelID)
 				}
-			case <-time.After(r.option.ConnectTimeout + 5*time.Second):
-				udpConn.Close()
-				return fmt.Errorf("UDP association response timeout")
-			}
-
-			if !response.Success {
-				udpConn.Close()
-				return fmt.Errorf("UDP association failed: %s", response.Error)
+			case <-ctx.Done():
+				return
 			}
-		}
+		}()
+		return true, nil
+	}
 
-		// Send UDP associate response
-		resp := []byte{
-			0x05, // version
-			0x00, // success
-			0x00, // reserved
-			0x01, // IPv4
+	// Wait for response with timeout in strict mode
+	timer := time.NewTimer(r.option.ConnectTimeout + 5*time.Second)
+	defer timer.Stop()
+	select {
+	case msg := <-queue:
+		response, ok := msg.(ConnectResponseMessage)
+		if !ok {
+			return false, fmt.Errorf("unexpected message type for connect response")
 		}
-		resp = append(resp, localAddr.IP.To4()...)
-		portBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(portBytes, uint16(localAddr.Port))
-		resp = append(resp, portBytes...)
-
-		if _, err := socksConn.Write(resp); err != nil {
-			udpConn.Close()
-			return fmt.Errorf("write UDP associate response error: %w", err)
+		if !response.Success {
+			r.log.Debug().Str("error", response.Error).Msg("Remote connection failed")
+			return false, nil
 		}
-
-		r.log.Trace().Int("port", localAddr.Port).Msg("UDP association established")
-
-		// Monitor TCP connection for closure
-		go func() {
-			buffer := make([]byte, 1)
-			socksConn.Read(buffer)
-			udpConn.Close()
-		}()
-
-		// Start UDP relay
-		return r.HandleSocksUDPForward(ctx, ws, udpConn, socksConn, channelID)
-
-	default:
-		return fmt.Errorf("unsupported command: %d", cmd)
+	case <-timer.C:
+		r.log.Debug().Str("addr", request.Address).Int("port", request.Port).Msg("Remote connection response timeout")
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
 	}
+
+	r.log.Trace().Str("addr", request.Address).Int("port", request.Port).Msg("Remote successfully connected")
+	return true, nil
 }
 
 // HandleRemoteTCPForward handles remote TCP forwarding
@@ -983,8 +724,30 @@ func (r *Relay) HandleRemoteTCPForward(ctx context.Context, ws *WSConn, remoteCo
 	}
 }
 
+// udpTargetAddr returns the destination of a datagram for udpConn. Domain names are resolved
+// locally, unless udpConn is the UDP association of a proxy resolving them, so the lookup does
+// not leak outside of the proxy.
+func (r *Relay) udpTargetAddr(udpConn net.PacketConn, host string, port int) (net.Addr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	if _, ok := udpConn.(*remoteResolvePacketConn); ok {
+		return channelAddr{network: "udp", address: net.JoinHostPort(host, strconv.Itoa(port))}, nil
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(addrs[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid resolved address: %s", addrs[0])
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
 // HandleRemoteUDPForward handles remote UDP forwarding
-func (r *Relay) HandleRemoteUDPForward(ctx context.Context, ws *WSConn, udpConn *net.UDPConn, channelID uuid.UUID) error {
+func (r *Relay) HandleRemoteUDPForward(ctx context.Context, ws *WSConn, udpConn net.PacketConn, channelID uuid.UUID) error {
 	// Initialize activity time
 	r.updateActivityTime(channelID)
 
@@ -1026,38 +789,16 @@ func (r *Relay) HandleRemoteUDPForward(ctx context.Context, ws *WSConn, udpConn
 				// Update activity time
 				r.updateActivityTime(channelID)
 
-				// Resolve domain name if necessary
-				var targetIP net.IP
-				if ip := net.ParseIP(dataMsg.TargetAddr); ip != nil {
-					targetIP = ip
-				} else {
-					// Attempt to resolve domain name
-					addrs, err := net.LookupHost(dataMsg.TargetAddr)
-					if err != nil {
-						r.log.Debug().
-							Err(err).
-							Str("domain", dataMsg.TargetAddr).
-							Msg("Failed to resolve domain name")
-						continue
-					}
-					// Parse the first resolved address
-					targetIP = net.ParseIP(addrs[0])
-					if targetIP == nil {
-						r.log.Debug().
-							Str("addr", addrs[0]).
-							Str("domain", dataMsg.TargetAddr).
-							Msg("Failed to parse resolved IP address")
-						continue
-					}
-				}
-
-				targetAddr := &net.UDPAddr{
-					IP:   targetIP,
-					Port: dataMsg.TargetPort,
+				targetAddr, err := r.udpTargetAddr(udpConn, dataMsg.TargetAddr, dataMsg.TargetPort)
+				if err != nil {
+					r.log.Debug().
+						Err(err).
+						Str("domain", dataMsg.TargetAddr).
+						Msg("Failed to resolve domain name")
+					continue
 				}
 
-				_, err := udpConn.WriteToUDP(dataMsg.Data, targetAddr)
-				if err != nil {
+				if _, err := udpConn.WriteTo(dataMsg.Data, targetAddr); err != nil {
 					errChan <- fmt.Errorf("udp write error: %w", err)
 					return
 				}
@@ -1236,55 +977,29 @@ func (r *Relay) HandleSocksUDPForward(ctx context.Context, ws *WSConn, udpConn *
 			r.udpClientAddrs.Store(channelID, remoteAddr)
 
 			// Parse SOCKS UDP header
-			if n > 3 { // Minimal UDP header
-				atyp := buffer[3]
-				var targetAddr string
-				var targetPort int
-				var payload []byte
-
-				switch atyp {
-				case 0x01: // IPv4
-					addrBytes := buffer[4:8]
-					targetAddr = net.IP(addrBytes).String()
-					portBytes := buffer[8:10]
-					targetPort = int(binary.BigEndian.Uint16(portBytes))
-					payload = buffer[10:n]
-				case 0x03: // Domain
-					addrLen := int(buffer[4])
-					addrBytes := buffer[5 : 5+addrLen]
-					targetAddr = string(addrBytes)
-					portBytes := buffer[5+addrLen : 7+addrLen]
-					targetPort = int(binary.BigEndian.Uint16(portBytes))
-					payload = buffer[7+addrLen : n]
-				case 0x04: // IPv6
-					addrBytes := buffer[4:20]
-					targetAddr = net.IP(addrBytes).String()
-					portBytes := buffer[20:22]
-					targetPort = int(binary.BigEndian.Uint16(portBytes))
-					payload = buffer[22:n]
-				default:
-					r.log.Trace().Msg("Cannot parse UDP packet from associated port")
-					continue
-				}
+			targetAddr, targetPort, payload, err := socks5.ParseUDPDatagram(buffer[:n])
+			if err != nil {
+				r.log.Trace().Err(err).Msg("Cannot parse UDP packet from associated port")
+				continue
+			}
 
-				// Update activity time
-				r.updateActivityTime(channelID)
+			// Update activity time
+			r.updateActivityTime(channelID)
 
-				msg := DataMessage{
-					Protocol:    "udp",
-					ChannelID:   channelID,
-					Data:        payload,
-					TargetAddr:  targetAddr,
-					TargetPort:  targetPort,
-					Compression: r.determineCompression(len(payload)),
-				}
-				r.logMessage(msg, "send", ws.Label())
-				if err := ws.WriteMessage(msg); err != nil {
-					errChan <- fmt.Errorf("websocket write error: %w", err)
-					return
-				}
-				r.log.Trace().Int("size", len(payload)).Msg("Sent UDP data to WebSocket")
+			msg := DataMessage{
+				Protocol:    "udp",
+				ChannelID:   channelID,
+				Data:        payload,
+				TargetAddr:  targetAddr,
+				TargetPort:  targetPort,
+				Compression: r.determineCompression(ws, payload),
+			}
+			r.logMessage(msg, "send", ws.Label())
+			if err := ws.WriteMessage(msg); err != nil {
+				errChan <- fmt.Errorf("websocket write error: %w", err)
+				return
 			}
+			r.log.Trace().Int("size", len(payload)).Msg("Sent UDP data to WebSocket")
 		}
 	}()
 
@@ -1306,29 +1021,12 @@ func (r *Relay) HandleSocksUDPForward(ctx context.Context, ws *WSConn, udpConn *
 				r.updateActivityTime(channelID)
 
 				// Construct SOCKS UDP header
-				udpHeader := []byte{0, 0, 0} // RSV + FRAG
-
-				// Try parsing as IPv4
-				if ip := net.ParseIP(dataMsg.Address); ip != nil {
-					if ip4 := ip.To4(); ip4 != nil {
-						udpHeader = append(udpHeader, 0x01) // IPv4
-						udpHeader = append(udpHeader, ip4...)
-					} else {
-						udpHeader = append(udpHeader, 0x04) // IPv6
-						udpHeader = append(udpHeader, ip...)
-					}
-				} else {
-					// Treat as domain name
-					domainBytes := []byte(dataMsg.Address)
-					udpHeader = append(udpHeader, 0x03) // Domain
-					udpHeader = append(udpHeader, byte(len(domainBytes)))
-					udpHeader = append(udpHeader, domainBytes...)
+				datagram, err := socks5.AppendUDPHeader(make([]byte, 0, len(dataMsg.Data)+262), dataMsg.Address, dataMsg.Port)
+				if err != nil {
+					r.log.Debug().Err(err).Msg("Dropping UDP packet: cannot encode source address")
+					continue
 				}
-
-				portBytes := make([]byte, 2)
-				binary.BigEndian.PutUint16(portBytes, uint16(dataMsg.Port))
-				udpHeader = append(udpHeader, portBytes...)
-				udpHeader = append(udpHeader, dataMsg.Data...)
+				datagram = append(datagram, dataMsg.Data...)
 
 				addr, ok := r.udpClientAddrs.Load(dataMsg.ChannelID)
 				if !ok {
@@ -1337,7 +1035,7 @@ func (r *Relay) HandleSocksUDPForward(ctx context.Context, ws *WSConn, udpConn *
 				}
 
 				clientAddr := addr.(*net.UDPAddr)
-				if _, err := udpConn.WriteToUDP(udpHeader, clientAddr); err != nil {
+				if _, err := udpConn.WriteToUDP(datagram, clientAddr); err != nil {
 					errChan <- fmt.Errorf("udp write error: %w", err)
 					return
 				}
@@ -1427,10 +1125,45 @@ func (r *Relay) Close() {
 	})
 }
 
-// determineCompression decides compression method based on data size
-func (r *Relay) determineCompression(dataSize int) byte {
-	if dataSize >= r.option.CompressionThreshold {
-		return DataCompressionGzip
+// determineCompression decides the compression of data sent on ws, using the compression
+// negotiated for ws when the data is large enough or, in adaptive mode, looks compressible
+func (r *Relay) determineCompression(ws *WSConn, data []byte) byte {
+	compression := ws.Compression()
+	if compression == DataCompressionNone {
+		return DataCompressionNone
+	}
+	if r.option.AdaptiveCompression {
+		if len(data) >= adaptiveCompressionMinSize && isCompressible(data) {
+			return compression
+		}
+		return DataCompressionNone
+	}
+	if len(data) >= r.option.CompressionThreshold {
+		return compression
+	}
+	return DataCompressionNone
+}
+
+// acceptedCompressions returns the accepted compressions in preference order
+func (r *Relay) acceptedCompressions() []byte {
+	if r.option.Compressions == nil {
+		return Compressions()
+	}
+	return r.option.Compressions
+}
+
+// selectCompression returns the first of the offered compressions that is also accepted
+func (r *Relay) selectCompression(offered []byte) byte {
+	accepted := r.acceptedCompressions()
+	for _, id := range offered {
+		if _, ok := getCompressor(id); !ok {
+			continue
+		}
+		for _, a := range accepted {
+			if a == id {
+				return id
+			}
+		}
 	}
 	return DataCompressionNone
 }
@@ -1452,6 +1185,14 @@ func (r *Relay) disconnectChannel(channelID uuid.UUID) {
 	r.connectionSuccessMap.Delete(channelID)
 }
 
+// closeConnChannels disconnects the channels still open on a connection that ended, unblocking
+// their readers
+func (r *Relay) closeConnChannels(ws *WSConn) {
+	for _, channelID := range ws.closeChannels() {
+		r.disconnectChannel(channelID)
+	}
+}
+
 // SetConnectionSuccess sets the connection success status for a channel
 func (r *Relay) SetConnectionSuccess(channelID uuid.UUID) {
 	r.connectionSuccessMap.Store(channelID, true)
@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -49,12 +53,20 @@ type WSSocksServer struct {
 	tokenIndexes    map[string]int                  // Round-robin indexes for load balancing
 	tokenOptions    map[string]*ReverseTokenOptions // options per token
 	connectorTokens map[string]string               // Maps connector tokens to their reverse tokens
+	connectorMeta   map[string]connectorMeta        // Creation of connector tokens
 	internalTokens  map[string][]string             // Maps original token to list of internal tokens
 	sha256TokenMap  map[string]string               // Maps SHA256 tokens to original tokens
+	tokenLimits     map[string]TokenLimits          // Limits of the tokens restricted
+	tokenBytes      map[string]int64                // Bytes transferred by disconnected clients of limited tokens
+	tokenWarned     map[string]bool                 // Limited tokens whose clients were warned of expiry
+	sweepOnce       sync.Once                       // Starts the sweeping of limited tokens
 
 	// Connector management
 	connCache *connectorCache
 
+	// Listeners accepting the connections requested through tokens
+	listeners map[string]*tokenListener
+
 	// Active SOCKS servers
 	socksTasks map[int]context.CancelFunc // Active SOCKS server tasks
 
@@ -64,15 +76,41 @@ type WSSocksServer struct {
 	socketManager  *SocketManager
 
 	// API server
-	apiKey string
+	apiKeys []APIKey
+	events  *eventHub
+
+	// Banned client instances and IPs
+	bans  map[string]Ban
+	banMu sync.Mutex
+
+	// Reverse proxies whose forwarded client IP headers are trusted
+	trustedProxies []*net.IPNet
+
+	// HTTP routing
+	basePath    string
+	socketPaths []string
+	decoy       http.Handler
+
+	// TLS/TCP and QUIC transports
+	tcpPort      int
+	quicPort     int
+	tlsConfig    *tls.Config
+	tcpListener  net.Listener
+	quicListener *quicListener
+
+	// Sessions of clients using the poll transport
+	pollSessions sync.Map
 
 	// Error channel
 	errors chan error // Channel for errors
 }
 
 type clientInfo struct {
-	ID   uuid.UUID
-	Conn *WSConn
+	ID       uuid.UUID
+	Conn     *WSConn
+	Token    string    // Token the client authenticated with
+	Type     string    // "forward", "reverse" or "connector"
+	Instance uuid.UUID // Client instance, shared by its threads, nil if unknown
 }
 
 type waitingSocket struct {
@@ -98,20 +136,31 @@ func newConnectorCache() *connectorCache {
 
 // ServerOption represents configuration options for WSSocksServer
 type ServerOption struct {
-	WSHost           string
-	WSPort           int
-	SocksHost        string
-	PortPool         *PortPool
-	SocksWaitClient  bool
-	Logger           zerolog.Logger
-	BufferSize       int
-	APIKey           string
-	ChannelTimeout   time.Duration
-	ConnectTimeout   time.Duration
-	StrictConnect    bool
-	UpstreamProxy    string
-	UpstreamUsername string
-	UpstreamPassword string
+	WSHost              string
+	WSPort              int
+	SocksHost           string
+	PortPool            *PortPool
+	SocksWaitClient     bool
+	Logger              zerolog.Logger
+	BufferSize          int
+	APIKey              string
+	APIKeys             []APIKey // Scoped API keys, in addition to the admin APIKey
+	ChannelTimeout      time.Duration
+	ConnectTimeout      time.Duration
+	StrictConnect       bool
+	UpstreamProxy       string
+	UpstreamUsername    string
+	UpstreamPassword    string
+	Dialer              Dialer       // Dialer for outbound connections, nil to dial directly
+	Compressions        []byte       // Accepted compressions in preference order, nil for all registered ones
+	AdaptiveCompression bool         // Decide compression by sampling the data instead of by size
+	TCPPort             int          // TLS/TCP transport listen port on WSHost, disabled if 0
+	QUICPort            int          // QUIC transport UDP listen port on WSHost, disabled if 0
+	TLSConfig           *tls.Config  // Certificate of the TLS/TCP and QUIC transports
+	BasePath            string       // Path prefix of all endpoints, e.g. /wssocks, empty for the root
+	SocketPaths         []string     // Paths of the client endpoints below the base path, /socket if empty
+	Decoy               http.Handler // Serves the root page and unknown paths instead of the banner
+	TrustedProxies      []string     // IPs or CIDR ranges of the proxies whose forwarded client IP headers are trusted
 }
 
 // DefaultServerOption returns default server options
@@ -182,6 +231,12 @@ func (o *ServerOption) WithAPI(apiKey string) *ServerOption {
 	return o
 }
 
+// WithAPIKeys sets scoped keys to enable the HTTP API
+func (o *ServerOption) WithAPIKeys(keys ...APIKey) *ServerOption {
+	o.APIKeys = keys
+	return o
+}
+
 // WithChannelTimeout sets the channel timeout duration
 func (o *ServerOption) WithChannelTimeout(timeout time.Duration) *ServerOption {
 	o.ChannelTimeout = timeout
@@ -213,6 +268,71 @@ func (o *ServerOption) WithUpstreamAuth(username, password string) *ServerOption
 	return o
 }
 
+// WithDialer sets the dialer used for outbound TCP and UDP traffic
+func (o *ServerOption) WithDialer(dialer Dialer) *ServerOption {
+	o.Dialer = dialer
+	return o
+}
+
+// WithCompressions sets the accepted compressions in preference order, an empty list disables compression
+func (o *ServerOption) WithCompressions(compressions []byte) *ServerOption {
+	o.Compressions = compressions
+	return o
+}
+
+// WithAdaptiveCompression controls whether compression is decided by sampling the data
+func (o *ServerOption) WithAdaptiveCompression(adaptive bool) *ServerOption {
+	o.AdaptiveCompression = adaptive
+	return o
+}
+
+// WithTCPPort sets the port of the TLS/TCP transport, which requires a TLS config
+func (o *ServerOption) WithTCPPort(port int) *ServerOption {
+	o.TCPPort = port
+	return o
+}
+
+// WithQUICPort sets the UDP port of the QUIC transport, which requires a TLS config
+func (o *ServerOption) WithQUICPort(port int) *ServerOption {
+	o.QUICPort = port
+	return o
+}
+
+// WithTLSConfig sets the TLS config, holding the certificate, of the TLS/TCP and QUIC transports
+func (o *ServerOption) WithTLSConfig(config *tls.Config) *ServerOption {
+	o.TLSConfig = config
+	return o
+}
+
+// WithBasePath sets the path prefix of all endpoints, e.g. /wssocks serves clients on
+// /wssocks/socket and the API on /wssocks/api
+func (o *ServerOption) WithBasePath(basePath string) *ServerOption {
+	o.BasePath = basePath
+	return o
+}
+
+// WithSocketPaths sets the paths below the base path on which clients connect, e.g. /socket and
+// /ws, each serving the HTTP transports below it as well
+func (o *ServerOption) WithSocketPaths(paths ...string) *ServerOption {
+	o.SocketPaths = paths
+	return o
+}
+
+// WithDecoy sets a handler serving the root page and unknown paths, such as a static site, so
+// the server does not reveal itself to visitors
+func (o *ServerOption) WithDecoy(decoy http.Handler) *ServerOption {
+	o.Decoy = decoy
+	return o
+}
+
+// WithTrustedProxies sets the IPs or CIDR ranges of the reverse proxies in front of the server,
+// such as a CDN. Client IPs are only taken from the CF-Connecting-IP and X-Forwarded-For
+// headers of their requests, other clients could forge them to evade IP bans.
+func (o *ServerOption) WithTrustedProxies(proxies ...string) *ServerOption {
+	o.TrustedProxies = proxies
+	return o
+}
+
 // NewWSSocksServer creates a new WSSocksServer instance
 func NewWSSocksServer(opt *ServerOption) *WSSocksServer {
 	if opt == nil {
@@ -225,7 +345,10 @@ func NewWSSocksServer(opt *ServerOption) *WSSocksServer {
 		WithConnectTimeout(opt.ConnectTimeout).
 		WithStrictConnect(opt.StrictConnect).
 		WithUpstreamProxy(opt.UpstreamProxy).
-		WithUpstreamAuth(opt.UpstreamUsername, opt.UpstreamPassword)
+		WithUpstreamAuth(opt.UpstreamUsername, opt.UpstreamPassword).
+		WithDialer(opt.Dialer).
+		WithCompressions(opt.Compressions).
+		WithAdaptiveCompression(opt.AdaptiveCompression)
 
 	s := &WSSocksServer{
 		relay:           NewRelay(opt.Logger, relayOpt),
@@ -241,21 +364,63 @@ func NewWSSocksServer(opt *ServerOption) *WSSocksServer {
 		tokenClients:    make(map[string][]clientInfo),
 		tokenIndexes:    make(map[string]int),
 		connectorTokens: make(map[string]string),
+		connectorMeta:   make(map[string]connectorMeta),
 		connCache:       newConnectorCache(),
+		listeners:       make(map[string]*tokenListener),
 		tokenOptions:    make(map[string]*ReverseTokenOptions),
 		socksTasks:      make(map[int]context.CancelFunc),
 		socksWaitClient: opt.SocksWaitClient,
 		waitingSockets:  make(map[int]*waitingSocket),
 		socketManager:   NewSocketManager(opt.SocksHost, opt.Logger),
-		apiKey:          opt.APIKey,
+		apiKeys:         apiKeys(opt),
+		events:          newEventHub(),
+		tcpPort:         opt.TCPPort,
+		quicPort:        opt.QUICPort,
+		bans:            make(map[string]Ban),
+		basePath:        normalizeBasePath(opt.BasePath),
+		socketPaths:     normalizeSocketPaths(opt.SocketPaths),
+		decoy:           opt.Decoy,
+		tlsConfig:       opt.TLSConfig,
 		internalTokens:  make(map[string][]string),
 		sha256TokenMap:  make(map[string]string),
+		tokenLimits:     make(map[string]TokenLimits),
+		tokenBytes:      make(map[string]int64),
+		tokenWarned:     make(map[string]bool),
 		errors:          make(chan error, 1),
 	}
 
+	trustedProxies, err := parseTrustedProxies(opt.TrustedProxies)
+	if err != nil {
+		s.log.Warn().Err(err).Msg("Ignoring trusted proxies")
+	}
+	s.trustedProxies = trustedProxies
+
 	return s
 }
 
+// normalizeBasePath returns the base path with a leading slash and without a trailing one
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// normalizeSocketPaths returns the socket paths in the form of base paths, /socket if none is set
+func normalizeSocketPaths(paths []string) []string {
+	var normalized []string
+	for _, path := range paths {
+		if path = normalizeBasePath(path); path != "" {
+			normalized = append(normalized, path)
+		}
+	}
+	if len(normalized) == 0 {
+		return []string{"/socket"}
+	}
+	return normalized
+}
+
 // generateRandomToken generates a random token string
 func generateRandomToken(length int) string {
 	b := make([]byte, length/2)
@@ -270,6 +435,7 @@ type ReverseTokenOptions struct {
 	Username             string
 	Password             string
 	AllowManageConnector bool // Allows managing connectors via WebSocket messages
+	TokenLimits
 }
 
 // DefaultReverseTokenOptions returns default options for reverse token
@@ -333,7 +499,9 @@ func (s *WSSocksServer) AddReverseToken(opts *ReverseTokenOptions) (string, int,
 	if opts.AllowManageConnector {
 		s.tokens[token] = -1 // Use -1 to indicate no SOCKS port
 		s.tokenOptions[token] = opts
+		s.setTokenLimits(token, opts.TokenLimits)
 		s.log.Info().Msg("New autonomy reverse token added")
+		s.events.publish(Event{Type: EventTokenAdded, Token: token, Detail: "reverse"})
 		return token, -1, nil
 	}
 
@@ -351,6 +519,7 @@ func (s *WSSocksServer) AddReverseToken(opts *ReverseTokenOptions) (string, int,
 	// Store token information
 	s.tokens[token] = assignedPort
 	s.tokenOptions[token] = opts
+	s.setTokenLimits(token, opts.TokenLimits)
 
 	// Start SOCKS server immediately if we're not waiting for clients
 	if s.wsServer != nil && !s.socksWaitClient {
@@ -364,12 +533,159 @@ func (s *WSSocksServer) AddReverseToken(opts *ReverseTokenOptions) (string, int,
 	}
 
 	s.log.Info().Int("port", assignedPort).Msg("New reverse proxy token added")
+	s.events.publish(Event{Type: EventTokenAdded, Token: token, Detail: "reverse"})
 	s.log.Debug().Str("sha256Token", sha256Token).Msg("SHA256 for the token")
 	return token, assignedPort, nil
 }
 
+// ReverseTokenOptions returns a copy of the options of a reverse token
+func (s *WSSocksServer) ReverseTokenOptions(token string) (*ReverseTokenOptions, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.isReverseToken(token) {
+		return nil, false
+	}
+	opts := *s.tokenOptions[token]
+	return &opts, true
+}
+
+// UpdateReverseToken changes the options of a reverse token in place without disconnecting its
+// clients, moving the SOCKS server if the port changes, and returns the SOCKS port. A zero port
+// keeps the current one. SOCKS connections accepted on the old port are closed. Connector
+// autonomy is only turned on or off while no provider is connected.
+func (s *WSSocksServer) UpdateReverseToken(token string, opts *ReverseTokenOptions) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isReverseToken(token) {
+		return 0, fmt.Errorf("reverse token not found")
+	}
+
+	updated := *opts
+	updated.Token = token
+	port := s.tokens[token]
+
+	// Providers stay registered the way they connected, autonomy ones under internal tokens
+	// with connectors of their own, so the mode only changes while none is connected
+	autonomy := s.tokenOptions[token] != nil && s.tokenOptions[token].AllowManageConnector
+	if updated.AllowManageConnector != autonomy && s.hasProviders(token) {
+		return 0, fmt.Errorf("cannot change allow_manage_connector while providers are connected")
+	}
+
+	// Autonomy tokens have no SOCKS port
+	newPort := port
+	if updated.AllowManageConnector {
+		newPort = -1
+	} else if port <= 0 || (updated.Port != 0 && updated.Port != port) {
+		newPort = s.portPool.Get(updated.Port)
+		if newPort == 0 {
+			return 0, fmt.Errorf("cannot allocate port: %d", updated.Port)
+		}
+	}
+	if newPort > 0 {
+		updated.Port = newPort
+	}
+
+	if newPort != port {
+		_, running := s.socksTasks[port]
+		start := newPort > 0 && (running || len(s.tokenClients[token]) > 0 || (s.wsServer != nil && !s.socksWaitClient))
+
+		// Bind the new port first so that a failure leaves the token unchanged
+		if start {
+			if _, err := s.socketManager.GetListener(newPort); err != nil {
+				s.portPool.Put(newPort)
+				return 0, err
+			}
+			defer s.socketManager.ReleaseListener(newPort)
+		}
+
+		if cancel, exists := s.socksTasks[port]; exists {
+			cancel()
+			delete(s.socksTasks, port)
+		}
+		if port > 0 {
+			s.portPool.Put(port)
+		}
+		s.tokens[token] = newPort
+
+		if start {
+			ctx, cancel := context.WithCancel(context.Background())
+			s.socksTasks[newPort] = cancel
+			go func() {
+				if err := s.runSocksServer(ctx, token, newPort); err != nil {
+					s.log.Warn().Err(err).Int("port", newPort).Msg("SOCKS server error")
+				}
+			}()
+		}
+	}
+
+	// Internal tokens of autonomy clients share the options of their token, and are dropped
+	// with the autonomy mode
+	s.tokenOptions[token] = &updated
+	s.setTokenLimits(token, updated.TokenLimits)
+	for _, internalToken := range s.internalTokens[token] {
+		if updated.AllowManageConnector {
+			s.tokenOptions[internalToken] = &updated
+			continue
+		}
+		delete(s.tokens, internalToken)
+		delete(s.tokenIndexes, internalToken)
+		delete(s.tokenOptions, internalToken)
+	}
+	if !updated.AllowManageConnector {
+		delete(s.internalTokens, token)
+	}
+
+	s.log.Info().Str("token", token).Int("port", newPort).Msg("Reverse token updated")
+	return newPort, nil
+}
+
+// hasProviders reports whether clients are connected to a reverse token, including the
+// autonomy clients registered under its internal tokens, with the server lock held
+func (s *WSSocksServer) hasProviders(token string) bool {
+	if len(s.tokenClients[token]) > 0 {
+		return true
+	}
+	for _, internalToken := range s.internalTokens[token] {
+		if len(s.tokenClients[internalToken]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isReverseToken reports whether a token is a reverse token added to the server, as opposed to
+// the internal tokens of autonomy clients
+func (s *WSSocksServer) isReverseToken(token string) bool {
+	if _, exists := s.tokenOptions[token]; !exists {
+		return false
+	}
+	for _, internalTokens := range s.internalTokens {
+		for _, internalToken := range internalTokens {
+			if internalToken == token {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ForwardTokenOptions represents configuration options for a forward token
+type ForwardTokenOptions struct {
+	Token string
+	TokenLimits
+}
+
 // AddForwardToken adds a new token for forward socks proxy
 func (s *WSSocksServer) AddForwardToken(token string) (string, error) {
+	return s.AddForwardTokenWithOptions(&ForwardTokenOptions{Token: token})
+}
+
+// AddForwardTokenWithOptions adds a new token for forward socks proxy with limits
+func (s *WSSocksServer) AddForwardTokenWithOptions(opts *ForwardTokenOptions) (string, error) {
+	token := opts.Token
+
 	// Check if token already exists
 	if token != "" && s.tokenExists(token) {
 		return "", fmt.Errorf("token already exists")
@@ -388,13 +704,21 @@ func (s *WSSocksServer) AddForwardToken(token string) (string, error) {
 	s.sha256TokenMap[sha256Token] = token
 
 	s.forwardTokens[token] = struct{}{}
+	s.setTokenLimits(token, opts.TokenLimits)
 	s.log.Info().Msg("New forward proxy token added")
+	s.events.publish(Event{Type: EventTokenAdded, Token: token, Detail: "forward"})
 	s.log.Debug().Str("sha256Token", sha256Token).Msg("SHA256 for the token")
 	return token, nil
 }
 
 // AddConnectorToken adds a new connector token that forwards requests to a reverse token
 func (s *WSSocksServer) AddConnectorToken(connectorToken string, reverseToken string) (string, error) {
+	return s.addConnectorToken(connectorToken, reverseToken, uuid.Nil)
+}
+
+// addConnectorToken adds a connector token, createdBy is the provider adding it with a connector
+// message, nil if added on the server
+func (s *WSSocksServer) addConnectorToken(connectorToken string, reverseToken string, createdBy uuid.UUID) (string, error) {
 	// Check if connector token already exists
 	if connectorToken != "" && s.tokenExists(connectorToken) {
 		return "", fmt.Errorf("connector token already exists")
@@ -420,16 +744,29 @@ func (s *WSSocksServer) AddConnectorToken(connectorToken string, reverseToken st
 
 	// Store connector token mapping
 	s.connectorTokens[connectorToken] = reverseToken
+	s.connectorMeta[connectorToken] = connectorMeta{createdAt: time.Now(), createdBy: createdBy}
 
 	s.log.Info().Msg("New connector token added")
+	event := Event{Type: EventConnectorAdded, Token: connectorToken}
+	if createdBy != uuid.Nil {
+		event.ClientID = createdBy.String()
+	}
+	s.events.publish(event)
 
 	return connectorToken, nil
 }
 
-// RemoveToken removes a token and disconnects all its clients
+// RemoveToken removes a token and disconnects all its clients, returning false if the token
+// does not exist
 func (s *WSSocksServer) RemoveToken(token string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.removeToken(token)
+}
+
+// removeToken removes a token, must be called with the server lock held
+func (s *WSSocksServer) removeToken(token string) bool {
+	s.removeTokenLimits(token)
 
 	// Clean up any internal tokens first
 	if internalTokens, exists := s.internalTokens[token]; exists {
@@ -473,8 +810,10 @@ func (s *WSSocksServer) RemoveToken(token string) bool {
 
 		// Clean up token related data
 		delete(s.connectorTokens, token)
+		delete(s.connectorMeta, token)
 
 		s.log.Info().Str("token", token).Msg("Connector token removed")
+		s.events.publish(Event{Type: EventTokenRemoved, Token: token, Detail: "connector"})
 
 		return true
 	}
@@ -484,7 +823,7 @@ func (s *WSSocksServer) RemoveToken(token string) bool {
 		// Remove all connector tokens using this reverse token
 		for connectorToken, rt := range s.connectorTokens {
 			if rt == token {
-				s.RemoveToken(connectorToken)
+				s.removeToken(connectorToken)
 			}
 		}
 
@@ -497,6 +836,12 @@ func (s *WSSocksServer) RemoveToken(token string) bool {
 			delete(s.tokenClients, token)
 		}
 
+		// Close listener of the token if any
+		if listener, exists := s.listeners[token]; exists {
+			listener.shutdown()
+			delete(s.listeners, token)
+		}
+
 		// Clean up token related data
 		delete(s.tokens, token)
 		delete(s.tokenIndexes, token)
@@ -512,6 +857,7 @@ func (s *WSSocksServer) RemoveToken(token string) bool {
 		s.portPool.Put(port)
 
 		s.log.Info().Str("token", token).Msg("Reverse token removed")
+		s.events.publish(Event{Type: EventTokenRemoved, Token: token, Detail: "reverse"})
 
 		return true
 	}
@@ -527,15 +873,22 @@ func (s *WSSocksServer) RemoveToken(token string) bool {
 			delete(s.tokenClients, token)
 		}
 
+		// Close listener of the token if any
+		if listener, exists := s.listeners[token]; exists {
+			listener.shutdown()
+			delete(s.listeners, token)
+		}
+
 		// Clean up token related data
 		delete(s.forwardTokens, token)
 
 		s.log.Info().Str("token", token).Msg("Forward token removed")
+		s.events.publish(Event{Type: EventTokenRemoved, Token: token, Detail: "forward"})
 
 		return true
 	}
 
-	return true
+	return false
 }
 
 // handlePendingToken handles starting SOCKS server for a token
@@ -564,8 +917,16 @@ func (s *WSSocksServer) handlePendingToken(ctx context.Context, token string) er
 	return nil
 }
 
-// Serve starts the WebSocket server and waits for clients
-func (s *WSSocksServer) Serve(ctx context.Context) error {
+// Handler returns the HTTP handler serving clients, the API and the root page below the base
+// path, to be mounted into an existing server instead of calling Serve. Connections are served
+// until ctx is done, and token limits enforced until the ctx of the first call is done. The
+// SOCKS servers of reverse tokens start once their clients connect.
+func (s *WSSocksServer) Handler(ctx context.Context) http.Handler {
+	// Remove the tokens that expire or exceed their byte limit, once for all handlers
+	s.sweepOnce.Do(func() {
+		go s.sweepTokens(ctx)
+	})
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins
@@ -575,29 +936,19 @@ func (s *WSSocksServer) Serve(ctx context.Context) error {
 	mux := http.NewServeMux()
 
 	// Register API handlers if enabled
-	if s.apiKey != "" {
-		apiHandler := NewAPIHandler(s, s.apiKey)
+	if len(s.apiKeys) > 0 {
+		apiHandler := NewAPIHandlerWithKeys(s, s.apiKeys)
 		apiHandler.RegisterHandlers(mux)
-		s.log.Info().Int("port", s.wsPort).Msg("API endpoints enabled")
 	}
 
-	handleWSUpgrade := func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			s.log.Warn().Err(err).Msg("Failed to upgrade connection")
+	// The root page and unknown paths
+	handleRoot := func(w http.ResponseWriter, r *http.Request) {
+		if s.decoy != nil {
+			s.decoy.ServeHTTP(w, r)
 			return
 		}
-		go s.handleWebSocket(ctx, conn, r)
-	}
-
-	// Register WebSocket handlers
-	mux.HandleFunc("/socket/", handleWSUpgrade)
-	mux.HandleFunc("/socket", handleWSUpgrade)
-
-	// Update root handler
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
-			if s.apiKey != "" {
+			if len(s.apiKeys) > 0 {
 				fmt.Fprintf(w, "WSSocks %s is running. API endpoints available at /api/*\n", Version)
 			} else {
 				fmt.Fprintf(w, "WSSocks %s is running but API is not enabled.\n", Version)
@@ -605,11 +956,80 @@ func (s *WSSocksServer) Serve(ctx context.Context) error {
 			return
 		}
 		http.NotFound(w, r)
+	}
+
+	// Clients use WebSocket, or the HTTP transports below the same path when it is blocked. Other
+	// paths below the socket path are unknown.
+	handleSocket := func(socketPath string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case socketPath, socketPath + "/":
+			case socketPath + "/" + TransportStream:
+				s.serveStream(ctx, w, r)
+				return
+			case socketPath + "/" + TransportPoll:
+				s.servePoll(ctx, w, r)
+				return
+			default:
+				handleRoot(w, r)
+				return
+			}
+			if !websocket.IsWebSocketUpgrade(r) && s.decoy != nil {
+				// Browsers see the decoy site instead of an upgrade error
+				s.decoy.ServeHTTP(w, r)
+				return
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				s.log.Warn().Err(err).Msg("Failed to upgrade connection")
+				return
+			}
+			go s.handleConnection(ctx, NewWSConn(conn, "", s.log), r)
+		}
+	}
+
+	// Register connection handlers
+	for _, socketPath := range s.socketPaths {
+		mux.HandleFunc(socketPath+"/", handleSocket(socketPath))
+		mux.HandleFunc(socketPath, handleSocket(socketPath))
+	}
+
+	// Update root handler
+	mux.HandleFunc("/", handleRoot)
+
+	if s.basePath == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, s.basePath)
+		if !ok || (rest != "" && rest[0] != '/') {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+
+		// Serve the request as if the base path was the root
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		mux.ServeHTTP(w, r2)
 	})
+}
+
+// Serve starts the WebSocket server and waits for clients
+func (s *WSSocksServer) Serve(ctx context.Context) error {
+	if len(s.apiKeys) > 0 {
+		s.log.Info().Int("port", s.wsPort).Msg("API endpoints enabled")
+	}
 
 	s.wsServer = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", s.wsHost, s.wsPort),
-		Handler: mux,
+		Handler: s.Handler(ctx),
 	}
 
 	// Handle all pending tokens
@@ -626,9 +1046,20 @@ func (s *WSSocksServer) Serve(ctx context.Context) error {
 		}
 	}
 
+	if s.tcpPort != 0 {
+		if err := s.listenTCP(ctx); err != nil {
+			return err
+		}
+	}
+	if s.quicPort != 0 {
+		if err := s.listenQUIC(ctx); err != nil {
+			return err
+		}
+	}
+
 	s.log.Info().
 		Str("listen", s.wsServer.Addr).
-		Str("url", fmt.Sprintf("http://localhost:%d", s.wsPort)).
+		Str("url", fmt.Sprintf("http://localhost:%d%s", s.wsPort, s.basePath)).
 		Msg("WSSocks Server started")
 	close(s.ready)
 
@@ -672,11 +1103,9 @@ func (s *WSSocksServer) WaitReady(ctx context.Context, timeout time.Duration) er
 	}
 }
 
-// handleWebSocket handles WebSocket connection
-func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn, r *http.Request) {
-	// Wrap the websocket connection
-	wsConn := NewWSConn(ws, "", s.log)
-	wsConn.SetClientIPFromRequest(r) // Extract and set client IP
+// handleConnection authenticates a client connection and serves it until it closes
+func (s *WSSocksServer) handleConnection(ctx context.Context, wsConn *WSConn, r *http.Request) {
+	wsConn.clientIP = getClientIPFromRequest(r, s.trustedProxies)
 
 	var clientID uuid.UUID
 	var token string
@@ -684,10 +1113,14 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 	var isValidReverse, isValidForward, isValidConnector bool
 	var reverseToken string
 	var isUrlAuth bool
-	var authMsg AuthMessage
+	var instance uuid.UUID
+	compressions := []byte{DataCompressionGzip} // Accepted by clients not negotiating compression
+	minVersion, maxVersion := MinProtocolVersion, MinProtocolVersion
+	var capabilities Capability
 
 	defer func() {
 		wsConn.Close()
+		s.relay.closeConnChannels(wsConn)
 		if clientID != uuid.Nil {
 			s.cleanupConnection(clientID, internalToken)
 		}
@@ -723,19 +1156,26 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 					}
 				}
 
+				instance, _ = uuid.Parse(query.Get("instance"))
+				if query.Has("compression") {
+					compressions = parseCompressionList(query.Get("compression"))
+				}
+				if versions := query.Get("version"); versions != "" {
+					minVersion, maxVersion = parseVersionRange(versions)
+				}
+				if caps, err := strconv.ParseUint(query.Get("capabilities"), 10, 32); err == nil {
+					capabilities = Capability(caps)
+				}
+
 				isUrlAuth = true
 			}
 			s.mu.RUnlock()
 			if !exists || (!isValidReverse && !isValidForward && !isValidConnector) {
-				authResponse := AuthResponseMessage{Success: false, Error: "invalid token"}
-				s.relay.logMessage(authResponse, "send", wsConn.Label())
-				wsConn.WriteMessage(authResponse)
+				s.refuseAuth(wsConn, "", "invalid token")
 				return
 			}
 		} else {
-			authResponse := AuthResponseMessage{Success: false, Error: "invalid token format"}
-			s.relay.logMessage(authResponse, "send", wsConn.Label())
-			wsConn.WriteMessage(authResponse)
+			s.refuseAuth(wsConn, "", "invalid token format")
 			return
 		}
 	} else {
@@ -743,22 +1183,22 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 		msg, err := wsConn.ReadMessage()
 		if err != nil {
 			s.log.Debug().Err(err).Msg("Failed to read auth message")
-			authResponse := AuthResponseMessage{Success: false, Error: "invalid auth message"}
-			s.relay.logMessage(authResponse, "send", wsConn.Label())
-			wsConn.WriteMessage(authResponse)
+			s.refuseAuth(wsConn, "", "invalid auth message")
 			return
 		}
 
 		s.relay.logMessage(msg, "recv", wsConn.Label())
 		authMsg, ok := msg.(AuthMessage)
 		if !ok {
-			authResponse := AuthResponseMessage{Success: false, Error: "invalid auth message"}
-			s.relay.logMessage(authResponse, "send", wsConn.Label())
-			wsConn.WriteMessage(authResponse)
+			s.refuseAuth(wsConn, "", "invalid auth message")
 			return
 		}
 
 		token = authMsg.Token
+		instance = authMsg.Instance
+		compressions = authMsg.Compressions
+		minVersion, maxVersion = authMsg.MinVersion, authMsg.MaxVersion
+		capabilities = authMsg.Capabilities
 		s.mu.RLock()
 		isValidReverse = authMsg.Reverse && s.tokens[token] != 0
 		_, hasForwardToken := s.forwardTokens[token]
@@ -769,17 +1209,46 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 		s.mu.RUnlock()
 
 		if !isValidReverse && !isValidForward && !isValidConnector {
-			authResponse := AuthResponseMessage{Success: false, Error: "invalid token"}
-			s.relay.logMessage(authResponse, "send", wsConn.Label())
-			wsConn.WriteMessage(authResponse)
+			s.refuseAuth(wsConn, "", "invalid token")
 			return
 		}
 	}
 
+	if s.isBanned(instance, wsConn.GetClientIP()) {
+		s.log.Info().Str("instance", instance.String()).Str("client_ip", wsConn.GetClientIP()).Msg("Refused banned client")
+		s.refuseAuth(wsConn, token, "banned")
+		return
+	}
+
+	version, ok := negotiateVersion(minVersion, maxVersion)
+	if !ok {
+		s.refuseAuth(wsConn, token, "unsupported protocol version")
+		return
+	}
+	capabilities &= LocalCapabilities
+	wsConn.setProtocol(version, capabilities, true)
+
 	clientID = uuid.New()
 	wsConn.setLabel(clientID.String())
-
+	compression := s.relay.selectCompression(negotiableCompressions(compressions, capabilities))
+	wsConn.setCompression(compression)
+	s.log.Debug().
+		Str("client_id", clientID.String()).
+		Uint8("version", version).
+		Uint32("capabilities", uint32(capabilities)).
+		Str("compression", CompressionName(compression)).
+		Msg("Protocol negotiated")
+
+	// The limits are checked under the lock registering the client, so that concurrent clients
+	// cannot exceed them together
 	s.mu.Lock()
+	if reason := s.checkTokenLimits(token); reason != "" {
+		s.mu.Unlock()
+		s.log.Info().Str("client_ip", wsConn.GetClientIP()).Str("reason", reason).Msg("Refused client over token limits")
+		s.refuseAuth(wsConn, token, reason)
+		return
+	}
+
 	// For reverse tokens with AllowManageConnector, generate a unique internal token
 	if isValidReverse {
 		opts, exists := s.tokenOptions[token]
@@ -787,7 +1256,7 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 			if isUrlAuth {
 				internalToken = uuid.New().String()
 			} else {
-				internalToken = authMsg.Instance.String()
+				internalToken = instance.String()
 			}
 			s.tokenIndexes[internalToken] = 0
 			s.tokenOptions[internalToken] = opts
@@ -803,10 +1272,31 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 	if _, exists := s.tokenClients[internalToken]; !exists {
 		s.tokenClients[internalToken] = make([]clientInfo, 0)
 	}
-	s.tokenClients[internalToken] = append(s.tokenClients[internalToken], clientInfo{ID: clientID, Conn: wsConn})
+	clientType := "forward"
+	if isValidReverse {
+		clientType = "reverse"
+	} else if isValidConnector {
+		clientType = "connector"
+	}
+	s.tokenClients[internalToken] = append(s.tokenClients[internalToken], clientInfo{
+		ID:       clientID,
+		Conn:     wsConn,
+		Token:    token,
+		Type:     clientType,
+		Instance: instance,
+	})
 	s.clients[clientID] = wsConn
+	wsConn.setChannelHook(s.channelEvents(token, clientID))
 	s.mu.Unlock()
 
+	s.events.publish(Event{
+		Type:     EventClientConnected,
+		Token:    token,
+		ClientID: clientID.String(),
+		IP:       wsConn.GetClientIP(),
+		Detail:   clientType,
+	})
+
 	if isValidReverse {
 		// Handle reverse proxy client
 		s.mu.Lock()
@@ -836,7 +1326,12 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 		s.log.Info().Str("client_id", clientID.String()).Str("client_ip", wsConn.GetClientIP()).Msg("Forward client authenticated")
 	}
 
-	authResponse := AuthResponseMessage{Success: true}
+	authResponse := AuthResponseMessage{
+		Success:      true,
+		Compression:  compression,
+		Version:      version,
+		Capabilities: capabilities,
+	}
 	s.relay.logMessage(authResponse, "send", wsConn.Label())
 	if err := wsConn.WriteMessage(authResponse); err != nil {
 		s.log.Debug().Err(err).Msg("Failed to send auth response")
@@ -865,7 +1360,7 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 		}
 	}
 
-	// Start message handling goroutines
+	// Start message handling goroutines, stopped with the connection
 	errChan := make(chan error, 2)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -877,16 +1372,46 @@ func (s *WSSocksServer) handleWebSocket(ctx context.Context, ws *websocket.Conn,
 		}()
 	} else {
 		go func() {
-			errChan <- s.messageDispatcher(ctx, wsConn, clientID)
+			errChan <- s.messageDispatcher(ctx, wsConn, clientID, token)
 		}()
 	}
 
+	// Measure the round-trip time of the client, other transports check liveness themselves
+	if wsConn.hasControl() {
+		go s.heartbeat(ctx, wsConn)
+	}
+
 	// Wait for either routine to finish
 	<-errChan
 }
 
+// refuseAuth answers a client failing authentication and publishes the failure
+func (s *WSSocksServer) refuseAuth(wsConn *WSConn, token string, reason string) {
+	authResponse := AuthResponseMessage{Success: false, Error: reason}
+	s.relay.logMessage(authResponse, "send", wsConn.Label())
+	wsConn.WriteMessage(authResponse)
+	s.events.publish(Event{Type: EventAuthFailed, Token: token, IP: wsConn.GetClientIP(), Detail: reason})
+}
+
+// heartbeat pings a client periodically, its pongs update the RTT of the connection
+func (s *WSSocksServer) heartbeat(ctx context.Context, ws *WSConn) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := ws.SyncWriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // messageDispatcher handles WebSocket message distribution
-func (s *WSSocksServer) messageDispatcher(ctx context.Context, ws *WSConn, clientID uuid.UUID) error {
+func (s *WSSocksServer) messageDispatcher(ctx context.Context, ws *WSConn, clientID uuid.UUID, token string) error {
 	for {
 		select {
 		case <-ctx.Done():
@@ -922,6 +1447,8 @@ func (s *WSSocksServer) messageDispatcher(ctx context.Context, ws *WSConn, clien
 				s.connCache.mu.RUnlock()
 
 				if exists {
+					// The connector may not accept the compression of the sender
+					m.Compression = s.relay.determineCompression(targetWS, m.Data)
 					s.relay.logMessage(m, "send", ws.Label())
 					if err := targetWS.WriteMessage(m); err != nil {
 						s.log.Debug().Err(err).Msg("Failed to forward data message to connector client")
@@ -931,23 +1458,28 @@ func (s *WSSocksServer) messageDispatcher(ctx context.Context, ws *WSConn, clien
 				}
 
 			case ConnectMessage:
-				go func(m ConnectMessage) {
-					var isForwardClient bool
-					s.mu.RLock()
-					_, isForwardClient = s.clients[clientID]
-					s.mu.RUnlock()
-
-					if isForwardClient {
-						// Create buffered channel with larger capacity
-						msgChan := make(chan BaseMessage, 1000)
-						s.relay.messageQueues.Store(m.ChannelID, msgChan)
-						go func() {
-							if err := s.relay.HandleNetworkConnection(ctx, ws, m); err != nil && !errors.Is(err, context.Canceled) {
-								s.log.Debug().Err(err).Msg("Network connection handler error")
-							}
-						}()
-					}
-				}(m)
+				var isForwardClient bool
+				s.mu.RLock()
+				_, isForwardClient = s.clients[clientID]
+				s.mu.RUnlock()
+
+				if isForwardClient {
+					// Create the queue before reading the next message, so data sent right
+					// after the connect request in non-strict mode is not dropped
+					msgChan := make(chan BaseMessage, 1000)
+					s.relay.messageQueues.Store(m.ChannelID, msgChan)
+					go func(m ConnectMessage) {
+						var err error
+						if listener := s.listenerOf(token); listener != nil {
+							err = s.handleListenerConnect(ctx, ws, m, listener)
+						} else {
+							err = s.relay.HandleNetworkConnection(ctx, ws, m)
+						}
+						if err != nil && !errors.Is(err, context.Canceled) {
+							s.log.Debug().Err(err).Msg("Network connection handler error")
+						}
+					}(m)
+				}
 
 			case ConnectResponseMessage:
 				go func(m ConnectResponseMessage) {
@@ -1023,7 +1555,7 @@ func (s *WSSocksServer) handleConnectorMessage(m ConnectorMessage, ws *WSConn, c
 	} else {
 		switch m.Operation {
 		case "add":
-			newToken, err := s.AddConnectorToken(m.ConnectorToken, token)
+			newToken, err := s.addConnectorToken(m.ConnectorToken, token, clientID)
 			if err != nil {
 				response.Success = false
 				response.Error = err.Error()
@@ -1070,6 +1602,17 @@ func (s *WSSocksServer) connectorMessageDispatcher(ctx context.Context, ws *WSCo
 
 			switch m := msg.(type) {
 			case ConnectMessage:
+				if listener := s.listenerOf(reverseToken); listener != nil {
+					msgChan := make(chan BaseMessage, 1000)
+					s.relay.messageQueues.Store(m.ChannelID, msgChan)
+					go func(m ConnectMessage) {
+						if err := s.handleListenerConnect(ctx, ws, m, listener); err != nil && !errors.Is(err, context.Canceled) {
+							s.log.Debug().Err(err).Msg("Listener connection handler error")
+						}
+					}(m)
+					continue
+				}
+
 				go func(m ConnectMessage) {
 					reverseWS, err := s.getNextWebSocket(reverseToken)
 					if err != nil {
@@ -1105,10 +1648,22 @@ func (s *WSSocksServer) connectorMessageDispatcher(ctx context.Context, ws *WSCo
 				}(m)
 
 			case DataMessage:
+				// Channels served by a listener of the reverse token
+				if queue, ok := s.relay.messageQueues.Load(m.ChannelID); ok {
+					select {
+					case queue.(chan BaseMessage) <- m:
+					default:
+						s.log.Debug().Str("channel_id", m.ChannelID.String()).Msg("Message queue full, dropping message")
+					}
+					continue
+				}
+
 				// Route data message based on channel_id
 				s.connCache.mu.RLock()
 				targetWS, exists := s.connCache.channelIDToClient[m.ChannelID]
 				if exists {
+					// The provider may not accept the compression of the connector
+					m.Compression = s.relay.determineCompression(targetWS, m.Data)
 					s.relay.logMessage(m, "send", ws.Label())
 					if err := targetWS.WriteMessage(m); err != nil {
 						s.log.Debug().Err(err).Msg("Failed to forward data message")
@@ -1131,6 +1686,7 @@ func (s *WSSocksServer) connectorMessageDispatcher(ctx context.Context, ws *WSCo
 						delete(s.connCache.channelIDToClient, m.ChannelID)
 					}
 					s.connCache.mu.Unlock()
+					s.relay.disconnectChannel(m.ChannelID)
 				}(m)
 			}
 		}
@@ -1168,6 +1724,7 @@ func (s *WSSocksServer) cleanupConnection(clientID uuid.UUID, token string) {
 	if ws, exists := s.clients[clientID]; exists {
 		clientIP = ws.GetClientIP()
 	}
+	clientToken := token
 
 	// Clean up connection in tokenClients
 	if token != "" && s.tokenClients[token] != nil {
@@ -1175,6 +1732,12 @@ func (s *WSSocksServer) cleanupConnection(clientID uuid.UUID, token string) {
 		for _, client := range s.tokenClients[token] {
 			if client.ID != clientID {
 				clients = append(clients, client)
+				continue
+			}
+			clientToken = client.Token
+			if _, limited := s.tokenLimits[client.Token]; limited {
+				// Keep counting the bytes of the client towards the limit of its token
+				s.tokenBytes[client.Token] += int64(client.Conn.BytesSent() + client.Conn.BytesReceived())
 			}
 		}
 		if len(clients) == 0 {
@@ -1193,6 +1756,12 @@ func (s *WSSocksServer) cleanupConnection(clientID uuid.UUID, token string) {
 	delete(s.clients, clientID)
 
 	s.log.Info().Str("client_id", clientID.String()).Str("client_ip", clientIP).Msg("Client disconnected")
+	s.events.publish(Event{
+		Type:     EventClientDisconnected,
+		Token:    clientToken,
+		ClientID: clientID.String(),
+		IP:       clientIP,
+	})
 }
 
 // broadcastPartnersToConnectors sends the current number of reverse clients to all connectors
@@ -1383,6 +1952,12 @@ func (s *WSSocksServer) Close() {
 		delete(s.socksTasks, port)
 	}
 
+	// Close all listeners
+	for token, listener := range s.listeners {
+		listener.shutdown()
+		delete(s.listeners, token)
+	}
+
 	// Clean up all client connections
 	for clientID, ws := range s.clients {
 		ws.Close()
@@ -1397,6 +1972,18 @@ func (s *WSSocksServer) Close() {
 		s.wsServer = nil
 	}
 
+	// Close TLS/TCP transport listener if it exists
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+		s.tcpListener = nil
+	}
+
+	// Close QUIC transport listener if it exists
+	if s.quicListener != nil {
+		s.quicListener.Close()
+		s.quicListener = nil
+	}
+
 	// Cancel main worker if it exists
 	if s.cancelFunc != nil {
 		s.cancelFunc()
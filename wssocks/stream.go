@@ -0,0 +1,114 @@
+package wssocks
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// errInvalidStreamID is the protocol error of peers assigning stream IDs of the other side or
+// reusing them
+var errInvalidStreamID = errors.New("protocol error: invalid stream ID")
+
+// streamTable maps the channels of a WebSocket connection to the short stream IDs used by
+// compact data frames. Each peer assigns IDs to the channels it requests, clients using odd
+// IDs and servers even ones, and IDs are never reused on a connection. Connect messages are
+// written in the order of their IDs, so the IDs of a peer always increase.
+type streamTable struct {
+	mu       sync.Mutex
+	next     uint64 // Next ID assigned locally
+	peerNext uint64 // Lowest ID the peer may assign next
+	ids      map[uuid.UUID]uint64
+	channels map[uint64]uuid.UUID
+}
+
+func newStreamTable(server bool) *streamTable {
+	next, peerNext := uint64(1), uint64(2)
+	if server {
+		next, peerNext = 2, 1
+	}
+	return &streamTable{
+		next:     next,
+		peerNext: peerNext,
+		ids:      make(map[uuid.UUID]uint64),
+		channels: make(map[uint64]uuid.UUID),
+	}
+}
+
+// outgoing assigns or fills in the stream ID of a message about to be sent
+func (t *streamTable) outgoing(msg BaseMessage) BaseMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch m := msg.(type) {
+	case ConnectMessage:
+		m.StreamID = t.next
+		t.next += 2
+		t.register(m.StreamID, m.ChannelID)
+		return m
+	case DataMessage:
+		// Channels without a stream ID on this connection are sent as full frames
+		m.StreamID = t.ids[m.ChannelID]
+		return m
+	case ConnectResponseMessage:
+		if !m.Success {
+			t.unregister(m.ChannelID)
+		}
+	case DisconnectMessage:
+		t.unregister(m.ChannelID)
+	}
+	return msg
+}
+
+// incoming registers or resolves the stream ID of a received message, failing if the peer
+// assigned an ID it may not use
+func (t *streamTable) incoming(msg BaseMessage) (BaseMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch m := msg.(type) {
+	case ConnectMessage:
+		if m.StreamID != 0 {
+			if m.StreamID < t.peerNext || m.StreamID%2 != t.peerNext%2 {
+				return nil, fmt.Errorf("%w: %d", errInvalidStreamID, m.StreamID)
+			}
+			t.peerNext = m.StreamID + 2
+			t.register(m.StreamID, m.ChannelID)
+		}
+	case DataMessage:
+		if m.StreamID != 0 {
+			// Unknown streams resolve to uuid.Nil and are dropped as unknown channels
+			m.ChannelID = t.channels[m.StreamID]
+			return m, nil
+		}
+	case ConnectResponseMessage:
+		if !m.Success {
+			t.unregister(m.ChannelID)
+		}
+	case DisconnectMessage:
+		t.unregister(m.ChannelID)
+	}
+	return msg, nil
+}
+
+// forget frees the stream ID of a channel that ended without a message closing it
+func (t *streamTable) forget(channelID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unregister(channelID)
+}
+
+func (t *streamTable) register(streamID uint64, channelID uuid.UUID) {
+	t.unregister(channelID)
+	t.ids[channelID] = streamID
+	t.channels[streamID] = channelID
+}
+
+func (t *streamTable) unregister(channelID uuid.UUID) {
+	if streamID, ok := t.ids[channelID]; ok {
+		delete(t.ids, channelID)
+		delete(t.channels, streamID)
+	}
+}
@@ -0,0 +1,35 @@
+package wssocks
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamTableForget(t *testing.T) {
+	c := &WSConn{}
+	c.setProtocol(ProtocolVersion, LocalCapabilities, true)
+	streams := c.streams.Load()
+
+	// A channel requested by the peer and ended locally without a DisconnectMessage
+	channelID := uuid.New()
+	msg, err := streams.incoming(ConnectMessage{Protocol: "tcp", ChannelID: channelID, StreamID: 1})
+	require.NoError(t, err)
+	c.trackChannel(msg, false)
+	require.Len(t, streams.ids, 1)
+	require.Len(t, c.Channels(), 1)
+
+	c.forgetChannel(channelID)
+	require.Empty(t, streams.ids)
+	require.Empty(t, streams.channels)
+	require.Empty(t, c.Channels())
+
+	// Channels still open when the connection ends are freed as well
+	channelID = uuid.New()
+	msg = streams.outgoing(ConnectMessage{Protocol: "udp", ChannelID: channelID})
+	c.trackChannel(msg, true)
+	require.Equal(t, []uuid.UUID{channelID}, c.closeChannels())
+	require.Empty(t, streams.ids)
+	require.Empty(t, streams.channels)
+}
@@ -0,0 +1,318 @@
+package wssocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// transparentUDPTimeout is the idle time after which a transparent UDP session is closed
+	transparentUDPTimeout = 3 * time.Minute
+	// transparentUDPQueueSize is the number of datagrams buffered per session before dropping
+	transparentUDPQueueSize = 256
+)
+
+// transparentUDPPacket is a datagram received on the transparent UDP socket
+type transparentUDPPacket struct {
+	data []byte
+	dst  *net.UDPAddr
+}
+
+// transparentUDPSession tracks the channel used by a single transparent UDP client
+type transparentUDPSession struct {
+	client  *net.UDPAddr
+	packets chan transparentUDPPacket
+}
+
+// transparentNetwork returns the network to listen on for the given host, so that
+// IPv4 hosts use IPv4 sockets where the original destination can be recovered
+func transparentNetwork(proto string, host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return proto + "4"
+		}
+		return proto + "6"
+	}
+	return proto
+}
+
+// runTransparentServer runs the local transparent proxy for redirected TCP and UDP traffic
+func (c *WSSocksClient) runTransparentServer(ctx context.Context) error {
+	addr := net.JoinHostPort(c.transparentHost, strconv.Itoa(c.transparentPort))
+
+	listener, err := listenTransparentTCP(ctx, transparentNetwork("tcp", c.transparentHost), addr)
+	if err != nil {
+		return fmt.Errorf("failed to start transparent TCP listener: %w", err)
+	}
+
+	udpConn, err := listenTransparentUDP(ctx, transparentNetwork("udp", c.transparentHost), addr)
+	if err != nil {
+		c.log.Warn().Err(err).Msg("Transparent UDP is disabled, TPROXY requires CAP_NET_ADMIN")
+	}
+
+	c.mu.Lock()
+	c.transparentListener = listener
+	c.transparentUDP = udpConn
+	c.mu.Unlock()
+
+	c.log.Info().Str("addr", listener.Addr().String()).Msg("Transparent proxy started")
+
+	if udpConn != nil {
+		go c.serveTransparentUDP(ctx, udpConn)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				c.log.Warn().Err(err).Msg("Error accepting transparent connection")
+				continue
+			}
+
+			c.log.Debug().Str("remote_addr", conn.RemoteAddr().String()).Msg("Accepted transparent connection")
+			go c.handleTransparentTCP(ctx, conn)
+		}
+	}
+}
+
+// handleTransparentTCP relays a redirected TCP connection to its original destination
+func (c *WSSocksClient) handleTransparentTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := originalDestination(conn)
+	if err != nil {
+		c.log.Warn().Err(err).Msg("Cannot recover original destination of transparent connection")
+		return
+	}
+	if c.isTransparentLoop(dst.IP, dst.Port) {
+		c.log.Warn().Str("dst", dst.String()).Msg("Refusing transparent connection addressed to the proxy itself")
+		return
+	}
+
+	ws := c.waitWebSocket(10 * time.Second)
+	if ws == nil {
+		c.log.Warn().Msg("No valid websockets connection after waiting 10s, refusing transparent connection")
+		return
+	}
+
+	if err := c.relay.HandleTCPRequest(ctx, ws, conn, dst.IP.String(), dst.Port, nil); err != nil && !errors.Is(err, context.Canceled) {
+		c.log.Warn().Err(err).Msg("Error handling transparent connection")
+	}
+}
+
+// isTransparentLoop reports whether a recovered destination points back at the transparent listener
+func (c *WSSocksClient) isTransparentLoop(ip net.IP, port int) bool {
+	if port != c.transparentPort {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransparentUDP reads TPROXY datagrams and dispatches them to per-client sessions
+func (c *WSSocksClient) serveTransparentUDP(ctx context.Context, conn *net.UDPConn) {
+	var mu sync.Mutex
+	sessions := make(map[string]*transparentUDPSession)
+
+	buffer := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, src, dst, err := readTransparentUDP(conn, buffer, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c.log.Debug().Err(err).Msg("Transparent UDP read error")
+			continue
+		}
+		if c.isTransparentLoop(dst.IP, dst.Port) {
+			c.log.Debug().Str("dst", dst.String()).Msg("Dropping transparent UDP packet addressed to the proxy itself")
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		// Packets are queued under the lock sessions are removed with, so none is queued to a
+		// session that already ended
+		key := src.String()
+		mu.Lock()
+		session, exists := sessions[key]
+		if !exists {
+			session = &transparentUDPSession{
+				client:  src,
+				packets: make(chan transparentUDPPacket, transparentUDPQueueSize),
+			}
+			sessions[key] = session
+			go func() {
+				c.runTransparentUDPSession(ctx, session, func() bool {
+					// Idle sessions only end if no packet was queued meanwhile
+					mu.Lock()
+					defer mu.Unlock()
+					if len(session.packets) > 0 {
+						return false
+					}
+					delete(sessions, key)
+					return true
+				})
+				mu.Lock()
+				if sessions[key] == session {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+			}()
+		}
+		select {
+		case session.packets <- transparentUDPPacket{data: data, dst: dst}:
+		default:
+			c.log.Debug().Str("client", key).Msg("Transparent UDP queue full, dropping packet")
+		}
+		mu.Unlock()
+	}
+}
+
+// runTransparentUDPSession relays datagrams of one transparent UDP client through a UDP channel,
+// ending once idle if end reports that the session was removed
+func (c *WSSocksClient) runTransparentUDPSession(ctx context.Context, session *transparentUDPSession, end func() bool) {
+	ws := c.waitWebSocket(10 * time.Second)
+	if ws == nil {
+		c.log.Warn().Msg("No valid websockets connection after waiting 10s, dropping transparent UDP session")
+		return
+	}
+
+	r := c.relay
+	channelID := uuid.New()
+	queue := make(chan BaseMessage, 1000)
+	r.messageQueues.Store(channelID, queue)
+	defer r.messageQueues.Delete(channelID)
+
+	ctx, cancel := context.WithCancel(ctx)
+	r.udpChannels.Store(channelID, cancel)
+	defer func() {
+		cancel()
+		r.udpChannels.Delete(channelID)
+		r.lastActivity.Delete(channelID)
+	}()
+
+	request := ConnectMessage{
+		Protocol:  "udp",
+		ChannelID: channelID,
+	}
+	c.log.Debug().Str("client", session.client.String()).Msg("Requesting transparent UDP channel")
+	connected, err := r.connectChannel(ctx, ws, request, queue, r.option.StrictConnect)
+	if err != nil || !connected {
+		if err != nil {
+			c.log.Debug().Err(err).Msg("Transparent UDP channel failed")
+		}
+		return
+	}
+
+	// Send disconnect message on exit
+	defer func() {
+		disconnectMsg := DisconnectMessage{
+			ChannelID: channelID,
+		}
+		r.logMessage(disconnectMsg, "send", ws.Label())
+		ws.WriteMessage(disconnectMsg)
+	}()
+
+	// Reply sockets are bound to the remote address so replies appear to come from it
+	replies := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, conn := range replies {
+			conn.Close()
+		}
+	}()
+
+	r.updateActivityTime(channelID)
+	idle := time.NewTimer(transparentUDPTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-idle.C:
+			if !end() {
+				idle.Reset(transparentUDPTimeout)
+				continue
+			}
+			c.log.Trace().Str("client", session.client.String()).Msg("Transparent UDP session idle, closing")
+			return
+		case packet := <-session.packets:
+			r.updateActivityTime(channelID)
+			idle.Reset(transparentUDPTimeout)
+
+			msg := DataMessage{
+				Protocol:    "udp",
+				ChannelID:   channelID,
+				Data:        packet.data,
+				TargetAddr:  packet.dst.IP.String(),
+				TargetPort:  packet.dst.Port,
+				Compression: r.determineCompression(ws, packet.data),
+			}
+			r.logMessage(msg, "send", ws.Label())
+			if err := ws.WriteMessage(msg); err != nil {
+				c.log.Debug().Err(err).Msg("Failed to send transparent UDP data")
+				return
+			}
+		case msg := <-queue:
+			dataMsg, ok := msg.(DataMessage)
+			if !ok {
+				c.log.Debug().Str("type", msg.GetType()).Msg("Unexpected message type for data")
+				continue
+			}
+			r.updateActivityTime(channelID)
+			idle.Reset(transparentUDPTimeout)
+
+			from := &net.UDPAddr{IP: net.ParseIP(dataMsg.Address), Port: dataMsg.Port}
+			if from.IP == nil {
+				c.log.Debug().Str("addr", dataMsg.Address).Msg("Dropping transparent UDP reply from unparsable address")
+				continue
+			}
+			if ip4 := from.IP.To4(); ip4 != nil {
+				from.IP = ip4
+			}
+
+			key := from.String()
+			reply, exists := replies[key]
+			if !exists {
+				reply, err = dialTransparentUDP(ctx, from)
+				if err != nil {
+					c.log.Debug().Err(err).Str("from", key).Msg("Failed to bind transparent UDP reply socket")
+					continue
+				}
+				replies[key] = reply
+			}
+			if _, err := reply.WriteToUDP(dataMsg.Data, session.client); err != nil {
+				c.log.Debug().Err(err).Msg("Failed to write transparent UDP reply")
+				continue
+			}
+			c.log.Trace().Int("size", len(dataMsg.Data)).Str("from", key).Msg("Sent UDP data to transparent client")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+//go:build linux
+
+package wssocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST, the IPv6 counterpart of SO_ORIGINAL_DST
+const ip6tSoOriginalDst = 80
+
+// transparentControl enables IP_TRANSPARENT so the socket can receive TPROXY traffic
+// and bind to non-local addresses
+func transparentControl(network string, fd int, recvOrigDst bool) error {
+	if strings.HasSuffix(network, "6") {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("set IPV6_TRANSPARENT: %w", err)
+		}
+		if recvOrigDst {
+			if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				return fmt.Errorf("set IPV6_RECVORIGDSTADDR: %w", err)
+			}
+		}
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil && !strings.HasSuffix(network, "6") {
+		return fmt.Errorf("set IP_TRANSPARENT: %w", err)
+	}
+	if recvOrigDst {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil && !strings.HasSuffix(network, "6") {
+			return fmt.Errorf("set IP_RECVORIGDSTADDR: %w", err)
+		}
+	}
+	return nil
+}
+
+// listenTransparentTCP listens for TCP connections redirected by REDIRECT or TPROXY rules.
+// IP_TRANSPARENT is enabled when permitted; REDIRECT works without it.
+func listenTransparentTCP(ctx context.Context, network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			return rc.Control(func(fd uintptr) {
+				// Best effort, only TPROXY needs it and it requires CAP_NET_ADMIN
+				transparentControl(network, int(fd), false)
+			})
+		},
+	}
+	return lc.Listen(ctx, network, address)
+}
+
+// listenTransparentUDP listens for UDP datagrams redirected by TPROXY rules
+func listenTransparentUDP(ctx context.Context, network, address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var sockErr error
+			if err := rc.Control(func(fd uintptr) {
+				sockErr = transparentControl(network, int(fd), true)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDestination recovers the destination a redirected TCP connection was addressed to.
+// SO_ORIGINAL_DST covers REDIRECT; for TPROXY the local address is the original destination.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("invalid local address")
+	}
+
+	rc, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in: family(2) + port(2) + addr(4)
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+			}
+			return
+		}
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		dst = &net.TCPAddr{
+			IP:   ip,
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	if sockErr != nil {
+		// Not redirected through conntrack, assume TPROXY
+		return local, nil
+	}
+	return dst, nil
+}
+
+// readTransparentUDP reads a TPROXY datagram along with its source and original destination
+func readTransparentUDP(conn *net.UDPConn, buffer, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, src, err := conn.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if ip4 := src.IP.To4(); ip4 != nil {
+		src.IP = ip4
+	}
+
+	dst, err := transparentUDPDestination(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, src, dst, nil
+}
+
+// transparentUDPDestination returns the original destination carried by the control messages
+// of a TPROXY datagram
+func transparentUDPDestination(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("parse control message: %w", err)
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch addr := sa.(type) {
+		case *unix.SockaddrInet4:
+			return &net.UDPAddr{IP: net.IP(addr.Addr[:]).To4(), Port: addr.Port}, nil
+		case *unix.SockaddrInet6:
+			ip := net.IP(addr.Addr[:])
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			return &net.UDPAddr{IP: ip, Port: addr.Port}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination in control message")
+}
+
+// dialTransparentUDP opens a UDP socket bound to a (possibly non-local) address for sending
+// replies to transparent clients on behalf of the remote peer
+func dialTransparentUDP(ctx context.Context, from *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if from.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var sockErr error
+			if err := rc.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				sockErr = transparentControl(network, int(fd), false)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, network, from.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,58 @@
+package wssocks
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// origDstControlMessage builds the control message TPROXY attaches to a datagram sent to ip:port
+// on an IPv4 or IPv6 socket
+func origDstControlMessage(ip net.IP, port int, ipv6 bool) []byte {
+	level, typ, size := unix.SOL_IP, unix.IP_ORIGDSTADDR, unix.SizeofSockaddrInet4
+	if ipv6 {
+		level, typ, size = unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, unix.SizeofSockaddrInet6
+	}
+
+	oob := make([]byte, unix.CmsgSpace(size))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = int32(level)
+	header.Type = int32(typ)
+	header.SetLen(unix.CmsgLen(size))
+
+	data := unsafe.Pointer(&oob[unix.CmsgLen(0)])
+	if !ipv6 {
+		sa := (*unix.RawSockaddrInet4)(data)
+		sa.Family = unix.AF_INET
+		copy(sa.Addr[:], ip.To4())
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = [2]byte{byte(port >> 8), byte(port)}
+	} else {
+		sa := (*unix.RawSockaddrInet6)(data)
+		sa.Family = unix.AF_INET6
+		copy(sa.Addr[:], ip.To16())
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = [2]byte{byte(port >> 8), byte(port)}
+	}
+	return oob
+}
+
+func TestTransparentUDPDestination(t *testing.T) {
+	dst, err := transparentUDPDestination(origDstControlMessage(net.ParseIP("192.0.2.1"), 53, false))
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:53", dst.String())
+	require.Len(t, dst.IP, net.IPv4len)
+
+	dst, err = transparentUDPDestination(origDstControlMessage(net.ParseIP("2001:db8::1"), 443, true))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:443", dst.String())
+
+	// IPv4-mapped destinations of dual-stack sockets are reported as IPv4
+	dst, err = transparentUDPDestination(origDstControlMessage(net.ParseIP("::ffff:192.0.2.1"), 53, true))
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:53", dst.String())
+
+	_, err = transparentUDPDestination(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package wssocks
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+func listenTransparentTCP(ctx context.Context, network, address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(ctx context.Context, network, address string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func readTransparentUDP(conn *net.UDPConn, buffer, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
+
+func dialTransparentUDP(ctx context.Context, from *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
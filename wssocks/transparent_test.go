@@ -0,0 +1,38 @@
+package wssocks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransparentNetwork(t *testing.T) {
+	require.Equal(t, "tcp4", transparentNetwork("tcp", "0.0.0.0"))
+	require.Equal(t, "tcp4", transparentNetwork("tcp", "127.0.0.1"))
+	require.Equal(t, "udp6", transparentNetwork("udp", "::"))
+	require.Equal(t, "udp6", transparentNetwork("udp", "::1"))
+	require.Equal(t, "tcp", transparentNetwork("tcp", ""))
+	require.Equal(t, "udp", transparentNetwork("udp", "localhost"))
+}
+
+func TestTransparentLoop(t *testing.T) {
+	c := &WSSocksClient{transparentPort: 12345}
+
+	// Destinations at the listener port on local addresses point back at the proxy
+	require.True(t, c.isTransparentLoop(net.ParseIP("127.0.0.1"), 12345))
+	require.True(t, c.isTransparentLoop(net.ParseIP("::1"), 12345))
+	require.True(t, c.isTransparentLoop(net.IPv4zero, 12345))
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			require.True(t, c.isTransparentLoop(ipNet.IP, 12345), "address %s", ipNet.IP)
+		}
+	}
+
+	// Other ports and remote addresses are relayed
+	require.False(t, c.isTransparentLoop(net.ParseIP("127.0.0.1"), 80))
+	require.False(t, c.isTransparentLoop(net.ParseIP("192.0.2.1"), 12345))
+	require.False(t, c.isTransparentLoop(net.ParseIP("2001:db8::1"), 12345))
+}
@@ -0,0 +1,226 @@
+package wssocks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports carrying the messages between clients and servers. WebSocket is used by default,
+// the HTTP transports are for networks where the WebSocket upgrade is blocked.
+// The TCP and QUIC transports listen on their own ports and avoid the framing overhead of the
+// others.
+const (
+	TransportWebSocket = "websocket"
+	TransportStream    = "stream" // Frames streamed in a full-duplex HTTP POST, over HTTP/2 or HTTP/1.1
+	TransportPoll      = "poll"   // Frames exchanged with plain HTTP long-polling requests
+	TransportTCP       = "tcp"    // Frames sent directly over TLS, for servers reached without a CDN
+	TransportQUIC      = "quic"   // Frames sent over TLS on reliable UDP, for servers reached without a CDN
+)
+
+const (
+	// Time to wait for the server to accept an HTTP transport before giving up on it
+	transportHandshakeTimeout = 15 * time.Second
+	// Interval of the keepalive frames of transports without control messages
+	keepaliveInterval = 15 * time.Second
+	// Time without any frame after which such a transport is considered dead
+	keepaliveTimeout = 3 * keepaliveInterval
+)
+
+var (
+	errTransportClosed  = errors.New("transport closed")
+	errKeepaliveTimeout = errors.New("transport keepalive timeout")
+)
+
+// Transport carries the binary messages of a WSConn between a client and a server
+type Transport interface {
+	// ReadFrame returns the next message frame
+	ReadFrame() ([]byte, error)
+	// WriteFrame sends a message frame, which may be reused once it returns. Calls are
+	// serialized by the WSConn.
+	WriteFrame(frame []byte) error
+	// Close closes the transport, making pending and later reads and writes fail
+	Close() error
+}
+
+// controlWriter is implemented by transports with control messages, used for heartbeats
+type controlWriter interface {
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// websocketTransport carries messages as binary WebSocket messages
+type websocketTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *websocketTransport) ReadFrame() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+
+func (t *websocketTransport) WriteFrame(frame []byte) error {
+	return t.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (t *websocketTransport) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return t.conn.WriteControl(messageType, data, deadline)
+}
+
+func (t *websocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+// keepaliveTransport checks the liveness of a transport over a byte stream, which has no
+// control messages to ping the peer with. An empty frame is sent when nothing was written for
+// an interval, and the transport is closed when nothing was read for the timeout.
+type keepaliveTransport struct {
+	Transport
+	interval time.Duration
+	timeout  time.Duration
+
+	mu        sync.Mutex // Serializes the keepalive frames with the writes of the WSConn
+	lastWrite atomic.Int64
+	expired   atomic.Bool
+	timer     *time.Timer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newKeepaliveTransport(t Transport, interval, timeout time.Duration) *keepaliveTransport {
+	k := &keepaliveTransport{
+		Transport: t,
+		interval:  interval,
+		timeout:   timeout,
+		done:      make(chan struct{}),
+	}
+	k.lastWrite.Store(time.Now().UnixNano())
+	k.timer = time.AfterFunc(timeout, func() {
+		k.expired.Store(true)
+		k.Close()
+	})
+	go k.keepalive()
+	return k
+}
+
+// ReadFrame returns the next frame, skipping the keepalive frames of the peer
+func (k *keepaliveTransport) ReadFrame() ([]byte, error) {
+	for {
+		frame, err := k.Transport.ReadFrame()
+		if err != nil {
+			if k.expired.Load() {
+				return nil, errKeepaliveTimeout
+			}
+			return nil, err
+		}
+		k.timer.Reset(k.timeout)
+		if len(frame) > 0 {
+			return frame, nil
+		}
+	}
+}
+
+func (k *keepaliveTransport) WriteFrame(frame []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lastWrite.Store(time.Now().UnixNano())
+	return k.Transport.WriteFrame(frame)
+}
+
+func (k *keepaliveTransport) Close() error {
+	var err error
+	k.closeOnce.Do(func() {
+		close(k.done)
+		k.timer.Stop()
+		err = k.Transport.Close()
+	})
+	return err
+}
+
+// keepalive writes an empty frame whenever nothing was written for an interval
+func (k *keepaliveTransport) keepalive() {
+	ticker := time.NewTicker(k.interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, k.lastWrite.Load())) < k.interval {
+				continue
+			}
+			if err := k.WriteFrame(nil); err != nil {
+				k.Close()
+				return
+			}
+		}
+	}
+}
+
+// parseTransportScheme returns the transport selected by a URL scheme and the scheme used to
+// reach the server, e.g. "https+poll" selects the poll transport over https
+func parseTransportScheme(scheme string) (string, string, error) {
+	switch scheme {
+	case "tcp+tls":
+		return TransportTCP, "tls", nil
+	case "quic":
+		return TransportQUIC, "udp", nil
+	}
+
+	base, transport, found := strings.Cut(scheme, "+")
+	if !found {
+		return TransportWebSocket, scheme, nil
+	}
+	switch transport {
+	case TransportStream, TransportPoll:
+		if base != "http" && base != "https" {
+			return "", "", fmt.Errorf("unsupported scheme for %s transport: %s", transport, scheme)
+		}
+		return transport, base, nil
+	default:
+		return "", "", fmt.Errorf("unsupported transport: %s", transport)
+	}
+}
+
+// httpTransportURL returns the URL of an HTTP transport endpoint below the WebSocket path of
+// the server, e.g. /socket/poll for /socket
+func httpTransportURL(u *url.URL, scheme, transport string) string {
+	endpoint := *u
+	switch scheme {
+	case "ws":
+		scheme = "http"
+	case "wss":
+		scheme = "https"
+	}
+	endpoint.Scheme = scheme
+	endpoint.Path = strings.TrimSuffix(u.Path, "/") + "/" + transport
+	endpoint.RawPath = ""
+	return endpoint.String()
+}
+
+// transportStatusError is returned when an HTTP transport endpoint rejects a request
+type transportStatusError struct {
+	transport string
+	status    string
+}
+
+func (e *transportStatusError) Error() string {
+	return fmt.Sprintf("%s transport rejected: %s", e.transport, e.status)
+}
+
+// newTransportHTTPClient returns the HTTP client used by the HTTP transports, using HTTP/2 when
+// the server supports it
+func newTransportHTTPClient(noEnvProxy bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	if noEnvProxy {
+		transport.Proxy = nil
+	}
+	return &http.Client{Transport: transport}
+}
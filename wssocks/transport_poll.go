@@ -0,0 +1,524 @@
+package wssocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Time a poll request waits for frames before returning empty
+	pollWait = 20 * time.Second
+	// Sessions without requests for this long are closed
+	pollSessionTimeout = 60 * time.Second
+	// Maximum size of the frames returned by a poll request or sent by one
+	pollBatchSize = 1024 * 1024
+	// Frames queued in each direction of a session
+	pollQueueSize = 256
+	// Failed requests retried in a row before the client gives up on a session
+	pollRetries = 3
+	// Delay before retrying a failed request
+	pollRetryDelay = time.Second
+)
+
+// The poll transport exchanges frames with plain HTTP requests to the poll endpoint:
+//
+//	POST   /socket/poll?<auth query>          opens a session, its ID is the response body
+//	POST   /socket/poll?session=ID&seq=N      sends the frames in the request body
+//	GET    /socket/poll?session=ID&ack=N      waits for frames and returns them in the response body
+//	DELETE /socket/poll?session=ID            closes the session
+//
+// Bodies hold length-prefixed frames as written by FrameWriter. Batches are numbered in each
+// direction so that failed requests can be retried without losing or duplicating frames: the
+// sequence number of a returned batch is in the X-Poll-Seq header, and the batch is sent again
+// until a poll request acknowledges it, while batches sent again by the client are dropped.
+
+// pollServerTransport is the server side of a poll session
+type pollServerTransport struct {
+	incoming chan []byte // Frames sent by the client
+	outgoing chan []byte // Frames waiting for a poll request
+
+	sendMu  sync.Mutex // Serializes poll requests
+	seq     uint64     // Sequence number of the last batch returned
+	pending []byte     // Last batch returned, until it is acknowledged
+
+	receiveMu sync.Mutex
+	received  uint64 // Sequence number of the last batch sent by the client
+
+	timer     *time.Timer // Closes the session when the client stops polling
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newPollServerTransport(onClose func()) *pollServerTransport {
+	t := &pollServerTransport{
+		incoming: make(chan []byte, pollQueueSize),
+		outgoing: make(chan []byte, pollQueueSize),
+		done:     make(chan struct{}),
+		onClose:  onClose,
+	}
+	t.timer = time.AfterFunc(pollSessionTimeout, func() { t.Close() })
+	return t
+}
+
+func (t *pollServerTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.incoming:
+		return frame, nil
+	case <-t.done:
+		return nil, errTransportClosed
+	}
+}
+
+func (t *pollServerTransport) WriteFrame(frame []byte) error {
+	// The frame is queued, so it must not share the buffer of the caller
+	frame = append([]byte(nil), frame...)
+	select {
+	case t.outgoing <- frame:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	}
+}
+
+func (t *pollServerTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.timer.Stop()
+		close(t.done)
+		t.onClose()
+	})
+	return nil
+}
+
+// touch postpones the expiry of the session
+func (t *pollServerTransport) touch() {
+	t.timer.Reset(pollSessionTimeout)
+}
+
+// receive queues the frames of batch seq sent by the client in body, unless it was already
+// received. Batches without sequence number are always queued.
+func (t *pollServerTransport) receive(body io.Reader, seq uint64) error {
+	// Read the whole batch first, so a truncated request queues nothing
+	var frames [][]byte
+	reader := NewFrameReader(io.LimitReader(body, pollBatchSize))
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+
+	t.receiveMu.Lock()
+	defer t.receiveMu.Unlock()
+	if seq != 0 && seq <= t.received {
+		return nil
+	}
+	for _, frame := range frames {
+		select {
+		case t.incoming <- frame:
+		case <-t.done:
+			return errTransportClosed
+		}
+	}
+	if seq != 0 {
+		t.received = seq
+	}
+	return nil
+}
+
+// send returns the batch for a poll request acknowledging the batches up to ack and its
+// sequence number. The last batch is returned again if it was not acknowledged, otherwise
+// queued frames are waited for, returning a nil batch if none were queued.
+func (t *pollServerTransport) send(ctx context.Context, ack uint64) ([]byte, uint64, error) {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	if t.pending != nil {
+		if ack < t.seq {
+			// The response carrying the batch was lost
+			return t.pending, t.seq, nil
+		}
+		t.pending = nil
+	}
+
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+
+	var frame []byte
+	select {
+	case frame = <-t.outgoing:
+	case <-t.done:
+		return nil, 0, errTransportClosed
+	case <-timer.C:
+		return nil, 0, nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+
+	// Batch the frames queued meanwhile
+	var buf bytes.Buffer
+	writer := NewFrameWriter(&buf)
+	for {
+		if err := writer.WriteFrame(frame); err != nil {
+			return nil, 0, err
+		}
+		if buf.Len() >= pollBatchSize {
+			break
+		}
+		select {
+		case frame = <-t.outgoing:
+			continue
+		default:
+		}
+		break
+	}
+	t.seq++
+	t.pending = buf.Bytes()
+	return t.pending, t.seq, nil
+}
+
+// servePoll serves the requests of clients connecting with the poll transport
+func (s *WSSocksServer) servePoll(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.openPollSession(ctx, w, r)
+		return
+	}
+
+	value, ok := s.pollSessions.Load(sessionID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusGone)
+		return
+	}
+	transport := value.(*pollServerTransport)
+	transport.touch()
+	defer transport.touch()
+
+	switch r.Method {
+	case http.MethodGet:
+		// Requests without acknowledgement acknowledge every batch
+		ack, err := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64)
+		if err != nil {
+			ack = math.MaxUint64
+		}
+		batch, seq, err := transport.send(r.Context(), ack)
+		if err == errTransportClosed {
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if batch == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Poll-Seq", strconv.FormatUint(seq, 10))
+		w.Write(batch)
+	case http.MethodPost:
+		seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		if err := transport.receive(r.Body, seq); err != nil {
+			if err == errTransportClosed {
+				http.Error(w, "session closed", http.StatusGone)
+			} else {
+				http.Error(w, "invalid frames", http.StatusBadRequest)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		transport.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// openPollSession creates a poll session and serves its connection in the background
+func (s *WSSocksServer) openPollSession(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sessionID := uuid.New().String()
+	transport := newPollServerTransport(func() {
+		s.pollSessions.Delete(sessionID)
+	})
+	s.pollSessions.Store(sessionID, transport)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			transport.Close()
+		case <-transport.done:
+		}
+	}()
+	// The request is only used for its URL and headers once the handler returned
+	go s.handleConnection(ctx, NewTransportConn(transport, ""), r.Clone(context.Background()))
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, sessionID)
+}
+
+// pollClientTransport is the client side of a poll session
+type pollClientTransport struct {
+	client     *http.Client
+	sessionURL string
+
+	incoming chan []byte
+	outgoing chan []byte
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// dialPoll opens a poll session on a server
+func dialPoll(ctx context.Context, client *http.Client, endpoint string, timeout time.Duration) (*pollClientTransport, error) {
+	openCtx, cancelOpen := context.WithTimeout(ctx, timeout)
+	defer cancelOpen()
+	req, err := http.NewRequestWithContext(openCtx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &transportStatusError{transport: TransportPoll, status: resp.Status}
+	}
+	sessionID, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"session": {strings.TrimSpace(string(sessionID))}}.Encode()
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &pollClientTransport{
+		client:     client,
+		sessionURL: u.String(),
+		incoming:   make(chan []byte, pollQueueSize),
+		outgoing:   make(chan []byte, pollQueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	go t.receiveLoop()
+	go t.sendLoop()
+	return t, nil
+}
+
+func (t *pollClientTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.incoming:
+		return frame, nil
+	case <-t.ctx.Done():
+		return nil, errTransportClosed
+	}
+}
+
+func (t *pollClientTransport) WriteFrame(frame []byte) error {
+	// The frame is queued, so it must not share the buffer of the caller
+	frame = append([]byte(nil), frame...)
+	select {
+	case t.outgoing <- frame:
+		return nil
+	case <-t.ctx.Done():
+		return errTransportClosed
+	}
+}
+
+func (t *pollClientTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		// Tell the server, so it does not wait for the session to expire
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.sessionURL, nil); err == nil {
+				if resp, err := t.client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+// errPollSession is returned when the server rejects the requests of a session, which is
+// not worth retrying
+var errPollSession = errors.New("poll session rejected")
+
+// retry waits before retrying a request failed with err, returning false if the session ends
+// instead
+func (t *pollClientTransport) retry(err error, failures int) bool {
+	if errors.Is(err, errPollSession) || failures > pollRetries {
+		return false
+	}
+	select {
+	case <-time.After(pollRetryDelay):
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// poll waits for the frames of the server, acknowledging the batches up to ack, and returns
+// them with the sequence number of their batch, or no frames if none were queued
+func (t *pollClientTransport) poll(ack uint64) ([][]byte, uint64, error) {
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodGet, t.sessionURL+"&ack="+strconv.FormatUint(ack, 10), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil, 0, nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, 0, &transportStatusError{transport: TransportPoll, status: resp.Status}
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, errPollSession
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get("X-Poll-Seq"), 10, 64)
+	if err != nil {
+		return nil, 0, errPollSession
+	}
+
+	// Only deliver complete batches, a batch cut short is returned again by the next poll
+	var frames [][]byte
+	reader := NewFrameReader(resp.Body)
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			return frames, seq, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// receiveLoop polls the server for frames until the session ends
+func (t *pollClientTransport) receiveLoop() {
+	defer t.Close()
+	var ack uint64
+	failures := 0
+	for {
+		frames, seq, err := t.poll(ack)
+		if err != nil {
+			failures++
+			if t.ctx.Err() != nil || !t.retry(err, failures) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		if seq <= ack {
+			continue
+		}
+		ack = seq
+
+		for _, frame := range frames {
+			select {
+			case t.incoming <- frame:
+			case <-t.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// push sends a batch of frames with its sequence number
+func (t *pollClientTransport) push(batch []byte, seq uint64) error {
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost, t.sessionURL+"&seq="+strconv.FormatUint(seq, 10), bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return &transportStatusError{transport: TransportPoll, status: resp.Status}
+	default:
+		return errPollSession
+	}
+}
+
+// sendLoop sends the queued frames in batches until the session ends
+func (t *pollClientTransport) sendLoop() {
+	defer t.Close()
+	var buf bytes.Buffer
+	writer := NewFrameWriter(&buf)
+	var seq uint64
+	for {
+		select {
+		case frame := <-t.outgoing:
+			buf.Reset()
+			if err := writer.WriteFrame(frame); err != nil {
+				return
+			}
+			// Batch the frames queued meanwhile
+		batch:
+			for buf.Len() < pollBatchSize {
+				select {
+				case frame := <-t.outgoing:
+					if err := writer.WriteFrame(frame); err != nil {
+						return
+					}
+				default:
+					break batch
+				}
+			}
+		case <-t.ctx.Done():
+			return
+		}
+
+		// Batches sent again after a failure are dropped by the server if already received
+		seq++
+		for failures := 1; ; failures++ {
+			err := t.push(buf.Bytes(), seq)
+			if err == nil {
+				break
+			}
+			if t.ctx.Err() != nil || !t.retry(err, failures) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package wssocks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The QUIC transport carries the same TLS stream as the TLS/TCP transport over UDP, for
+// networks where UDP fares better than TCP. Like QUIC, each connection is identified by a
+// random ID chosen by the client and made reliable by acknowledging and retransmitting packets,
+// but it carries a single stream with a fixed window and is not compatible with QUIC itself.
+//
+// Packets start with Type(1) + ConnID(8), followed by:
+//   - data:  Seq(8) + Ack(8) + Payload(N), Ack being the next sequence number expected
+//   - ack:   Ack(8) + Seq(8), Seq being the data packet acknowledged, received out of order or not
+//   - close: nothing, the sender discarded the connection
+const (
+	quicPacketData  byte = 1
+	quicPacketAck   byte = 2
+	quicPacketClose byte = 3
+)
+
+const (
+	quicHeaderSize     = 9
+	quicDataHeaderSize = quicHeaderSize + 16
+	// Payload of data packets, keeping them below the minimum IPv6 MTU
+	quicMaxPayload = 1200
+	// Packets in flight, and packets buffered by the receiver ahead of the reader
+	quicWindow = 256
+	// Bounds of the retransmission timeout, derived from the measured round trip time
+	quicMinRTO = 100 * time.Millisecond
+	quicMaxRTO = 5 * time.Second
+	// Times a packet is overtaken by later ones before it is considered lost
+	quicReorderThreshold = 3
+	// Time a closed connection keeps retransmitting the data not yet acknowledged
+	quicLinger = 5 * time.Second
+)
+
+// errQUICTimeout is returned when packets were not acknowledged for the keepalive timeout
+var errQUICTimeout = errors.New("quic transport timeout")
+
+// quicStream is a reliable, ordered byte stream over UDP packets, on which TLS runs
+type quicStream struct {
+	id      uint64
+	local   net.Addr
+	remote  net.Addr
+	output  func(packet []byte) error // Sends a packet to the peer
+	release func()                    // Called once when the stream ends
+
+	mu      sync.Mutex
+	changed chan struct{} // Closed and replaced on state changes, waking blocked calls
+	done    chan struct{} // Closed when the stream ends
+	err     error         // Error of the ended stream
+
+	// Sending side
+	sendNext uint64
+	inflight []*quicSegment // Packets not yet acknowledged, by sequence number
+	srtt     time.Duration
+	rto      time.Duration
+
+	// Receiving side
+	recvNext   uint64
+	pending    map[uint64][]byte // Packets received ahead of recvNext
+	readBuf    []byte
+	peerClosed bool
+
+	closing       bool
+	closedAt      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// quicSegment is a data packet waiting to be acknowledged
+type quicSegment struct {
+	seq       uint64
+	data      []byte
+	first     time.Time // First sent
+	sent      time.Time // Last sent
+	retries   int
+	received  bool // Acknowledged out of order, waiting for the packets before it
+	overtaken int  // Packets sent after this one and acknowledged since it was last sent
+}
+
+func newQUICStream(id uint64, local, remote net.Addr, output func([]byte) error, release func()) *quicStream {
+	s := &quicStream{
+		id:      id,
+		local:   local,
+		remote:  remote,
+		output:  output,
+		release: release,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+		rto:     4 * quicMinRTO,
+		pending: make(map[uint64][]byte),
+	}
+	go s.retransmitLoop()
+	return s
+}
+
+func (s *quicStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.readBuf) == 0 {
+		switch {
+		case s.closing:
+			return 0, net.ErrClosed
+		case s.err != nil:
+			return 0, s.err
+		case s.peerClosed:
+			return 0, io.EOF
+		}
+		if !s.wait(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	if len(s.readBuf) == 0 {
+		s.readBuf = nil
+	}
+	return n, nil
+}
+
+func (s *quicStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		switch {
+		case s.closing:
+			return written, net.ErrClosed
+		case s.err != nil:
+			return written, s.err
+		case s.peerClosed:
+			return written, io.ErrClosedPipe
+		}
+		if len(s.inflight) >= quicWindow {
+			if !s.wait(s.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+
+		n := len(b) - written
+		if n > quicMaxPayload {
+			n = quicMaxPayload
+		}
+		seg := &quicSegment{seq: s.sendNext, data: append([]byte(nil), b[written:written+n]...)}
+		s.sendNext++
+		s.inflight = append(s.inflight, seg)
+		s.transmit(seg, time.Now())
+		written += n
+	}
+	return written, nil
+}
+
+// Close ends the stream once the data written is acknowledged, or after lingering for it
+func (s *quicStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing || s.err != nil {
+		return nil
+	}
+	s.closing = true
+	s.closedAt = time.Now()
+	s.broadcast()
+	if len(s.inflight) == 0 || s.peerClosed {
+		s.finish()
+	}
+	return nil
+}
+
+// abort ends the stream at once, e.g. when its UDP socket fails
+func (s *quicStream) abort(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminate(err)
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.local }
+func (s *quicStream) RemoteAddr() net.Addr { return s.remote }
+
+func (s *quicStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.broadcast()
+	return nil
+}
+
+func (s *quicStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *quicStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
+
+// handle processes a packet of the peer, without its header
+func (s *quicStream) handle(kind byte, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	switch kind {
+	case quicPacketData:
+		if len(body) < quicDataHeaderSize-quicHeaderSize {
+			return
+		}
+		s.acknowledge(binary.BigEndian.Uint64(body[8:]))
+		if s.err == nil {
+			seq := binary.BigEndian.Uint64(body)
+			s.receive(seq, body[16:])
+			// Every data packet is acknowledged, so lost acknowledgements are sent again
+			ack := make([]byte, 16)
+			binary.BigEndian.PutUint64(ack, s.recvNext)
+			binary.BigEndian.PutUint64(ack[8:], seq)
+			s.sendPacket(quicPacketAck, ack)
+		}
+	case quicPacketAck:
+		if len(body) < 16 {
+			return
+		}
+		s.acknowledgeOne(binary.BigEndian.Uint64(body[8:]))
+		s.acknowledge(binary.BigEndian.Uint64(body))
+	case quicPacketClose:
+		s.peerClosed = true
+		s.broadcast()
+		if s.closing {
+			s.terminate(net.ErrClosed)
+		}
+	}
+}
+
+// receive buffers the payload of a data packet, dropping packets outside of the window or
+// that the reader has no room for, which the peer sends again
+func (s *quicStream) receive(seq uint64, payload []byte) {
+	if seq < s.recvNext || seq >= s.recvNext+quicWindow || len(s.readBuf) >= quicWindow*quicMaxPayload {
+		return
+	}
+	if _, ok := s.pending[seq]; !ok {
+		s.pending[seq] = append([]byte(nil), payload...)
+	}
+
+	delivered := false
+	for {
+		data, ok := s.pending[s.recvNext]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.recvNext)
+		s.readBuf = append(s.readBuf, data...)
+		s.recvNext++
+		delivered = true
+	}
+	if delivered {
+		s.broadcast()
+	}
+}
+
+// acknowledgeOne marks an inflight packet as received, updating the round trip time if it was
+// sent only once. The packets sent before it and still missing are sent again once it overtook
+// them enough times, without waiting for the retransmission timeout.
+func (s *quicStream) acknowledgeOne(seq uint64) {
+	var acked *quicSegment
+	for _, seg := range s.inflight {
+		if seg.seq == seq {
+			acked = seg
+			break
+		}
+	}
+	if acked == nil || acked.received {
+		return
+	}
+	acked.received = true
+
+	now := time.Now()
+	if acked.retries == 0 {
+		rtt := now.Sub(acked.sent)
+		if s.srtt == 0 {
+			s.srtt = rtt
+		} else {
+			s.srtt = (7*s.srtt + rtt) / 8
+		}
+		s.rto = 2 * s.srtt
+		if s.rto < quicMinRTO {
+			s.rto = quicMinRTO
+		} else if s.rto > quicMaxRTO {
+			s.rto = quicMaxRTO
+		}
+	}
+	for _, seg := range s.inflight {
+		if seg.seq >= seq {
+			break
+		}
+		if seg.received || seg.sent.After(acked.sent) {
+			continue
+		}
+		seg.overtaken++
+		if seg.overtaken >= quicReorderThreshold {
+			seg.retries++
+			s.transmit(seg, now)
+		}
+	}
+}
+
+// acknowledge drops the packets before ack from the inflight ones
+func (s *quicStream) acknowledge(ack uint64) {
+	acked := 0
+	for acked < len(s.inflight) && s.inflight[acked].seq < ack {
+		acked++
+	}
+	if acked == 0 {
+		return
+	}
+	s.inflight = s.inflight[acked:]
+	s.broadcast()
+	if s.closing && len(s.inflight) == 0 {
+		s.finish()
+	}
+}
+
+// retransmitLoop sends again the packets not acknowledged in time
+func (s *quicStream) retransmitLoop() {
+	ticker := time.NewTicker(quicMinRTO / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.retransmit(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *quicStream) retransmit(now time.Time) {
+	if len(s.inflight) == 0 {
+		return
+	}
+	if now.Sub(s.inflight[0].first) > keepaliveTimeout {
+		s.terminate(errQUICTimeout)
+		return
+	}
+	if s.closing && now.Sub(s.closedAt) > quicLinger {
+		s.finish()
+		return
+	}
+	for _, seg := range s.inflight {
+		// Back off exponentially on packets lost again
+		rto := s.rto
+		for i := 0; i < seg.retries && rto < quicMaxRTO; i++ {
+			rto *= 2
+		}
+		if !seg.received && now.Sub(seg.sent) >= rto {
+			seg.retries++
+			s.transmit(seg, now)
+		}
+	}
+}
+
+// transmit sends a data packet, acknowledging the packets received so far
+func (s *quicStream) transmit(seg *quicSegment, now time.Time) {
+	if seg.first.IsZero() {
+		seg.first = now
+	}
+	seg.sent = now
+	seg.overtaken = 0
+	body := make([]byte, 16, 16+len(seg.data))
+	binary.BigEndian.PutUint64(body, seg.seq)
+	binary.BigEndian.PutUint64(body[8:], s.recvNext)
+	s.sendPacket(quicPacketData, append(body, seg.data...))
+}
+
+// sendPacket sends a packet to the peer, losses being recovered by retransmissions
+func (s *quicStream) sendPacket(kind byte, body []byte) {
+	packet := make([]byte, quicHeaderSize, quicHeaderSize+len(body))
+	packet[0] = kind
+	binary.BigEndian.PutUint64(packet[1:], s.id)
+	s.output(append(packet, body...))
+}
+
+// finish tells the peer the stream is closed and ends it
+func (s *quicStream) finish() {
+	s.sendPacket(quicPacketClose, nil)
+	s.terminate(net.ErrClosed)
+}
+
+// terminate ends the stream with an error, with s.mu held
+func (s *quicStream) terminate(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.broadcast()
+	s.release()
+}
+
+// broadcast wakes the blocked reads and writes, with s.mu held
+func (s *quicStream) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait releases s.mu until the state changes, returning false if the deadline passed
+func (s *quicStream) wait(deadline time.Time) bool {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return false
+	}
+	changed := s.changed
+	s.mu.Unlock()
+	defer s.mu.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// quicListener demultiplexes the packets received on the UDP socket of a server into the
+// streams of its clients
+type quicListener struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	streams map[uint64]*quicStream
+	closed  bool
+}
+
+func newQUICListener(conn net.PacketConn) *quicListener {
+	return &quicListener{
+		conn:    conn,
+		streams: make(map[uint64]*quicStream),
+	}
+}
+
+// serve reads packets until the socket is closed, calling handle with each new stream
+func (l *quicListener) serve(handle func(net.Conn)) {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.conn.ReadFrom(buffer)
+		if err != nil {
+			l.Close()
+			return
+		}
+		if n < quicHeaderSize {
+			continue
+		}
+		packet := buffer[:n]
+		kind, id := packet[0], binary.BigEndian.Uint64(packet[1:])
+
+		l.mu.Lock()
+		stream := l.streams[id]
+		if stream == nil {
+			// Streams are opened by the first data packet of a client
+			if l.closed || kind != quicPacketData || n < quicDataHeaderSize || binary.BigEndian.Uint64(packet[quicHeaderSize:]) != 0 {
+				l.mu.Unlock()
+				continue
+			}
+			stream = l.open(id, addr)
+			go handle(stream)
+		}
+		l.mu.Unlock()
+
+		// Packets of other addresses are dropped, streams do not migrate
+		if addr.String() != stream.remote.String() {
+			continue
+		}
+		stream.handle(kind, packet[quicHeaderSize:])
+	}
+}
+
+// open creates the stream of a new client, with l.mu held
+func (l *quicListener) open(id uint64, addr net.Addr) *quicStream {
+	var stream *quicStream
+	output := func(packet []byte) error {
+		_, err := l.conn.WriteTo(packet, addr)
+		return err
+	}
+	release := func() {
+		l.mu.Lock()
+		if l.streams[id] == stream {
+			delete(l.streams, id)
+		}
+		l.mu.Unlock()
+	}
+	stream = newQUICStream(id, l.conn.LocalAddr(), addr, output, release)
+	l.streams[id] = stream
+	return stream
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close closes the socket and ends the streams of all clients
+func (l *quicListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	streams := make([]*quicStream, 0, len(l.streams))
+	for _, stream := range l.streams {
+		streams = append(streams, stream)
+	}
+	l.mu.Unlock()
+
+	err := l.conn.Close()
+	for _, stream := range streams {
+		stream.abort(net.ErrClosed)
+	}
+	return err
+}
+
+// dialQUIC connects to the QUIC transport of a server at address
+func dialQUIC(ctx context.Context, address string, config *tls.Config, timeout time.Duration) (Transport, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	output := func(packet []byte) error {
+		_, err := conn.Write(packet)
+		return err
+	}
+	stream := newQUICStream(binary.BigEndian.Uint64(id[:]), conn.LocalAddr(), remote, output, func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				// Includes the refusals of servers not listening, failing the handshake early
+				stream.abort(err)
+				return
+			}
+			if n >= quicHeaderSize && binary.BigEndian.Uint64(buffer[1:]) == stream.id {
+				stream.handle(buffer[0], buffer[quicHeaderSize:n])
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConn := tls.Client(stream, clientTLSConfig(config, host))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		stream.abort(err)
+		return nil, err
+	}
+	return newKeepaliveTransport(newTCPTransport(tlsConn), keepaliveInterval, keepaliveTimeout), nil
+}
+
+// listenQUIC starts the QUIC transport listener, serving clients until it is closed
+func (s *WSSocksServer) listenQUIC(ctx context.Context) error {
+	if s.tlsConfig == nil {
+		return errors.New("TLS certificate required for the QUIC transport")
+	}
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(s.wsHost, fmt.Sprint(s.quicPort)))
+	if err != nil {
+		return fmt.Errorf("failed to listen for QUIC transport: %w", err)
+	}
+	listener := newQUICListener(conn)
+
+	s.mu.Lock()
+	s.quicListener = listener
+	s.mu.Unlock()
+
+	s.log.Info().Str("listen", listener.Addr().String()).Msg("QUIC transport started")
+
+	go listener.serve(func(stream net.Conn) {
+		s.handleTLSConn(ctx, tls.Server(stream, s.tlsConfig))
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package wssocks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamServerTransport is the server side of the stream transport, reading the frames of the
+// client from the request body and writing frames to the response
+type streamServerTransport struct {
+	reader     *FrameReader
+	writer     *FrameWriter
+	flusher    http.Flusher
+	controller *http.ResponseController
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (t *streamServerTransport) ReadFrame() ([]byte, error) {
+	return t.reader.ReadFrame()
+}
+
+func (t *streamServerTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The response must not be used once the handler returned
+	if t.closed {
+		return errTransportClosed
+	}
+	if err := t.writer.WriteFrame(frame); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+func (t *streamServerTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	// Closing the request body does not interrupt a pending read, a past deadline does
+	return t.controller.SetReadDeadline(time.Now())
+}
+
+// serveStream serves a client connecting with the stream transport, until the connection ends
+func (s *WSSocksServer) serveStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if r.ProtoMajor < 2 {
+		if err := enableFullDuplex(w); err != nil {
+			s.log.Debug().Err(err).Msg("Refusing stream transport")
+			http.Error(w, "stream transport requires HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+	}
+
+	// Send the headers right away, the client waits for them before sending frames
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	transport := &streamServerTransport{
+		reader:     NewFrameReader(r.Body),
+		writer:     NewFrameWriter(w),
+		flusher:    flusher,
+		controller: http.NewResponseController(w),
+	}
+	s.handleConnection(ctx, NewTransportConn(newKeepaliveTransport(transport, keepaliveInterval, keepaliveTimeout), ""), r)
+}
+
+// streamClientTransport is the client side of the stream transport
+type streamClientTransport struct {
+	reader *FrameReader
+	writer *FrameWriter
+	body   io.ReadCloser
+	pipe   *io.PipeWriter
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+}
+
+// dialStream connects to the stream endpoint of a server, failing if the response headers
+// are not received within timeout, as when a proxy buffers the response
+func dialStream(ctx context.Context, client *http.Client, endpoint string, timeout time.Duration) (Transport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// HTTP/1.1 servers refusing the request would otherwise wait for the body to end before
+	// replying, and the body only ends with the connection
+	req.Close = true
+
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := client.Do(req)
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		pw.Close()
+		cancel()
+		return nil, &transportStatusError{transport: TransportStream, status: "response timeout"}
+	}
+	if err != nil {
+		pw.Close()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		cancel()
+		return nil, &transportStatusError{transport: TransportStream, status: resp.Status}
+	}
+
+	transport := &streamClientTransport{
+		reader: NewFrameReader(resp.Body),
+		writer: NewFrameWriter(pw),
+		body:   resp.Body,
+		pipe:   pw,
+		cancel: cancel,
+	}
+	return newKeepaliveTransport(transport, keepaliveInterval, keepaliveTimeout), nil
+}
+
+func (t *streamClientTransport) ReadFrame() ([]byte, error) {
+	return t.reader.ReadFrame()
+}
+
+func (t *streamClientTransport) WriteFrame(frame []byte) error {
+	return t.writer.WriteFrame(frame)
+}
+
+func (t *streamClientTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		t.pipe.Close()
+		t.body.Close()
+	})
+	return nil
+}
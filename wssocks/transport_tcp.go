@@ -0,0 +1,120 @@
+package wssocks
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// tcpTransport carries messages as length-prefixed frames directly over a TLS connection
+type tcpTransport struct {
+	conn   net.Conn
+	reader *FrameReader
+	writer *FrameWriter
+}
+
+func newTCPTransport(conn net.Conn) *tcpTransport {
+	return &tcpTransport{
+		conn:   conn,
+		reader: NewFrameReader(conn),
+		writer: NewFrameWriter(conn),
+	}
+}
+
+func (t *tcpTransport) ReadFrame() ([]byte, error) {
+	return t.reader.ReadFrame()
+}
+
+func (t *tcpTransport) WriteFrame(frame []byte) error {
+	return t.writer.WriteFrame(frame)
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// dialTCP connects to the TLS/TCP transport of a server at address
+func dialTCP(ctx context.Context, address string, config *tls.Config, timeout time.Duration) (Transport, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: clientTLSConfig(config, host)}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newKeepaliveTransport(newTCPTransport(conn), keepaliveInterval, keepaliveTimeout), nil
+}
+
+// clientTLSConfig returns the TLS config of a transport connecting to host, verifying its name
+// unless the config names another server
+func clientTLSConfig(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// listenTCP starts the TLS/TCP transport listener, serving clients until it is closed
+func (s *WSSocksServer) listenTCP(ctx context.Context) error {
+	if s.tlsConfig == nil {
+		return errors.New("TLS certificate required for the TCP transport")
+	}
+
+	listener, err := tls.Listen("tcp", net.JoinHostPort(s.wsHost, fmt.Sprint(s.tcpPort)), s.tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to listen for TCP transport: %w", err)
+	}
+
+	s.mu.Lock()
+	s.tcpListener = listener
+	s.mu.Unlock()
+
+	s.log.Info().Str("listen", listener.Addr().String()).Msg("TLS/TCP transport started")
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleTLSConn(ctx, conn.(*tls.Conn))
+		}
+	}()
+	return nil
+}
+
+// handleTLSConn completes the TLS handshake of a TLS/TCP or QUIC transport client and serves it
+func (s *WSSocksServer) handleTLSConn(ctx context.Context, conn *tls.Conn) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, transportHandshakeTimeout)
+	err := conn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		s.log.Debug().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("TLS handshake failed")
+		conn.Close()
+		return
+	}
+
+	// Clients authenticate with a message, the request only carries the remote address
+	r := &http.Request{
+		URL:        &url.URL{},
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	transport := newKeepaliveTransport(newTCPTransport(conn), keepaliveInterval, keepaliveTimeout)
+	s.handleConnection(ctx, NewTransportConn(transport, ""), r)
+}
@@ -0,0 +1,40 @@
+package wssocks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepaliveTransport(t *testing.T) {
+	local, remote := net.Pipe()
+	transport := newKeepaliveTransport(newTCPTransport(local), 20*time.Millisecond, 200*time.Millisecond)
+	defer transport.Close()
+	peer := newTCPTransport(remote)
+	defer peer.Close()
+
+	// Idle transports send empty frames
+	frame, err := peer.ReadFrame()
+	require.NoError(t, err)
+	require.Empty(t, frame)
+
+	// Empty frames of the peer are skipped
+	go func() {
+		peer.WriteFrame(nil)
+		peer.WriteFrame([]byte("data"))
+		for {
+			if _, err := peer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	frame, err = transport.ReadFrame()
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), frame)
+
+	// Silent peers are given up on
+	_, err = transport.ReadFrame()
+	require.ErrorIs(t, err, errKeepaliveTimeout)
+}